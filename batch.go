@@ -0,0 +1,187 @@
+package haystack
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+
+	"github.com/nomasters/haystack/needle"
+)
+
+// defaultMaxDatagramBytes is a conservative datagram size that fits within the MTU of
+// most internet paths, including tunnels, so 6 needles of 192 bytes are sent at a time.
+const defaultMaxDatagramBytes = 1200
+
+// WithMaxDatagramBytes sets the largest datagram BatchSet and SetBytesBatch send, which
+// should not exceed the path MTU less 28 bytes of IPv4 and UDP headers, since
+// fragmented datagrams are often dropped. It is rounded down to whole needles of 192
+// bytes, with at least one and at most needle.MaxBatchCount needles per datagram. The
+// default is 1200 bytes, or 6 needles. A 1500 byte Ethernet path allows 1472.
+func WithMaxDatagramBytes(n int) option {
+	return func(o *options) {
+		o.maxDatagram = n
+	}
+}
+
+// WithDontFragment sets the IP don't fragment bit on the client's sockets, so a
+// datagram larger than the path MTU fails with an error instead of being fragmented
+// and possibly lost. It is only supported on linux and has no effect with WithDialer
+// or over TCP.
+func WithDontFragment() option {
+	return func(o *options) {
+		o.dontFrag = true
+	}
+}
+
+// BatchSet writes needles to the server packed into datagrams of up to the number of
+// needles that fit in WithMaxDatagramBytes, which takes a fraction of the packets and
+// syscalls of calling Set for each. Like Set, it does not wait for the server to store them. A
+// datagram that is dropped loses every needle in it, and a server without batch
+// support rejects the whole datagram. A nil needle returns needle.ErrorNeedleIsNil
+// before anything is written.
+func (c *Client) BatchSet(ctx context.Context, needles []*needle.Needle) error {
+	for _, n := range needles {
+		if n == nil {
+			return needle.ErrorNeedleIsNil
+		}
+	}
+	if len(needles) == 0 {
+		return nil
+	}
+	defer c.track()()
+	defer c.inflight.start()()
+	conn, release, err := c.batchConn(ctx)
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	buf := make([]byte, 0, c.batchCount*needle.NeedleLength)
+	for len(needles) > 0 {
+		batch := needles[:min(len(needles), c.batchCount)]
+		needles = needles[len(batch):]
+		buf = buf[:0]
+		for _, n := range batch {
+			buf = append(buf, n.Bytes()...)
+		}
+		err := c.intercept(ctx, &Call{Op: OpBatchSet, Needles: batch}, func(context.Context, *Call) error {
+			return write(conn, buf)
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// SetBatch writes needles to the server one needle per datagram, back to back on a
+// single connection, rather than opening a connection for each as Set does. Unlike
+// BatchSet, datagram boundaries are preserved, so it works with any server. Like Set,
+// it does not wait for the server to store them. Writing stops at the first error or
+// once ctx is done, and the returned error joins an error for each needle that was not
+// written, identified by its index. Each datagram is an OpSet to interceptors.
+func (c *Client) SetBatch(ctx context.Context, needles []*needle.Needle) error {
+	if len(needles) == 0 {
+		return nil
+	}
+	defer c.track()()
+	defer c.inflight.start()()
+	conn, release, err := c.batchConn(ctx)
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	// the connection is not trusted after a failed write, so once a write fails the
+	// remaining needles are reported with the same error
+	var errs []error
+	var failed error
+	for i, n := range needles {
+		if n == nil {
+			errs = append(errs, fmt.Errorf("needle %d: %w", i, needle.ErrorNeedleIsNil))
+			continue
+		}
+		if failed == nil {
+			failed = ctx.Err()
+		}
+		if failed == nil {
+			failed = c.intercept(ctx, &Call{Op: OpSet, Hash: n.Hash(), Needle: n}, func(context.Context, *Call) error {
+				return write(conn, n.Bytes())
+			})
+		}
+		if failed != nil {
+			errs = append(errs, fmt.Errorf("needle %d: %w", i, failed))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// SetBytesBatch is like BatchSet for callers that already hold serialized needles,
+// such as bulk loaders reading them from a file. Each item must be needle.NeedleLength
+// bytes; the bytes are not otherwise checked, since the server verifies every needle.
+// The returned slice holds an error for each item: needle.ErrorByteSliceLength for an
+// item of the wrong length, which is skipped, or the error that stopped its datagram
+// from being written. Interceptors see each datagram as an OpBatchSet without Needles.
+func (c *Client) SetBytesBatch(ctx context.Context, items [][]byte) []error {
+	errs := make([]error, len(items))
+	valid := make([]int, 0, len(items))
+	for i, b := range items {
+		if len(b) != needle.NeedleLength {
+			errs[i] = needle.ErrorByteSliceLength
+			continue
+		}
+		valid = append(valid, i)
+	}
+	if len(valid) == 0 {
+		return errs
+	}
+	defer c.track()()
+	defer c.inflight.start()()
+	conn, release, err := c.batchConn(ctx)
+	if err != nil {
+		for _, i := range valid {
+			errs[i] = err
+		}
+		return errs
+	}
+	defer release()
+
+	buf := make([]byte, 0, c.batchCount*needle.NeedleLength)
+	for len(valid) > 0 {
+		batch := valid[:min(len(valid), c.batchCount)]
+		buf = buf[:0]
+		for _, i := range batch {
+			buf = append(buf, items[i]...)
+		}
+		err := c.intercept(ctx, &Call{Op: OpBatchSet}, func(context.Context, *Call) error {
+			return write(conn, buf)
+		})
+		if err != nil {
+			// the remaining items are not sent once a datagram fails
+			for _, i := range valid {
+				errs[i] = err
+			}
+			break
+		}
+		valid = valid[len(batch):]
+	}
+	return errs
+}
+
+// batchConn returns the connection batches are written to and a func that releases it.
+// A multiplexed client shares its socket, otherwise a new connection is dialed.
+func (c *Client) batchConn(ctx context.Context) (net.Conn, func(), error) {
+	if c.mux != nil {
+		return c.mux.conn, func() {}, nil
+	}
+	conn, err := c.dialContext(ctx, c.raddr)
+	if err != nil {
+		return nil, nil, timeoutError(ctx, err)
+	}
+	unbind := bind(ctx, conn)
+	return conn, func() {
+		unbind()
+		conn.Close()
+	}, nil
+}
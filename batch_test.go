@@ -0,0 +1,203 @@
+package haystack
+
+import (
+	"context"
+	"errors"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/nomasters/haystack/needle"
+	"github.com/nomasters/haystack/x/udp/server"
+)
+
+func TestClientBatchSet(t *testing.T) {
+	t.Parallel()
+	var datagrams []int
+	count := func(next OpFunc) OpFunc {
+		return func(ctx context.Context, call *Call) error {
+			if call.Op == OpBatchSet {
+				datagrams = append(datagrams, len(call.Needles))
+			}
+			return next(ctx, call)
+		}
+	}
+	// the server must not acknowledge SETs, since BatchSet never reads the acks and
+	// unlike a UDP socket a loopback pipe blocks until they are read.
+	l, err := server.NewLoopback()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	c, err := NewClient("loopback", WithDialer(l.Dial), WithInterceptors(count), WithMaxDatagramBytes(1472))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	if err := c.BatchSet(ctx, []*needle.Needle{nil}); !errors.Is(err, needle.ErrorNeedleIsNil) {
+		t.Errorf("expected needle.ErrorNeedleIsNil, got: %v", err)
+	}
+	var needles []*needle.Needle
+	for i := 0; i < needle.MaxBatchCount+2; i++ {
+		p := make([]byte, needle.PayloadLength)
+		p[0] = byte(i)
+		n, _ := needle.New(p)
+		needles = append(needles, n)
+	}
+	if err := c.BatchSet(ctx, needles); err != nil {
+		t.Fatal(err)
+	}
+	if len(datagrams) != 2 || datagrams[0] != needle.MaxBatchCount || datagrams[1] != 2 {
+		t.Errorf("expected datagrams of %v and 2 needles, got: %v", needle.MaxBatchCount, datagrams)
+	}
+	for _, n := range needles {
+		h := n.Hash()
+		if _, err := c.Poll(ctx, &h); err != nil {
+			t.Errorf("expected batched needle to be stored, got: %v", err)
+		}
+	}
+}
+
+func TestClientSetBytesBatch(t *testing.T) {
+	t.Parallel()
+	l, err := server.NewLoopback()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	c, err := NewClient("loopback", WithDialer(l.Dial))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	needles := needle.NewDeterministic(1, needle.MaxBatchCount+1)
+	items := [][]byte{make([]byte, needle.HashLength)}
+	for _, n := range needles {
+		items = append(items, n.Bytes())
+	}
+	errs := c.SetBytesBatch(ctx, items)
+	if len(errs) != len(items) {
+		t.Fatalf("expected %v errors, got %v", len(items), len(errs))
+	}
+	if !errors.Is(errs[0], needle.ErrorByteSliceLength) {
+		t.Errorf("expected needle.ErrorByteSliceLength, got: %v", errs[0])
+	}
+	for i, err := range errs[1:] {
+		if err != nil {
+			t.Errorf("item %v: %v", i+1, err)
+		}
+	}
+	for _, n := range needles {
+		h := n.Hash()
+		if _, err := c.Poll(ctx, &h); err != nil {
+			t.Errorf("expected needle to be stored, got: %v", err)
+		}
+	}
+}
+
+func TestWithMaxDatagramBytes(t *testing.T) {
+	t.Parallel()
+	for _, test := range []struct {
+		opts  []option
+		count int
+	}{
+		{opts: nil, count: 6},
+		{opts: []option{WithMaxDatagramBytes(100)}, count: 1},
+		{opts: []option{WithMaxDatagramBytes(3 * needle.NeedleLength)}, count: 3},
+		{opts: []option{WithMaxDatagramBytes(65507)}, count: needle.MaxBatchCount},
+	} {
+		c, err := NewClient("127.0.0.1:1337", test.opts...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		c.Close()
+		if c.batchCount != test.count {
+			t.Errorf("expected %v needles per datagram, got %v", test.count, c.batchCount)
+		}
+	}
+}
+
+func TestWithDontFragment(t *testing.T) {
+	t.Parallel()
+	if runtime.GOOS != "linux" {
+		t.Skip("don't fragment is only supported on linux")
+	}
+	c, err := NewClient("127.0.0.1:1337", WithDontFragment())
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Close()
+}
+
+func TestClientSetBatch(t *testing.T) {
+	t.Parallel()
+	l, err := server.NewLoopback()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	c, err := NewClient("loopback", WithDialer(l.Dial))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	needles := needle.NewDeterministic(2, 20)
+	if err := c.SetBatch(ctx, append(needles, nil)); !errors.Is(err, needle.ErrorNeedleIsNil) {
+		t.Errorf("expected needle.ErrorNeedleIsNil for the nil needle, got: %v", err)
+	}
+	for _, n := range needles {
+		h := n.Hash()
+		if _, err := c.Poll(ctx, &h); err != nil {
+			t.Errorf("expected needle to be stored, got: %v", err)
+		}
+	}
+
+	cancelled, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := c.SetBatch(cancelled, needles); !errors.Is(err, context.Canceled) {
+		t.Errorf("expected context.Canceled, got: %v", err)
+	}
+}
+
+func BenchmarkClient_SetBatch(b *testing.B) {
+	needles := needle.NewDeterministic(3, 1000)
+	l, err := server.NewLoopback()
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.Cleanup(func() { l.Close() })
+	c, err := NewClient("loopback", WithDialer(l.Dial))
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.Cleanup(func() { c.Close() })
+	ctx := context.Background()
+
+	b.Run("Set", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			for _, n := range needles {
+				if err := c.Set(n); err != nil {
+					b.Fatal(err)
+				}
+			}
+		}
+	})
+	b.Run("SetBatch", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			if err := c.SetBatch(ctx, needles); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
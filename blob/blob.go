@@ -0,0 +1,162 @@
+// Package blob stores data of any length in haystack by splitting it into content
+// defined chunk needles and recording their hashes in a chain of manifest needles.
+// The hash of the first manifest needle is all that is needed to read the data back.
+package blob
+
+import (
+	"context"
+	"errors"
+	"io"
+
+	"github.com/nomasters/haystack/needle"
+)
+
+const (
+	// a manifest needle payload begins with the hash of the next manifest needle
+	// (all zeros for the last one) and the number of chunk hashes it holds.
+	manifestHeaderLength = needle.HashLength + 1
+	// manifestEntries is the number of chunk hashes that fit in one manifest needle.
+	manifestEntries = (needle.PayloadLength - manifestHeaderLength) / needle.HashLength
+)
+
+var (
+	// ErrorInvalidManifest is returned when a manifest needle cannot be decoded
+	ErrorInvalidManifest = errors.New("Invalid manifest")
+)
+
+// Client is the subset of haystack.Client used to store and read blobs.
+type Client interface {
+	Set(n *needle.Needle) error
+	GetContext(ctx context.Context, h *needle.Hash) (*needle.Needle, error)
+}
+
+type options struct {
+	cdc      needle.CDCOptions
+	progress func(done, total int)
+}
+
+// Option configures optional Put and Get settings
+type Option func(*options)
+
+// WithCDCOptions sets the chunking options used by Put. The default is
+// needle.DefaultCDCOptions.
+func WithCDCOptions(cdc needle.CDCOptions) Option {
+	return func(o *options) {
+		o.cdc = cdc
+	}
+}
+
+// WithFixedChunks makes Put split data into chunks of exactly size bytes, the last
+// one shorter, instead of content defined chunks. Fixed chunks are cheaper to compute
+// but an edit shifts every chunk after it. size must be between 1 and
+// needle.MaxChunkLength, otherwise Put returns needle.ErrorInvalidCDCOptions.
+func WithFixedChunks(size int) Option {
+	return func(o *options) {
+		// with MinSize equal to MaxSize every boundary falls at MaxSize
+		o.cdc = needle.CDCOptions{MinSize: size, MaxSize: size, Mask: ^uint64(0)}
+	}
+}
+
+// WithProgress calls fn after each chunk is written by Put or read by Get, with the
+// number of chunks done so far and the total.
+func WithProgress(fn func(done, total int)) Option {
+	return func(o *options) {
+		o.progress = fn
+	}
+}
+
+// Put reads r to EOF, sets its chunks and manifest needles with client, and returns the
+// hash of the first manifest needle. SET is fire-and-forget, so a chunk lost in transit
+// is only detected when the blob is read with Get.
+func Put(ctx context.Context, client Client, r io.Reader, opts ...Option) (needle.Hash, error) {
+	o := newOptions(opts)
+	chunks, err := needle.ChunkCDC(r, o.cdc)
+	if err != nil {
+		return needle.Hash{}, err
+	}
+	for i, n := range chunks {
+		if err := ctx.Err(); err != nil {
+			return needle.Hash{}, err
+		}
+		if err := client.Set(n); err != nil {
+			return needle.Hash{}, err
+		}
+		o.progress(i+1, len(chunks))
+	}
+
+	// manifest needles are written last to first so each one can reference the next.
+	var next needle.Hash
+	last := (len(chunks) - 1) / manifestEntries * manifestEntries
+	for start := last; start >= 0; start -= manifestEntries {
+		page := chunks[start:min(start+manifestEntries, len(chunks))]
+		p := make([]byte, manifestHeaderLength, needle.PayloadLength)
+		copy(p, next[:])
+		p[needle.HashLength] = byte(len(page))
+		for _, n := range page {
+			h := n.Hash()
+			p = append(p, h[:]...)
+		}
+		p = p[:needle.PayloadLength]
+		n, err := needle.New(p)
+		if err != nil {
+			return needle.Hash{}, err
+		}
+		if err := client.Set(n); err != nil {
+			return needle.Hash{}, err
+		}
+		next = n.Hash()
+	}
+	return next, nil
+}
+
+// Get reads the manifest chain starting at hash and writes the blob it describes to w.
+// Every needle read is verified against its hash by the client, so the data written
+// is exactly the data that was Put.
+func Get(ctx context.Context, client Client, hash needle.Hash, w io.Writer, opts ...Option) error {
+	o := newOptions(opts)
+	var chunks []needle.Hash
+	for hash != (needle.Hash{}) {
+		n, err := client.GetContext(ctx, &hash)
+		if err != nil {
+			return err
+		}
+		p := n.Payload()
+		copy(hash[:], p[:needle.HashLength])
+		count := int(p[needle.HashLength])
+		if count > manifestEntries {
+			return ErrorInvalidManifest
+		}
+		for i := 0; i < count; i++ {
+			var h needle.Hash
+			copy(h[:], p[manifestHeaderLength+i*needle.HashLength:])
+			chunks = append(chunks, h)
+		}
+	}
+
+	for i := range chunks {
+		n, err := client.GetContext(ctx, &chunks[i])
+		if err != nil {
+			return err
+		}
+		data, err := needle.ChunkData(n)
+		if err != nil {
+			return err
+		}
+		if _, err := w.Write(data); err != nil {
+			return err
+		}
+		o.progress(i+1, len(chunks))
+	}
+	return nil
+}
+
+func newOptions(opts []Option) options {
+	o := options{
+		cdc:      needle.DefaultCDCOptions,
+		progress: func(int, int) {},
+	}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	return o
+}
@@ -0,0 +1,127 @@
+package blob
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"errors"
+	"sync"
+	"testing"
+
+	"github.com/nomasters/haystack"
+	"github.com/nomasters/haystack/needle"
+)
+
+var _ Client = (*haystack.Client)(nil)
+
+var errNotFound = errors.New("not found")
+
+type mockClient struct {
+	sync.Mutex
+	needles map[needle.Hash]*needle.Needle
+}
+
+func newMockClient() *mockClient {
+	return &mockClient{needles: make(map[needle.Hash]*needle.Needle)}
+}
+
+func (m *mockClient) Set(n *needle.Needle) error {
+	m.Lock()
+	defer m.Unlock()
+	m.needles[n.Hash()] = n
+	return nil
+}
+
+func (m *mockClient) GetContext(ctx context.Context, h *needle.Hash) (*needle.Needle, error) {
+	m.Lock()
+	defer m.Unlock()
+	n, ok := m.needles[*h]
+	if !ok {
+		return nil, errNotFound
+	}
+	return n, nil
+}
+
+func TestPutGet(t *testing.T) {
+	t.Parallel()
+
+	random := make([]byte, 10000)
+	rand.Read(random)
+	for name, data := range map[string][]byte{
+		"empty":       {},
+		"small":       []byte("a blob smaller than a chunk"),
+		"many chunks": random,
+	} {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+			c := newMockClient()
+			var put, got int
+			hash, err := Put(context.Background(), c, bytes.NewReader(data), WithProgress(func(done, total int) { put = total }))
+			if err != nil {
+				t.Fatal(err)
+			}
+			var out bytes.Buffer
+			if err := Get(context.Background(), c, hash, &out, WithProgress(func(done, total int) { got = done })); err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(out.Bytes(), data) {
+				t.Error("blob read by Get does not match")
+			}
+			if put != got {
+				t.Errorf("expected Get to read the %v chunks written by Put, read %v", put, got)
+			}
+		})
+	}
+}
+
+func TestPutFixedChunks(t *testing.T) {
+	t.Parallel()
+	data := make([]byte, 1000)
+	rand.Read(data)
+	c := newMockClient()
+	var chunks int
+	hash, err := Put(context.Background(), c, bytes.NewReader(data), WithFixedChunks(100), WithProgress(func(done, total int) { chunks = total }))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if chunks != 10 {
+		t.Errorf("expected 10 chunks of 100 bytes, got %v", chunks)
+	}
+	var out bytes.Buffer
+	if err := Get(context.Background(), c, hash, &out); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(out.Bytes(), data) {
+		t.Error("blob read by Get does not match")
+	}
+	for _, size := range []int{0, needle.MaxChunkLength + 1} {
+		if _, err := Put(context.Background(), c, bytes.NewReader(data), WithFixedChunks(size)); !errors.Is(err, needle.ErrorInvalidCDCOptions) {
+			t.Errorf("size %v: expected %v, got: %v", size, needle.ErrorInvalidCDCOptions, err)
+		}
+	}
+}
+
+func TestGetErrors(t *testing.T) {
+	t.Parallel()
+
+	c := newMockClient()
+	data := make([]byte, 1000)
+	rand.Read(data)
+	hash, err := Put(context.Background(), c, bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	chunks, _ := needle.ChunkCDC(bytes.NewReader(data), needle.DefaultCDCOptions)
+	delete(c.needles, chunks[len(chunks)/2].Hash())
+	if err := Get(context.Background(), c, hash, new(bytes.Buffer)); !errors.Is(err, errNotFound) {
+		t.Errorf("expected a missing chunk to fail Get, got: %v", err)
+	}
+
+	p := make([]byte, needle.PayloadLength)
+	p[needle.HashLength] = manifestEntries + 1
+	invalid, _ := needle.New(p)
+	c.Set(invalid)
+	if err := Get(context.Background(), c, invalid.Hash(), new(bytes.Buffer)); !errors.Is(err, ErrorInvalidManifest) {
+		t.Errorf("expected ErrorInvalidManifest, got: %v", err)
+	}
+}
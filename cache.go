@@ -0,0 +1,97 @@
+package haystack
+
+import (
+	"container/list"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/nomasters/haystack/needle"
+)
+
+// WithCache keeps up to size needles returned by GETs in memory, evicting the least
+// recently used, and serves repeated GETs for them without a network round trip for
+// up to ttl after they were fetched. Since a needle can never change for its hash, a
+// cached needle is always correct, but it may still be returned after the server has
+// expired it, so ttl should not exceed the server's ttl. The cache is used by Get,
+// GetContext and Poll.
+func WithCache(size int, ttl time.Duration) option {
+	return func(o *options) {
+		o.cacheSize = size
+		o.cacheTTL = ttl
+	}
+}
+
+// CacheStats returns the number of GETs served from the cache and the number that had
+// to go to the network. Both are zero unless the client was created WithCache.
+func (c *Client) CacheStats() (hits, misses uint64) {
+	if c.cache == nil {
+		return 0, 0
+	}
+	return c.cache.hits.Load(), c.cache.misses.Load()
+}
+
+type cacheEntry struct {
+	n         *needle.Needle
+	fetchedAt time.Time
+}
+
+// cache is an LRU cache of needles that expire a fixed time after they were fetched.
+type cache struct {
+	mu      sync.Mutex
+	size    int
+	ttl     time.Duration
+	order   *list.List
+	entries map[needle.Hash]*list.Element
+	hits    atomic.Uint64
+	misses  atomic.Uint64
+}
+
+func newCache(size int, ttl time.Duration) *cache {
+	return &cache{
+		size:    size,
+		ttl:     ttl,
+		order:   list.New(),
+		entries: make(map[needle.Hash]*list.Element),
+	}
+}
+
+// get returns the cached needle for h, or nil if it is missing or has expired.
+func (c *cache) get(h needle.Hash) *needle.Needle {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.entries[h]
+	if !ok {
+		c.misses.Add(1)
+		return nil
+	}
+	entry := e.Value.(cacheEntry)
+	if time.Since(entry.fetchedAt) >= c.ttl {
+		c.order.Remove(e)
+		delete(c.entries, h)
+		c.misses.Add(1)
+		return nil
+	}
+	c.order.MoveToFront(e)
+	c.hits.Add(1)
+	return entry.n
+}
+
+// add caches n, evicting the least recently used needle if the cache is full.
+func (c *cache) add(n *needle.Needle) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	h := n.Hash()
+	entry := cacheEntry{n: n, fetchedAt: time.Now()}
+	if e, ok := c.entries[h]; ok {
+		e.Value = entry
+		c.order.MoveToFront(e)
+		return
+	}
+	if c.order.Len() >= c.size {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.entries, oldest.Value.(cacheEntry).n.Hash())
+	}
+	c.entries[h] = c.order.PushFront(entry)
+}
@@ -0,0 +1,87 @@
+package haystack
+
+import (
+	"context"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/nomasters/haystack/needle"
+	"github.com/nomasters/haystack/x/udp/server"
+)
+
+func TestClientCache(t *testing.T) {
+	t.Parallel()
+	l, err := server.NewLoopback(server.WithAckSet())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	var dials atomic.Int64
+	dial := func(ctx context.Context, network, address string) (net.Conn, error) {
+		dials.Add(1)
+		return l.Dial(ctx, network, address)
+	}
+	c, err := NewClient("loopback", WithDialer(dial), WithCache(10, time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	n, _ := needle.New(make([]byte, needle.PayloadLength))
+	if err := c.SetAck(ctx, n); err != nil {
+		t.Fatal(err)
+	}
+	h := n.Hash()
+	before := dials.Load()
+	for i := 0; i < 3; i++ {
+		if _, err := c.GetContext(ctx, &h); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if d := dials.Load() - before; d != 1 {
+		t.Errorf("expected a single network GET, got %v", d)
+	}
+	if hits, misses := c.CacheStats(); hits != 2 || misses != 1 {
+		t.Errorf("expected 2 hits and 1 miss, got %v and %v", hits, misses)
+	}
+}
+
+func TestCache(t *testing.T) {
+	t.Parallel()
+	var needles []*needle.Needle
+	for i := 0; i < 3; i++ {
+		p := make([]byte, needle.PayloadLength)
+		p[0] = byte(i)
+		n, _ := needle.New(p)
+		needles = append(needles, n)
+	}
+
+	c := newCache(2, time.Minute)
+	c.add(needles[0])
+	c.add(needles[1])
+	if c.get(needles[0].Hash()) != needles[0] {
+		t.Error("expected cached needle")
+	}
+	// needles[1] is now the least recently used
+	c.add(needles[2])
+	if c.get(needles[1].Hash()) != nil {
+		t.Error("expected least recently used needle to be evicted")
+	}
+	if c.get(needles[0].Hash()) == nil || c.get(needles[2].Hash()) == nil {
+		t.Error("expected recently used needles to remain")
+	}
+	if hits, misses := c.hits.Load(), c.misses.Load(); hits != 3 || misses != 1 {
+		t.Errorf("expected 3 hits and 1 miss, got %v and %v", hits, misses)
+	}
+
+	expiring := newCache(2, 10*time.Millisecond)
+	expiring.add(needles[0])
+	time.Sleep(20 * time.Millisecond)
+	if expiring.get(needles[0].Hash()) != nil {
+		t.Error("expected expired needle to be dropped")
+	}
+}
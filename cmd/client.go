@@ -0,0 +1,212 @@
+package cmd
+
+import (
+	"context"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/nomasters/haystack"
+	"github.com/nomasters/haystack/blob"
+	"github.com/nomasters/haystack/needle"
+	"github.com/spf13/cobra"
+)
+
+func init() {
+	rootCmd.AddCommand(clientCmd)
+	clientCmd.PersistentFlags().StringP("address", "a", "127.0.0.1:1337", "address of the haystack server")
+	clientCmd.PersistentFlags().String("network", "udp", "network used to reach the server, udp or tcp")
+	clientCmd.AddCommand(clientGetCmd)
+	clientGetCmd.Flags().Duration("timeout", time.Second, "how long to wait for a response")
+	clientGetCmd.Flags().Duration("wait", 0, "retry with backoff until the needle is found or the duration passes")
+	clientCmd.AddCommand(clientPutFileCmd)
+	clientPutFileCmd.Flags().Int("fixed", 0, fmt.Sprintf("split the file into chunks of this many bytes, at most %d, instead of content defined chunks", needle.MaxChunkLength))
+	clientCmd.AddCommand(clientGetFileCmd)
+	clientGetFileCmd.Flags().Duration("timeout", time.Minute, "how long to wait for the whole file")
+	clientCmd.AddCommand(clientProbeCmd)
+	clientProbeCmd.Flags().Int("count", 10, "number of single needle probes to send")
+	clientCmd.AddCommand(clientPingCmd)
+	clientPingCmd.Flags().Duration("timeout", time.Second, "how long to wait for the pong")
+}
+
+var clientCmd = &cobra.Command{
+	Use:   "client",
+	Short: "Run haystack in client mode.",
+	Long:  `Client mode is used to send requests to a haystack server.`,
+}
+
+var clientGetCmd = &cobra.Command{
+	Use:   "get <hash>",
+	Short: "Get a needle by its hex encoded hash and print its payload.",
+	Long: `Get requests a needle by its hex encoded hash and prints the hex encoded payload.
+Because SET is fire-and-forget, a needle set moments ago may not be stored yet; use
+--wait to keep retrying until it appears.`,
+	Args: cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		b, err := hex.DecodeString(args[0])
+		if err != nil || len(b) != needle.HashLength {
+			fmt.Fprintf(os.Stderr, "hash must be %d hex encoded bytes\n", needle.HashLength)
+			os.Exit(1)
+		}
+		var hash needle.Hash
+		copy(hash[:], b)
+
+		client := newClient(cmd)
+		defer client.Close()
+
+		get := client.GetContext
+		timeout, _ := cmd.Flags().GetDuration("timeout")
+		if wait, _ := cmd.Flags().GetDuration("wait"); wait > 0 {
+			get, timeout = client.Poll, wait
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		defer cancel()
+		n, err := get(ctx, &hash)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		p := n.Payload()
+		fmt.Println(hex.EncodeToString(p[:]))
+	},
+}
+
+var clientProbeCmd = &cobra.Command{
+	Use:   "probe",
+	Short: "Measure round trip time, loss and datagram size to a server.",
+	Long: `Probe sends PINGs to measure round trip time and loss, then PINGs padded to the
+length of 1 up to a full batch of needles to find the largest datagram that gets
+through. Nothing is stored on the server.`,
+	Args: cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		client := newClient(cmd)
+		defer client.Close()
+
+		count, _ := cmd.Flags().GetInt("count")
+		r, err := client.Probe(context.Background(), count)
+		fmt.Printf("probes: %d sent, %d answered, %.1f%% loss\n", r.Sent, r.Received, r.Loss*100)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		fmt.Printf("rtt: min %v, avg %v, max %v\n", r.RTTMin, r.RTTAvg, r.RTTMax)
+		fmt.Printf("max datagram: %d bytes\n", r.MaxDatagramBytes)
+	},
+}
+
+var clientPingCmd = &cobra.Command{
+	Use:   "ping",
+	Short: "Check that a server is up and print the round trip time.",
+	Long: `Ping sends a PING, which the server answers without touching its storage, and prints
+the round trip time. Servers that predate PING do not answer, so ping times out.`,
+	Args: cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		client := newClient(cmd)
+		defer client.Close()
+
+		timeout, _ := cmd.Flags().GetDuration("timeout")
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		defer cancel()
+		rtt, err := client.Ping(ctx)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		fmt.Println("pong:", rtt)
+	},
+}
+
+var clientPutFileCmd = &cobra.Command{
+	Use:   "put-file <path>",
+	Short: "Store a file as chunk needles and print its manifest hash.",
+	Long: `Put-file splits a file into content defined chunks, or fixed size chunks with
+--fixed, sets each chunk and a chain of manifest needles, and prints the hex encoded
+hash of the first manifest needle, which get-file uses to reassemble the file.`,
+	Args: cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		f, err := os.Open(args[0])
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		defer f.Close()
+		client := newClient(cmd)
+		defer client.Close()
+
+		opts := []blob.Option{blob.WithProgress(progress("stored"))}
+		if size, _ := cmd.Flags().GetInt("fixed"); size != 0 {
+			opts = append(opts, blob.WithFixedChunks(size))
+		}
+		hash, err := blob.Put(context.Background(), client, f, opts...)
+		fmt.Fprintln(os.Stderr)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		fmt.Println(hex.EncodeToString(hash[:]))
+	},
+}
+
+var clientGetFileCmd = &cobra.Command{
+	Use:   "get-file <manifest-hash> <out-path>",
+	Short: "Reassemble a file stored with put-file.",
+	Long: `Get-file reads the manifest chain starting at the hex encoded hash and writes the
+file it describes to out-path. Every chunk is verified against its hash, and out-path
+is only written once the whole file has been read.`,
+	Args: cobra.ExactArgs(2),
+	Run: func(cmd *cobra.Command, args []string) {
+		b, err := hex.DecodeString(args[0])
+		if err != nil || len(b) != needle.HashLength {
+			fmt.Fprintf(os.Stderr, "hash must be %d hex encoded bytes\n", needle.HashLength)
+			os.Exit(1)
+		}
+		var hash needle.Hash
+		copy(hash[:], b)
+		client := newClient(cmd)
+		defer client.Close()
+
+		tmp, err := os.CreateTemp(filepath.Dir(args[1]), filepath.Base(args[1])+".*.tmp")
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		timeout, _ := cmd.Flags().GetDuration("timeout")
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		defer cancel()
+		err = blob.Get(ctx, client, hash, tmp, blob.WithProgress(progress("read")))
+		fmt.Fprintln(os.Stderr)
+		if cerr := tmp.Close(); err == nil {
+			err = cerr
+		}
+		if err == nil {
+			err = os.Rename(tmp.Name(), args[1])
+		}
+		if err != nil {
+			// os.Exit skips deferred calls, so the partial file is removed here
+			os.Remove(tmp.Name())
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+	},
+}
+
+// newClient returns a client for the address flag, exiting if it cannot be created.
+func newClient(cmd *cobra.Command) *haystack.Client {
+	address, _ := cmd.Flags().GetString("address")
+	network, _ := cmd.Flags().GetString("network")
+	client, err := haystack.NewClient(address, haystack.WithNetwork(network))
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	return client
+}
+
+// progress returns a blob progress func that reports chunk counts on stderr.
+func progress(verb string) func(done, total int) {
+	return func(done, total int) {
+		fmt.Fprintf(os.Stderr, "\r%s %d/%d chunks", verb, done, total)
+	}
+}
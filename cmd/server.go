@@ -2,6 +2,7 @@ package cmd
 
 import (
 	"fmt"
+	"os"
 
 	"github.com/nomasters/haystack/x/udp/server"
 	"github.com/spf13/cobra"
@@ -11,6 +12,20 @@ func init() {
 	rootCmd.AddCommand(serverCmd)
 	serverCmd.Flags().StringP("port", "p", "1337", "Port for the server listener")
 	serverCmd.Flags().StringP("host", "", "", "hostname of server listener")
+	serverCmd.Flags().String("interface", "", "bind the server listener to this network interface (linux only)")
+	serverCmd.Flags().String("response-address", "", "send replies from a socket bound to this address instead of the listener")
+	serverCmd.Flags().Bool("trace", false, "write a live, rate limited stream of operations to stderr")
+	serverCmd.Flags().Int("trace-rate", 100, "maximum number of traced operations written per second")
+	serverCmd.Flags().Bool("ack", false, "acknowledge each stored needle by replying with its hash")
+	serverCmd.Flags().Duration("handler-timeout", 0, "abandon storage operations that take longer than this, 0 to wait indefinitely")
+	serverCmd.Flags().Bool("log-invalid", false, "log the source address of SETs whose hash does not match the payload")
+	serverCmd.Flags().Float64("rate-limit", 0, "maximum requests per second from each source address, 0 for no limit")
+	serverCmd.Flags().Int("rate-burst", 10, "number of requests a source address may burst above the rate limit")
+	serverCmd.Flags().String("metrics-address", "", "serve Prometheus metrics at /metrics on this address")
+	serverCmd.Flags().Bool("access-log", false, "log every request with its operation, result, source and duration")
+	serverCmd.Flags().Bool("log-hashes", false, "include needle hashes in the access log")
+	serverCmd.Flags().Bool("tcp", false, "serve framed requests over TCP instead of UDP")
+	serverCmd.Flags().Bool("check", false, "validate the server configuration and exit without serving")
 }
 
 var serverCmd = &cobra.Command{
@@ -22,8 +37,50 @@ var serverCmd = &cobra.Command{
 		port, _ := cmd.Flags().GetString("port")
 		host, _ := cmd.Flags().GetString("host")
 		addr := host + ":" + port
+		if iface, _ := cmd.Flags().GetString("interface"); iface != "" {
+			opts = append(opts, server.WithBindInterface(iface))
+		}
+		if respAddr, _ := cmd.Flags().GetString("response-address"); respAddr != "" {
+			opts = append(opts, server.WithResponseAddress(respAddr))
+		}
+		if trace, _ := cmd.Flags().GetBool("trace"); trace {
+			rate, _ := cmd.Flags().GetInt("trace-rate")
+			opts = append(opts, server.WithTrace(server.NewTrace(1024, os.Stderr, rate)))
+		}
+		if ack, _ := cmd.Flags().GetBool("ack"); ack {
+			opts = append(opts, server.WithAckSet())
+		}
+		if timeout, _ := cmd.Flags().GetDuration("handler-timeout"); timeout > 0 {
+			opts = append(opts, server.WithHandlerTimeout(timeout))
+		}
+		if logInvalid, _ := cmd.Flags().GetBool("log-invalid"); logInvalid {
+			opts = append(opts, server.WithLogInvalidHash())
+		}
+		if rate, _ := cmd.Flags().GetFloat64("rate-limit"); rate > 0 {
+			burst, _ := cmd.Flags().GetInt("rate-burst")
+			opts = append(opts, server.WithRateLimit(rate, burst))
+		}
+		if metricsAddr, _ := cmd.Flags().GetString("metrics-address"); metricsAddr != "" {
+			opts = append(opts, server.WithMetricsAddr(metricsAddr))
+		}
+		if accessLog, _ := cmd.Flags().GetBool("access-log"); accessLog {
+			logHashes, _ := cmd.Flags().GetBool("log-hashes")
+			opts = append(opts, server.WithAccessLog(logHashes))
+		}
+		check, listenAndServe := server.Check, server.ListenAndServe
+		if tcp, _ := cmd.Flags().GetBool("tcp"); tcp {
+			check, listenAndServe = server.CheckTCP, server.ListenAndServeTCP
+		}
+		if checkOnly, _ := cmd.Flags().GetBool("check"); checkOnly {
+			if err := check(addr, opts...); err != nil {
+				fmt.Fprintln(os.Stderr, "check failed:", err)
+				os.Exit(1)
+			}
+			fmt.Println("check ok:", addr)
+			return
+		}
 		fmt.Println("listening on:", addr)
-		if err := server.ListenAndServe(addr, opts...); err != nil {
+		if err := listenAndServe(addr, opts...); err != nil {
 			fmt.Println(err)
 		}
 	},
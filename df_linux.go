@@ -0,0 +1,12 @@
+package haystack
+
+import "syscall"
+
+// setDontFragment sets the don't fragment bit on datagrams sent from the socket fd, so
+// a datagram larger than the path MTU fails instead of being fragmented.
+func setDontFragment(network string, fd uintptr) error {
+	if network == "udp6" {
+		return syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IPV6, syscall.IPV6_MTU_DISCOVER, syscall.IPV6_PMTUDISC_DO)
+	}
+	return syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IP, syscall.IP_MTU_DISCOVER, syscall.IP_PMTUDISC_DO)
+}
@@ -0,0 +1,10 @@
+//go:build !linux
+
+package haystack
+
+import "errors"
+
+// setDontFragment is only supported on linux.
+func setDontFragment(network string, fd uintptr) error {
+	return errors.New("setting the don't fragment bit is not supported on this platform")
+}
@@ -5,6 +5,7 @@ go 1.23
 require (
 	github.com/rs/zerolog v1.31.0
 	github.com/spf13/cobra v1.8.0
+	go.etcd.io/bbolt v1.3.11
 )
 
 require (
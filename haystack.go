@@ -1,9 +1,16 @@
 package haystack
 
 import (
-	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
 	"errors"
+	"fmt"
+	"io"
 	"net"
+	"sync/atomic"
+	"syscall"
+	"time"
 
 	"github.com/nomasters/haystack/needle"
 )
@@ -16,9 +23,33 @@ import (
 var (
 	// ErrTimestampExceedsThreshold is an error returned with the timestamp exceeds the acceptable threshold
 	ErrTimestampExceedsThreshold = errors.New("Timestamp exceeds threshold")
+	// ErrPayloadTooLarge is returned by Store when the payload does not fit in a single Needle
+	ErrPayloadTooLarge = errors.New("Payload exceeds needle payload length")
+	// ErrAckMismatch is returned by SetAck when the server acknowledges a different hash
+	ErrAckMismatch = errors.New("Ack does not match needle hash")
+	// ErrTimeout is returned when an operation runs out of time waiting on the network.
+	// On UDP this usually means the server does not hold the needle, or the request or
+	// response was lost, rather than that the transport is broken.
+	ErrTimeout = errors.New("Operation timed out")
+	// ErrBufferTooSmall is returned by GetBytesInto when dst cannot hold a needle
+	ErrBufferTooSmall = errors.New("Buffer is smaller than needle length")
+	// ErrOperationsInFlight is returned by Close when operations were still running
+	ErrOperationsInFlight = errors.New("Operations still in flight")
 )
 
 type options struct {
+	multiplex    bool
+	replicas     []string
+	dial         func(ctx context.Context, network, address string) (net.Conn, error)
+	interceptors []Interceptor
+	cacheSize    int
+	cacheTTL     time.Duration
+	maxDatagram  int
+	dontFrag     bool
+	retries      int
+	backoff      time.Duration
+	metrics      bool
+	network      string
 }
 
 type option func(*options)
@@ -27,50 +58,381 @@ type option func(*options)
 type Client struct {
 	raddr string
 	conn  net.Conn
+	// network is "udp" or "tcp", whose connections are wrapped in a frameConn.
+	network string
+	// dial opens the connection used for a single operation, it defaults to a UDP net.Dialer.
+	dial         func(ctx context.Context, network, address string) (net.Conn, error)
+	inflight     inflight
+	active       atomic.Int64
+	mux          *mux
+	replicas     []string
+	interceptors []Interceptor
+	cache        *cache
+	// batchCount is the number of needles BatchSet packs into a datagram.
+	batchCount int
+	dontFrag   bool
+	retries    int
+	backoff    time.Duration
+	// setLatency and getLatency are nil unless the client was created WithMetrics.
+	setLatency *histogram
+	getLatency *histogram
 }
 
-// Close implements the UDPConn.Close() method
+// Close implements the UDPConn.Close() method. If any Set or Get was still running,
+// the returned error wraps ErrOperationsInFlight with the number abandoned, which
+// usually means the client was closed before its callers finished. Use Flush before
+// Close to wait for pending SETs.
 func (c *Client) Close() error {
-	return c.conn.Close()
+	err := c.conn.Close()
+	if n := c.active.Load(); n > 0 {
+		err = errors.Join(err, fmt.Errorf("%w: %d", ErrOperationsInFlight, n))
+	}
+	return err
+}
+
+// track counts an operation as active until the returned func is called.
+func (c *Client) track() func() {
+	c.active.Add(1)
+	return func() { c.active.Add(-1) }
 }
 
-// Set takes a needle and returns
+// Set takes a needle and writes it to the server. A nil needle returns needle.ErrorNeedleIsNil.
 func (c *Client) Set(n *needle.Needle) error {
-	conn, err := net.Dial("udp", c.raddr)
+	return c.set(context.Background(), n)
+}
+
+func (c *Client) set(ctx context.Context, n *needle.Needle) error {
+	if n == nil {
+		return needle.ErrorNeedleIsNil
+	}
+	defer c.track()()
+	return c.intercept(ctx, &Call{Op: OpSet, Hash: n.Hash(), Needle: n}, func(ctx context.Context, _ *Call) (err error) {
+		defer c.inflight.start()()
+		defer c.setLatency.observe(c.setLatency.start(), &err)
+		if c.mux != nil {
+			return write(c.mux.conn, n.Bytes())
+		}
+		conn, err := c.dialContext(ctx, c.raddr)
+		if err != nil {
+			return timeoutError(ctx, err)
+		}
+		defer conn.Close()
+		defer bind(ctx, conn)()
+		return write(conn, n.Bytes())
+	})
+}
+
+// SetAck writes a needle to the server and waits for the server to acknowledge it
+// with the needle hash. The server must be running with acknowledgements enabled,
+// otherwise SetAck blocks until ctx is done.
+func (c *Client) SetAck(ctx context.Context, n *needle.Needle) error {
+	if n == nil {
+		return needle.ErrorNeedleIsNil
+	}
+	defer c.track()()
+	return c.intercept(ctx, &Call{Op: OpSetAck, Hash: n.Hash(), Needle: n}, func(ctx context.Context, _ *Call) error {
+		return c.setAck(ctx, n)
+	})
+}
+
+func (c *Client) setAck(ctx context.Context, n *needle.Needle) (err error) {
+	defer c.setLatency.observe(c.setLatency.start(), &err)
+	done := c.inflight.start()
+	conn, err := c.dialContext(ctx, c.raddr)
 	if err != nil {
-		return err
+		done()
+		return timeoutError(ctx, err)
 	}
 	defer conn.Close()
-	_, err = conn.Write(n.Bytes())
+	defer bind(ctx, conn)()
+	err = write(conn, n.Bytes())
+	done()
+	if err != nil {
+		return err
+	}
+	ack := make([]byte, needle.HashLength+1)
+	l, err := conn.Read(ack)
+	if err != nil {
+		return timeoutError(ctx, err)
+	}
+	if hash := n.Hash(); l != needle.HashLength || !bytes.Equal(ack[:l], hash[:]) {
+		return ErrAckMismatch
+	}
+	return nil
+}
+
+// dialContext opens a connection to address for a single operation.
+func (c *Client) dialContext(ctx context.Context, address string) (net.Conn, error) {
+	conn, err := c.dialNetwork(ctx, address)
+	if err != nil || c.network != "tcp" {
+		return conn, err
+	}
+	return newFrameConn(conn), nil
+}
+
+func (c *Client) dialNetwork(ctx context.Context, address string) (net.Conn, error) {
+	if c.dial != nil {
+		return c.dial(ctx, c.network, address)
+	}
+	var d net.Dialer
+	if c.dontFrag && c.network == "udp" {
+		d.Control = func(network, address string, rc syscall.RawConn) error {
+			var err error
+			if cerr := rc.Control(func(fd uintptr) {
+				err = setDontFragment(network, fd)
+			}); cerr != nil {
+				return cerr
+			}
+			if err != nil {
+				return fmt.Errorf("set don't fragment: %w", err)
+			}
+			return nil
+		}
+	}
+	return d.DialContext(ctx, c.network, address)
+}
+
+// write writes b to conn as a single message. A short write is treated as a failure
+// since a partial needle or hash is never a valid request.
+func write(conn net.Conn, b []byte) error {
+	n, err := conn.Write(b)
+	if err != nil {
+		return err
+	}
+	if n != len(b) {
+		return io.ErrShortWrite
+	}
+	return nil
+}
+
+// timeoutError wraps err with ErrTimeout if it was caused by a deadline passing. An
+// error caused by ctx being cancelled is returned as the context error instead.
+func timeoutError(ctx context.Context, err error) error {
+	if errors.Is(ctx.Err(), context.Canceled) {
+		return ctx.Err()
+	}
+	var ne net.Error
+	if errors.Is(err, context.DeadlineExceeded) || errors.As(err, &ne) && ne.Timeout() {
+		return fmt.Errorf("%w: %w", ErrTimeout, err)
+	}
 	return err
 }
 
-// Get takes a needle hash and returns a Needle
+// bind ties the deadline of conn to ctx so that an expired or cancelled context
+// unblocks any pending read or write. The returned func releases the binding.
+func bind(ctx context.Context, conn net.Conn) func() bool {
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	return context.AfterFunc(ctx, func() {
+		conn.SetDeadline(time.Now())
+	})
+}
+
+// Store takes a payload of up to needle.PayloadLength bytes, zero pads it, sets it
+// as a Needle and returns the Hash it can be retrieved by. A payload larger than
+// needle.PayloadLength returns ErrPayloadTooLarge rather than being truncated.
+func (c *Client) Store(ctx context.Context, payload []byte) (needle.Hash, error) {
+	p, truncated := needle.FitPayload(payload)
+	if truncated {
+		return needle.Hash{}, ErrPayloadTooLarge
+	}
+	n, err := needle.New(p[:])
+	if err != nil {
+		return needle.Hash{}, err
+	}
+	if err := c.set(ctx, n); err != nil {
+		return needle.Hash{}, err
+	}
+	return n.Hash(), nil
+}
+
+// Get takes a needle hash and returns a Needle. A nil hash returns needle.ErrorHashIsNil.
 func (c *Client) Get(h *needle.Hash) (*needle.Needle, error) {
-	p := make([]byte, needle.NeedleLength)
-	conn, err := net.Dial("udp", c.raddr)
+	return c.get(context.Background(), h)
+}
+
+// GetContext takes a needle hash and returns a Needle, giving up when ctx is done.
+// Since the server does not respond to misses, a miss returns an error wrapping
+// ErrTimeout once the deadline of ctx passes.
+func (c *Client) GetContext(ctx context.Context, h *needle.Hash) (*needle.Needle, error) {
+	return c.get(ctx, h)
+}
+
+func (c *Client) get(ctx context.Context, h *needle.Hash) (*needle.Needle, error) {
+	if h == nil {
+		return nil, needle.ErrorHashIsNil
+	}
+	defer c.track()()
+	call := &Call{Op: OpGet, Hash: *h}
+	err := c.intercept(ctx, call, func(ctx context.Context, call *Call) error {
+		if c.cache != nil {
+			if n := c.cache.get(*h); n != nil {
+				call.Needle = n
+				return nil
+			}
+		}
+		n, err := c.getNeedle(ctx, h)
+		if err == nil && c.cache != nil {
+			c.cache.add(n)
+		}
+		call.Needle = n
+		return err
+	})
 	if err != nil {
 		return nil, err
 	}
-	defer conn.Close()
-	conn.Write(h[:])
-	if _, err := bufio.NewReader(conn).Read(p); err != nil {
+	return call.Needle, nil
+}
+
+func (c *Client) getNeedle(ctx context.Context, h *needle.Hash) (_ *needle.Needle, err error) {
+	defer c.getLatency.observe(c.getLatency.start(), &err)
+	var n *needle.Needle
+	err = c.retry(ctx, func(ctx context.Context) (err error) {
+		if c.mux != nil {
+			p, err := c.mux.get(ctx, *h)
+			if err != nil {
+				return timeoutError(ctx, err)
+			}
+			n, err = needle.FromBytes(p)
+			return err
+		}
+		n, err = c.getFrom(ctx, c.raddr, h)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return n, nil
+}
+
+// GetBytesInto requests h and reads the raw needle bytes, hash followed by payload, into
+// dst, returning the number of bytes read. dst must be at least needle.NeedleLength
+// bytes, otherwise ErrBufferTooSmall is returned. The response is verified against h
+// before returning, so a caller can reuse a single buffer for every read. A nil hash
+// returns needle.ErrorHashIsNil.
+func (c *Client) GetBytesInto(ctx context.Context, h *needle.Hash, dst []byte) (int, error) {
+	if h == nil {
+		return 0, needle.ErrorHashIsNil
+	}
+	if len(dst) < needle.NeedleLength {
+		return 0, ErrBufferTooSmall
+	}
+	defer c.track()()
+	dst = dst[:needle.NeedleLength]
+	err := c.intercept(ctx, &Call{Op: OpGet, Hash: *h}, func(ctx context.Context, _ *Call) (err error) {
+		defer c.getLatency.observe(c.getLatency.start(), &err)
+		return c.retry(ctx, func(ctx context.Context) error {
+			if c.mux != nil {
+				p, err := c.mux.get(ctx, *h)
+				if err != nil {
+					return timeoutError(ctx, err)
+				}
+				copy(dst, p)
+			} else if err := c.getInto(ctx, c.raddr, h, dst); err != nil {
+				return err
+			}
+			return verify(h, dst)
+		})
+	})
+	if err != nil {
+		return 0, err
+	}
+	return needle.NeedleLength, nil
+}
+
+// getFrom requests h from the server at address on a new socket and verifies that
+// the response is a valid needle for h.
+func (c *Client) getFrom(ctx context.Context, address string, h *needle.Hash) (*needle.Needle, error) {
+	p := make([]byte, needle.NeedleLength)
+	if err := c.getInto(ctx, address, h, p); err != nil {
+		return nil, err
+	}
+	if err := verify(h, p); err != nil {
 		return nil, err
 	}
+	return needle.FromBytesTrusted(p)
+}
+
+// getInto requests h from the server at address on a new socket and reads the
+// response into dst, which must be needle.NeedleLength bytes.
+func (c *Client) getInto(ctx context.Context, address string, h *needle.Hash, dst []byte) error {
+	conn, err := c.dialContext(ctx, address)
+	if err != nil {
+		return timeoutError(ctx, err)
+	}
+	defer conn.Close()
+	defer bind(ctx, conn)()
+	if err := write(conn, h[:]); err != nil {
+		return err
+	}
 	// TODO: Because this is connectionless, we should create a readbuffer for conn that writes to client storage interface
 	// and then read from that client storage interface. This will make reading async calls that go really fast... faster.
-	return needle.FromBytes(p)
+	l, err := conn.Read(dst)
+	if err != nil {
+		return timeoutError(ctx, err)
+	}
+	if l != needle.NeedleLength {
+		return needle.ErrorByteSliceLength
+	}
+	return nil
+}
+
+// verify checks that b holds the needle for h without allocating.
+func verify(h *needle.Hash, b []byte) error {
+	if needle.Hash(b[:needle.HashLength]) != *h || needle.Hash(sha256.Sum256(b[needle.HashLength:])) != *h {
+		return needle.ErrorInvalidHash
+	}
+	return nil
+}
+
+// WithDialer replaces the UDP dialer used to open the client's connections. It is
+// called with the network "udp", or the one set WithNetwork, and the server or
+// replica address. This allows
+// alternative transports, such as an in-process loopback for benchmarks.
+func WithDialer(dial func(ctx context.Context, network, address string) (net.Conn, error)) option {
+	return func(o *options) {
+		o.dial = dial
+	}
 }
 
 // NewClient creates a new haystack client. It requires an address
 // but can also take an arbitrary number of options
 func NewClient(address string, opts ...option) (*Client, error) {
+	o := options{network: "udp"}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	if o.network != "udp" && o.network != "tcp" {
+		return nil, fmt.Errorf("%w: %q", ErrUnknownNetwork, o.network)
+	}
 	c := new(Client)
 	c.raddr = address
-	conn, err := net.Dial("udp", address)
+	c.replicas = o.replicas
+	c.dial = o.dial
+	c.interceptors = o.interceptors
+	c.dontFrag = o.dontFrag
+	c.network = o.network
+	c.retries = o.retries
+	c.backoff = o.backoff
+	if o.metrics {
+		c.setLatency = new(histogram)
+		c.getLatency = new(histogram)
+	}
+	c.batchCount = defaultMaxDatagramBytes / needle.NeedleLength
+	if o.maxDatagram > 0 {
+		c.batchCount = min(max(o.maxDatagram/needle.NeedleLength, 1), needle.MaxBatchCount)
+	}
+	if o.cacheSize > 0 {
+		c.cache = newCache(o.cacheSize, o.cacheTTL)
+	}
+	conn, err := c.dialContext(context.Background(), address)
 	if err != nil {
 		return c, err
 	}
 	c.conn = conn
+	if o.multiplex {
+		c.mux = newMux(conn, c.network == "tcp")
+	}
 	return c, nil
 }
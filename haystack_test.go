@@ -1 +1,280 @@
 package haystack
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/nomasters/haystack/needle"
+)
+
+// listen returns a UDP listener on a random local port for a client to send to.
+func listen(t *testing.T) net.PacketConn {
+	t.Helper()
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+// fakeServer is a minimal haystack server for client tests. It stores needles sent
+// to it and answers GETs for hashes it holds, ignoring misses like a real server.
+type fakeServer struct {
+	conn    net.PacketConn
+	mu      sync.Mutex
+	needles map[needle.Hash][]byte
+}
+
+func newFakeServer(t *testing.T) *fakeServer {
+	t.Helper()
+	s := &fakeServer{
+		conn:    listen(t),
+		needles: make(map[needle.Hash][]byte),
+	}
+	go s.serve()
+	return s
+}
+
+func (s *fakeServer) addr() string {
+	return s.conn.LocalAddr().String()
+}
+
+func (s *fakeServer) serve() {
+	buf := make([]byte, needle.NeedleLength+1)
+	for {
+		l, addr, err := s.conn.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		var hash needle.Hash
+		copy(hash[:], buf)
+		s.mu.Lock()
+		switch l {
+		case needle.NeedleLength:
+			s.needles[hash] = append([]byte(nil), buf[:l]...)
+		case needle.HashLength:
+			if b, ok := s.needles[hash]; ok {
+				s.conn.WriteTo(b, addr)
+			}
+		}
+		s.mu.Unlock()
+	}
+}
+
+// set stores n directly, without going through a client.
+func (s *fakeServer) set(n *needle.Needle) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.needles[n.Hash()] = n.Bytes()
+}
+
+func TestClientStore(t *testing.T) {
+	t.Parallel()
+	t.Run("payload", func(t *testing.T) {
+		t.Parallel()
+		srv := listen(t)
+		c, err := NewClient(srv.LocalAddr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer c.Close()
+
+		payload := []byte("hello haystack")
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		hash, err := c.Store(ctx, payload)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		buf := make([]byte, needle.NeedleLength+1)
+		srv.SetReadDeadline(time.Now().Add(time.Second))
+		n, _, err := srv.ReadFrom(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		received, err := needle.FromBytes(buf[:n])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if received.Hash() != hash {
+			t.Error("returned hash does not match the needle sent")
+		}
+		p := received.Payload()
+		if !bytes.Equal(p[:len(payload)], payload) {
+			t.Error("payload prefix does not match")
+		}
+		if !bytes.Equal(p[len(payload):], make([]byte, needle.PayloadLength-len(payload))) {
+			t.Error("payload is not zero padded")
+		}
+	})
+	t.Run("too large", func(t *testing.T) {
+		t.Parallel()
+		c := &Client{raddr: "127.0.0.1:1"}
+		_, err := c.Store(context.Background(), make([]byte, needle.PayloadLength+1))
+		if !errors.Is(err, ErrPayloadTooLarge) {
+			t.Errorf("expected ErrPayloadTooLarge, got: %v", err)
+		}
+	})
+}
+
+func TestClientSetNil(t *testing.T) {
+	t.Parallel()
+	c := &Client{raddr: "127.0.0.1:1"}
+	if err := c.Set(nil); !errors.Is(err, needle.ErrorNeedleIsNil) {
+		t.Errorf("expected needle.ErrorNeedleIsNil, got: %v", err)
+	}
+}
+
+func TestClientGetNil(t *testing.T) {
+	t.Parallel()
+	c := &Client{raddr: "127.0.0.1:1"}
+	ctx := context.Background()
+	if _, err := c.Get(nil); !errors.Is(err, needle.ErrorHashIsNil) {
+		t.Errorf("Get: expected needle.ErrorHashIsNil, got: %v", err)
+	}
+	if _, err := c.GetContext(ctx, nil); !errors.Is(err, needle.ErrorHashIsNil) {
+		t.Errorf("GetContext: expected needle.ErrorHashIsNil, got: %v", err)
+	}
+	if _, err := c.GetBytesInto(ctx, nil, make([]byte, needle.NeedleLength)); !errors.Is(err, needle.ErrorHashIsNil) {
+		t.Errorf("GetBytesInto: expected needle.ErrorHashIsNil, got: %v", err)
+	}
+	if _, err := c.GetQuorum(ctx, nil, 1); !errors.Is(err, needle.ErrorHashIsNil) {
+		t.Errorf("GetQuorum: expected needle.ErrorHashIsNil, got: %v", err)
+	}
+	if _, err := c.Poll(ctx, nil); !errors.Is(err, needle.ErrorHashIsNil) {
+		t.Errorf("Poll: expected needle.ErrorHashIsNil, got: %v", err)
+	}
+}
+
+func TestClientSetAck(t *testing.T) {
+	t.Parallel()
+	srv := listen(t)
+	go func() {
+		buf := make([]byte, needle.NeedleLength+1)
+		for {
+			l, addr, err := srv.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			ack := buf[:needle.HashLength]
+			if l == needle.NeedleLength && buf[needle.HashLength] == 1 {
+				ack = make([]byte, needle.HashLength)
+			}
+			srv.WriteTo(ack, addr)
+		}
+	}()
+
+	c, err := NewClient(srv.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	p := make([]byte, needle.PayloadLength)
+	n, _ := needle.New(p)
+	if err := c.SetAck(ctx, n); err != nil {
+		t.Errorf("expected ack, got: %v", err)
+	}
+	p[0] = 1
+	n, _ = needle.New(p)
+	if err := c.SetAck(ctx, n); !errors.Is(err, ErrAckMismatch) {
+		t.Errorf("expected ErrAckMismatch, got: %v", err)
+	}
+}
+
+// shortConn is a net.Conn that reports writing one byte less than it was given.
+type shortConn struct {
+	net.Conn
+}
+
+func (shortConn) Write(b []byte) (int, error)   { return len(b) - 1, nil }
+func (shortConn) Read(b []byte) (int, error)    { return 0, io.EOF }
+func (shortConn) Close() error                  { return nil }
+func (shortConn) SetDeadline(t time.Time) error { return nil }
+
+func TestClientShortWrite(t *testing.T) {
+	t.Parallel()
+	c := &Client{
+		raddr: "127.0.0.1:1",
+		dial: func(ctx context.Context, network, address string) (net.Conn, error) {
+			return shortConn{}, nil
+		},
+	}
+	n, _ := needle.New(make([]byte, needle.PayloadLength))
+	hash := n.Hash()
+
+	if err := c.Set(n); !errors.Is(err, io.ErrShortWrite) {
+		t.Errorf("Set: expected io.ErrShortWrite, got: %v", err)
+	}
+	if err := c.SetAck(context.Background(), n); !errors.Is(err, io.ErrShortWrite) {
+		t.Errorf("SetAck: expected io.ErrShortWrite, got: %v", err)
+	}
+	if _, err := c.Get(&hash); !errors.Is(err, io.ErrShortWrite) {
+		t.Errorf("Get: expected io.ErrShortWrite, got: %v", err)
+	}
+}
+
+func TestClientGetTimeout(t *testing.T) {
+	t.Parallel()
+
+	srv := newFakeServer(t)
+	n, _ := needle.New(make([]byte, needle.PayloadLength))
+	hash := n.Hash()
+
+	for _, multiplex := range []bool{false, true} {
+		var opts []option
+		if multiplex {
+			opts = append(opts, WithMultiplex())
+		}
+		c, err := NewClient(srv.addr(), opts...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer c.Close()
+
+		ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+		_, err = c.GetContext(ctx, &hash)
+		cancel()
+		if !errors.Is(err, ErrTimeout) {
+			t.Errorf("multiplex %v: expected ErrTimeout, got: %v", multiplex, err)
+		}
+
+		ctx, cancel = context.WithCancel(context.Background())
+		time.AfterFunc(20*time.Millisecond, cancel)
+		_, err = c.GetContext(ctx, &hash)
+		if !errors.Is(err, context.Canceled) || errors.Is(err, ErrTimeout) {
+			t.Errorf("multiplex %v: expected context.Canceled, got: %v", multiplex, err)
+		}
+	}
+
+	// a dial that runs out of time is a timeout too
+	var dials int
+	slowDial := func(ctx context.Context, network, address string) (net.Conn, error) {
+		if dials++; dials == 1 {
+			a, _ := net.Pipe()
+			return a, nil
+		}
+		<-ctx.Done()
+		return nil, ctx.Err()
+	}
+	c, err := NewClient(srv.addr(), WithDialer(slowDial))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if _, err := c.GetContext(ctx, &hash); !errors.Is(err, ErrTimeout) {
+		t.Errorf("expected ErrTimeout from a slow dial, got: %v", err)
+	}
+}
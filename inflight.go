@@ -0,0 +1,71 @@
+package haystack
+
+import (
+	"context"
+	"sync"
+)
+
+// inflight tracks operations that have started but not yet finished writing to the
+// network. Each operation is given an increasing sequence number so that Flush can
+// wait for the operations started before it without waiting on ones started after.
+type inflight struct {
+	mu      sync.Mutex
+	next    uint64
+	active  map[uint64]struct{}
+	changed chan struct{}
+}
+
+// start registers a new operation and returns a func that marks it finished.
+func (f *inflight) start() func() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.active == nil {
+		f.active = make(map[uint64]struct{})
+		f.changed = make(chan struct{})
+	}
+	seq := f.next
+	f.next++
+	f.active[seq] = struct{}{}
+	return func() {
+		f.mu.Lock()
+		defer f.mu.Unlock()
+		delete(f.active, seq)
+		close(f.changed)
+		f.changed = make(chan struct{})
+	}
+}
+
+// wait blocks until every operation started before it was called has finished, or
+// until ctx is done.
+func (f *inflight) wait(ctx context.Context) error {
+	f.mu.Lock()
+	until := f.next
+	for {
+		pending := false
+		for seq := range f.active {
+			if seq < until {
+				pending = true
+				break
+			}
+		}
+		if !pending {
+			f.mu.Unlock()
+			return nil
+		}
+		changed := f.changed
+		f.mu.Unlock()
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-changed:
+		}
+		f.mu.Lock()
+	}
+}
+
+// Flush blocks until every SET started before it was called has finished writing to
+// its socket, or until ctx is done. It does not wait for the server to store the
+// needles; use SetAck when confirmation of storage is needed.
+func (c *Client) Flush(ctx context.Context) error {
+	return c.inflight.wait(ctx)
+}
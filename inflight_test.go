@@ -0,0 +1,119 @@
+package haystack
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/nomasters/haystack/needle"
+)
+
+// blockingConn is a net.Conn whose writes block until release is closed.
+type blockingConn struct {
+	net.Conn
+	release chan struct{}
+}
+
+func (c blockingConn) Write(b []byte) (int, error) {
+	<-c.release
+	return len(b), nil
+}
+func (blockingConn) Close() error                  { return nil }
+func (blockingConn) SetDeadline(t time.Time) error { return nil }
+
+func TestClientFlush(t *testing.T) {
+	t.Parallel()
+
+	release := make(chan struct{})
+	c := &Client{
+		raddr: "127.0.0.1:1",
+		dial: func(ctx context.Context, network, address string) (net.Conn, error) {
+			return blockingConn{release: release}, nil
+		},
+	}
+	n, _ := needle.New(make([]byte, needle.PayloadLength))
+
+	if err := c.Flush(context.Background()); err != nil {
+		t.Fatalf("expected flush with nothing in flight to return, got: %v", err)
+	}
+
+	started := make(chan struct{})
+	setDone := make(chan error)
+	go func() {
+		// hold an operation open around Set so it is registered before Flush runs
+		done := c.inflight.start()
+		close(started)
+		defer done()
+		setDone <- c.Set(n)
+	}()
+	<-started
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if err := c.Flush(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("expected flush to wait for the pending set, got: %v", err)
+	}
+
+	flushed := make(chan error)
+	go func() { flushed <- c.Flush(context.Background()) }()
+	close(release)
+	if err := <-setDone; err != nil {
+		t.Fatal(err)
+	}
+	if err := <-flushed; err != nil {
+		t.Errorf("expected flush to return once the set finished, got: %v", err)
+	}
+}
+
+func TestClientFlushIgnoresLaterSets(t *testing.T) {
+	t.Parallel()
+
+	var c Client
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	first := c.inflight.start()
+	flushed := make(chan error)
+	go func() { flushed <- c.Flush(ctx) }()
+	// give Flush time to record which operations it is waiting for
+	time.Sleep(10 * time.Millisecond)
+	second := c.inflight.start()
+	defer second()
+	first()
+
+	if err := <-flushed; err != nil {
+		t.Errorf("expected flush to ignore sets started after it, got: %v", err)
+	}
+}
+
+func TestClientCloseInFlight(t *testing.T) {
+	t.Parallel()
+
+	release := make(chan struct{})
+	c := &Client{
+		raddr: "127.0.0.1:1",
+		conn:  blockingConn{release: release},
+		dial: func(ctx context.Context, network, address string) (net.Conn, error) {
+			return blockingConn{release: release}, nil
+		},
+	}
+	n, _ := needle.New(make([]byte, needle.PayloadLength))
+
+	setDone := make(chan error)
+	go func() { setDone <- c.Set(n) }()
+	for c.active.Load() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	if err := c.Close(); !errors.Is(err, ErrOperationsInFlight) {
+		t.Errorf("expected ErrOperationsInFlight, got: %v", err)
+	}
+	close(release)
+	if err := <-setDone; err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Close(); err != nil {
+		t.Errorf("expected no error once operations finished, got: %v", err)
+	}
+}
@@ -0,0 +1,74 @@
+package haystack
+
+import (
+	"context"
+
+	"github.com/nomasters/haystack/needle"
+)
+
+// Op identifies the kind of operation passing through an Interceptor.
+type Op int
+
+const (
+	// OpSet is a fire-and-forget SET from Set or Store
+	OpSet Op = iota
+	// OpSetAck is a SET that waits for the server acknowledgement
+	OpSetAck
+	// OpGet is a GET from Get, GetContext, GetBytesInto or GetQuorum, or a single
+	// attempt of Poll
+	OpGet
+	// OpBatchSet is a single datagram of needles written by BatchSet
+	OpBatchSet
+)
+
+// String returns the lower case name of the operation.
+func (o Op) String() string {
+	switch o {
+	case OpSet:
+		return "set"
+	case OpSetAck:
+		return "setack"
+	case OpGet:
+		return "get"
+	case OpBatchSet:
+		return "batchset"
+	default:
+		return "unknown"
+	}
+}
+
+// Call describes a single operation passing through the interceptor chain. Needle
+// holds the needle being set, and for OpGet it is filled in once the needle has been
+// received and verified. GetBytesInto leaves it nil to avoid allocating. For
+// OpBatchSet, Hash and Needle are unset and Needles holds the needles of the datagram,
+// or is nil for SetBytesBatch.
+type Call struct {
+	Op      Op
+	Hash    needle.Hash
+	Needle  *needle.Needle
+	Needles []*needle.Needle
+}
+
+// OpFunc performs the operation described by call.
+type OpFunc func(ctx context.Context, call *Call) error
+
+// Interceptor wraps an OpFunc to add behaviour such as logging, tracing or metrics
+// around every Set and Get. An interceptor must call next to perform the operation
+// and may inspect call and the returned error once it returns.
+type Interceptor func(next OpFunc) OpFunc
+
+// WithInterceptors adds interceptors that wrap each operation of the client. The first
+// interceptor is the outermost, so it sees the operation first and its result last.
+func WithInterceptors(interceptors ...Interceptor) option {
+	return func(o *options) {
+		o.interceptors = append(o.interceptors, interceptors...)
+	}
+}
+
+// intercept runs op for call through the client's interceptors.
+func (c *Client) intercept(ctx context.Context, call *Call, op OpFunc) error {
+	for i := len(c.interceptors) - 1; i >= 0; i-- {
+		op = c.interceptors[i](op)
+	}
+	return op(ctx, call)
+}
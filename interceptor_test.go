@@ -0,0 +1,91 @@
+package haystack
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/nomasters/haystack/needle"
+	"github.com/nomasters/haystack/x/udp/server"
+)
+
+func TestClientInterceptors(t *testing.T) {
+	t.Parallel()
+	var order []string
+	record := func(name string) Interceptor {
+		return func(next OpFunc) OpFunc {
+			return func(ctx context.Context, call *Call) error {
+				order = append(order, name+" "+call.Op.String())
+				err := next(ctx, call)
+				order = append(order, fmt.Sprintf("%v %v %v", name, call.Needle != nil, err == nil))
+				return err
+			}
+		}
+	}
+	c := newLoopbackClient(t, WithInterceptors(record("outer"), record("inner")))
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	p := make([]byte, needle.PayloadLength)
+	n, _ := needle.New(p)
+	if err := c.SetAck(ctx, n); err != nil {
+		t.Fatal(err)
+	}
+	h := n.Hash()
+	if _, err := c.GetContext(ctx, &h); err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{
+		"outer setack", "inner setack", "inner true true", "outer true true",
+		"outer get", "inner get", "inner true true", "outer true true",
+	}
+	if fmt.Sprint(order) != fmt.Sprint(expected) {
+		t.Errorf("expected %v, got %v", expected, order)
+	}
+
+	order = nil
+	failed := errors.New("failed")
+	c.interceptors = append(c.interceptors, func(OpFunc) OpFunc {
+		return func(context.Context, *Call) error { return failed }
+	})
+	if _, err := c.GetContext(ctx, &h); !errors.Is(err, failed) {
+		t.Errorf("expected interceptor error, got: %v", err)
+	}
+}
+
+// ExampleWithInterceptors shows an interceptor that traces every operation of a
+// client. A real tracer would start a span before calling next and end it after.
+func ExampleWithInterceptors() {
+	trace := func(next OpFunc) OpFunc {
+		return func(ctx context.Context, call *Call) error {
+			start := time.Now()
+			err := next(ctx, call)
+			_ = time.Since(start) // record the duration as a span or metric
+			fmt.Printf("%v %x... err=%v\n", call.Op, call.Hash[:4], err)
+			return err
+		}
+	}
+
+	l, err := server.NewLoopback(server.WithAckSet())
+	if err != nil {
+		panic(err)
+	}
+	defer l.Close()
+	c, err := NewClient("loopback", WithDialer(l.Dial), WithInterceptors(trace))
+	if err != nil {
+		panic(err)
+	}
+	defer c.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	n, _ := needle.New(make([]byte, needle.PayloadLength))
+	c.SetAck(ctx, n)
+	h := n.Hash()
+	c.GetContext(ctx, &h)
+	// Output:
+	// setack b3939788... err=<nil>
+	// get b3939788... err=<nil>
+}
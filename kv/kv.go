@@ -0,0 +1,173 @@
+// Package kv maps user chosen string keys to needle hashes so applications
+// can store and retrieve small values from haystack without tracking hashes.
+package kv
+
+import (
+	"context"
+	"errors"
+	"sync"
+
+	"github.com/nomasters/haystack/needle"
+)
+
+const (
+	// MaxValueLength is the largest value Put accepts. The first byte of
+	// each payload records the value length so padding can be stripped on Get.
+	MaxValueLength = needle.PayloadLength - 1
+	// MaxKeyLength is the largest key that fits in a single manifest entry.
+	MaxKeyLength = needle.PayloadLength - manifestHeaderLength - 1 - needle.HashLength
+
+	// a manifest needle payload begins with the hash of the next manifest
+	// needle (all zeros for the last one) and the number of entries it holds.
+	manifestHeaderLength = needle.HashLength + 1
+)
+
+var (
+	// ErrorKeyNotFound is returned when a key has not been Put
+	ErrorKeyNotFound = errors.New("Key not found")
+	// ErrorKeyTooLarge is returned when a key exceeds MaxKeyLength
+	ErrorKeyTooLarge = errors.New("Key exceeds max key length")
+	// ErrorValueTooLarge is returned when a value exceeds MaxValueLength
+	ErrorValueTooLarge = errors.New("Value exceeds max value length")
+	// ErrorInvalidValue is returned when a needle was not written by Put
+	ErrorInvalidValue = errors.New("Invalid value")
+	// ErrorInvalidManifest is returned when a manifest needle cannot be decoded
+	ErrorInvalidManifest = errors.New("Invalid manifest")
+)
+
+// Client is the subset of haystack.Client used by a Store.
+type Client interface {
+	Store(ctx context.Context, payload []byte) (needle.Hash, error)
+	GetContext(ctx context.Context, h *needle.Hash) (*needle.Needle, error)
+}
+
+// Store keeps a local mapping from keys to needle hashes on top of a Client.
+type Store struct {
+	sync.RWMutex
+	client Client
+	keys   map[string]needle.Hash
+}
+
+// New returns a pointer to an empty Store backed by client.
+func New(client Client) *Store {
+	return &Store{
+		client: client,
+		keys:   make(map[string]needle.Hash),
+	}
+}
+
+// Put stores value in haystack and maps key to the resulting hash.
+func (s *Store) Put(ctx context.Context, key string, value []byte) error {
+	if len(key) > MaxKeyLength {
+		return ErrorKeyTooLarge
+	}
+	if len(value) > MaxValueLength {
+		return ErrorValueTooLarge
+	}
+	p := make([]byte, len(value)+1)
+	p[0] = byte(len(value))
+	copy(p[1:], value)
+	hash, err := s.client.Store(ctx, p)
+	if err != nil {
+		return err
+	}
+	s.Lock()
+	s.keys[key] = hash
+	s.Unlock()
+	return nil
+}
+
+// Get fetches the value last Put for key. The server does not answer a miss, so if
+// the needle has expired or the reply is lost Get waits until ctx is done and returns
+// the error of the client. Callers should set a deadline on ctx.
+func (s *Store) Get(ctx context.Context, key string) ([]byte, error) {
+	s.RLock()
+	hash, ok := s.keys[key]
+	s.RUnlock()
+	if !ok {
+		return nil, ErrorKeyNotFound
+	}
+	n, err := s.client.GetContext(ctx, &hash)
+	if err != nil {
+		return nil, err
+	}
+	p := n.Payload()
+	if int(p[0]) > MaxValueLength {
+		return nil, ErrorInvalidValue
+	}
+	return append([]byte(nil), p[1:1+p[0]]...), nil
+}
+
+// Hash returns the needle hash key currently maps to.
+func (s *Store) Hash(key string) (needle.Hash, bool) {
+	s.RLock()
+	defer s.RUnlock()
+	hash, ok := s.keys[key]
+	return hash, ok
+}
+
+// Save persists the key mapping as a chain of manifest needles and returns
+// the hash of the first one, which can later be passed to Load.
+func (s *Store) Save(ctx context.Context) (needle.Hash, error) {
+	s.RLock()
+	var pages [][]byte
+	page := newManifestPage()
+	for key, hash := range s.keys {
+		entry := make([]byte, 0, 1+len(key)+needle.HashLength)
+		entry = append(entry, byte(len(key)))
+		entry = append(entry, key...)
+		entry = append(entry, hash[:]...)
+		if len(page)+len(entry) > needle.PayloadLength {
+			pages = append(pages, page)
+			page = newManifestPage()
+		}
+		page = append(page, entry...)
+		page[needle.HashLength]++
+	}
+	pages = append(pages, page)
+	s.RUnlock()
+
+	// pages are written last to first so each one can reference the next.
+	var next needle.Hash
+	for i := len(pages) - 1; i >= 0; i-- {
+		copy(pages[i], next[:])
+		hash, err := s.client.Store(ctx, pages[i])
+		if err != nil {
+			return needle.Hash{}, err
+		}
+		next = hash
+	}
+	return next, nil
+}
+
+// Load returns a Store populated from the manifest chain starting at hash, giving up
+// when ctx is done as Get does.
+func Load(ctx context.Context, client Client, hash needle.Hash) (*Store, error) {
+	s := New(client)
+	for hash != (needle.Hash{}) {
+		n, err := client.GetContext(ctx, &hash)
+		if err != nil {
+			return nil, err
+		}
+		p := n.Payload()
+		copy(hash[:], p[:needle.HashLength])
+		count := int(p[needle.HashLength])
+		b := p[manifestHeaderLength:]
+		for i := 0; i < count; i++ {
+			if len(b) < 1 || len(b) < 1+int(b[0])+needle.HashLength {
+				return nil, ErrorInvalidManifest
+			}
+			keyLen := int(b[0])
+			key := string(b[1 : 1+keyLen])
+			var h needle.Hash
+			copy(h[:], b[1+keyLen:])
+			s.keys[key] = h
+			b = b[1+keyLen+needle.HashLength:]
+		}
+	}
+	return s, nil
+}
+
+func newManifestPage() []byte {
+	return make([]byte, manifestHeaderLength, needle.PayloadLength)
+}
@@ -0,0 +1,136 @@
+package kv
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/nomasters/haystack"
+	"github.com/nomasters/haystack/needle"
+	"github.com/nomasters/haystack/x/udp/server"
+)
+
+var _ Client = (*haystack.Client)(nil)
+
+type mockClient struct {
+	sync.Mutex
+	needles map[needle.Hash]*needle.Needle
+}
+
+func newMockClient() *mockClient {
+	return &mockClient{needles: make(map[needle.Hash]*needle.Needle)}
+}
+
+func (m *mockClient) Store(ctx context.Context, payload []byte) (needle.Hash, error) {
+	p := make([]byte, needle.PayloadLength)
+	copy(p, payload)
+	n, err := needle.New(p)
+	if err != nil {
+		return needle.Hash{}, err
+	}
+	m.Lock()
+	m.needles[n.Hash()] = n
+	m.Unlock()
+	return n.Hash(), nil
+}
+
+func (m *mockClient) GetContext(ctx context.Context, h *needle.Hash) (*needle.Needle, error) {
+	m.Lock()
+	defer m.Unlock()
+	n, ok := m.needles[*h]
+	if !ok {
+		return nil, errors.New("not found")
+	}
+	return n, nil
+}
+
+func TestStore(t *testing.T) {
+	t.Parallel()
+	t.Run("put and get", func(t *testing.T) {
+		t.Parallel()
+		s := New(newMockClient())
+		value := []byte("a small value\x00with a trailing nul\x00")
+		if err := s.Put(context.Background(), "key", value); err != nil {
+			t.Fatal(err)
+		}
+		got, err := s.Get(context.Background(), "key")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, value) {
+			t.Errorf("expected %q, got %q", value, got)
+		}
+		if _, err := s.Get(context.Background(), "missing"); !errors.Is(err, ErrorKeyNotFound) {
+			t.Errorf("expected ErrorKeyNotFound, got: %v", err)
+		}
+	})
+	t.Run("limits", func(t *testing.T) {
+		t.Parallel()
+		s := New(newMockClient())
+		if err := s.Put(context.Background(), "key", make([]byte, MaxValueLength+1)); !errors.Is(err, ErrorValueTooLarge) {
+			t.Errorf("expected ErrorValueTooLarge, got: %v", err)
+		}
+		if err := s.Put(context.Background(), strings.Repeat("k", MaxKeyLength+1), nil); !errors.Is(err, ErrorKeyTooLarge) {
+			t.Errorf("expected ErrorKeyTooLarge, got: %v", err)
+		}
+	})
+	t.Run("save and load", func(t *testing.T) {
+		t.Parallel()
+		c := newMockClient()
+		s := New(c)
+		for i := 0; i < 20; i++ {
+			if err := s.Put(context.Background(), fmt.Sprintf("key-%d", i), []byte{byte(i)}); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := s.Put(context.Background(), strings.Repeat("k", MaxKeyLength), []byte("long key")); err != nil {
+			t.Fatal(err)
+		}
+		hash, err := s.Save(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		loaded, err := Load(context.Background(), c, hash)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < 20; i++ {
+			got, err := loaded.Get(context.Background(), fmt.Sprintf("key-%d", i))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, []byte{byte(i)}) {
+				t.Errorf("key-%d: unexpected value %v", i, got)
+			}
+		}
+		if got, _ := loaded.Get(context.Background(), strings.Repeat("k", MaxKeyLength)); string(got) != "long key" {
+			t.Errorf("long key: unexpected value %q", got)
+		}
+	})
+	t.Run("missing needle", func(t *testing.T) {
+		t.Parallel()
+		l, err := server.NewLoopback()
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer l.Close()
+		c, err := haystack.NewClient("loopback", haystack.WithDialer(l.Dial))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer c.Close()
+		// the key maps to a needle the server does not hold, as after it expires
+		s := New(c)
+		s.keys["expired"] = needle.NewDeterministic(1, 1)[0].Hash()
+		ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		defer cancel()
+		if _, err := s.Get(ctx, "expired"); !errors.Is(err, haystack.ErrTimeout) {
+			t.Errorf("expected %v, got: %v", haystack.ErrTimeout, err)
+		}
+	})
+}
@@ -0,0 +1,143 @@
+package haystack
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/nomasters/haystack/needle"
+	"github.com/nomasters/haystack/x/udp/server"
+)
+
+// newLoopbackClient returns a client connected to an in-process server. The server
+// acknowledges SETs so that SetAck can be used to wait until a needle is stored.
+func newLoopbackClient(tb testing.TB, opts ...option) *Client {
+	tb.Helper()
+	l, err := server.NewLoopback(server.WithAckSet())
+	if err != nil {
+		tb.Fatal(err)
+	}
+	tb.Cleanup(func() { l.Close() })
+	c, err := NewClient("loopback", append(opts, WithDialer(l.Dial))...)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	tb.Cleanup(func() { c.Close() })
+	return c
+}
+
+func TestClientLoopback(t *testing.T) {
+	t.Parallel()
+	for name, opts := range map[string][]option{
+		"dial per operation": nil,
+		"multiplex":          {WithMultiplex()},
+	} {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+			c := newLoopbackClient(t, opts...)
+			ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+			defer cancel()
+
+			p, _ := needle.FitPayload([]byte("loopback"))
+			n, _ := needle.New(p[:])
+			if err := c.SetAck(ctx, n); err != nil {
+				t.Fatal(err)
+			}
+			hash := n.Hash()
+			got, err := c.GetContext(ctx, &hash)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got.Bytes(), n.Bytes()) {
+				t.Error("unexpected needle returned")
+			}
+		})
+	}
+}
+
+func BenchmarkClient_Set(b *testing.B) {
+	c := newLoopbackClient(b)
+	n, _ := needle.New(make([]byte, needle.PayloadLength))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := c.Set(n); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkClient_Get(b *testing.B) {
+	for name, opts := range map[string][]option{
+		"dial per operation": nil,
+		"multiplex":          {WithMultiplex()},
+	} {
+		b.Run(name, func(b *testing.B) {
+			c := newLoopbackClient(b, opts...)
+			n, _ := needle.New(make([]byte, needle.PayloadLength))
+			if err := c.SetAck(context.Background(), n); err != nil {
+				b.Fatal(err)
+			}
+			hash := n.Hash()
+			b.ReportAllocs()
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				for pb.Next() {
+					if _, err := c.Get(&hash); err != nil {
+						b.Fatal(err)
+					}
+				}
+			})
+		})
+	}
+}
+
+func TestClientGetBytesInto(t *testing.T) {
+	t.Parallel()
+	c := newLoopbackClient(t)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	n, _ := needle.New(make([]byte, needle.PayloadLength))
+	if err := c.SetAck(ctx, n); err != nil {
+		t.Fatal(err)
+	}
+	hash := n.Hash()
+
+	if _, err := c.GetBytesInto(ctx, &hash, make([]byte, needle.NeedleLength-1)); !errors.Is(err, ErrBufferTooSmall) {
+		t.Errorf("expected ErrBufferTooSmall, got: %v", err)
+	}
+	dst := make([]byte, needle.NeedleLength+8)
+	l, err := c.GetBytesInto(ctx, &hash, dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(dst[:l], n.Bytes()) {
+		t.Error("unexpected bytes read")
+	}
+}
+
+func BenchmarkClient_GetBytesInto(b *testing.B) {
+	for name, opts := range map[string][]option{
+		"dial per operation": nil,
+		"multiplex":          {WithMultiplex()},
+	} {
+		b.Run(name, func(b *testing.B) {
+			c := newLoopbackClient(b, opts...)
+			n, _ := needle.New(make([]byte, needle.PayloadLength))
+			if err := c.SetAck(context.Background(), n); err != nil {
+				b.Fatal(err)
+			}
+			hash := n.Hash()
+			dst := make([]byte, needle.NeedleLength)
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if _, err := c.GetBytesInto(context.Background(), &hash, dst); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
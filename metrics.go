@@ -0,0 +1,140 @@
+package haystack
+
+import (
+	"math"
+	"math/bits"
+	"sync/atomic"
+	"time"
+)
+
+// subBucketBits is the number of bits of precision kept by a histogram bucket, so a
+// recorded latency is off by at most 1/2^subBucketBits of its value.
+const subBucketBits = 4
+
+// histogramBuckets covers every uint64 nanosecond value.
+const histogramBuckets = (64 - subBucketBits + 1) << subBucketBits
+
+// WithMetrics records the count, errors and latency of every SET and GET that goes to
+// the network, which the caller reads with Metrics. Collection is off by default so
+// clients that do not need it pay nothing for it.
+func WithMetrics() option {
+	return func(o *options) {
+		o.metrics = true
+	}
+}
+
+// OpMetrics summarises one kind of operation. Latencies are accurate to within about 6%.
+type OpMetrics struct {
+	Count  uint64
+	Errors uint64
+	P50    time.Duration
+	P90    time.Duration
+	P99    time.Duration
+}
+
+// Metrics is a point in time copy of the client's operation metrics. Set covers Set,
+// Store and SetAck and Get covers Get, GetContext, GetBytesInto and Poll. GETs served
+// from the cache are not counted, and a GET that is retried counts once, with the
+// latency of all of its attempts.
+type Metrics struct {
+	Set OpMetrics
+	Get OpMetrics
+}
+
+// Metrics returns the client's operation metrics. It is zero unless the client was
+// created WithMetrics.
+func (c *Client) Metrics() Metrics {
+	if c.setLatency == nil {
+		return Metrics{}
+	}
+	return Metrics{
+		Set: c.setLatency.snapshot(),
+		Get: c.getLatency.snapshot(),
+	}
+}
+
+// start returns the start time of an operation to pass to observe. Both are no-ops
+// when h is nil, so callers need not check whether metrics are enabled and a client
+// without metrics does not read the clock.
+func (h *histogram) start() time.Time {
+	if h == nil {
+		return time.Time{}
+	}
+	return time.Now()
+}
+
+// observe records an operation that started at start and returned *err in h.
+func (h *histogram) observe(start time.Time, err *error) {
+	if h == nil {
+		return
+	}
+	h.record(time.Since(start), *err)
+}
+
+// histogram is a lock free latency histogram in the style of HDR histograms: values
+// are grouped by their power of two and each power of two is split into 2^subBucketBits
+// linear sub-buckets.
+type histogram struct {
+	count   atomic.Uint64
+	errors  atomic.Uint64
+	buckets [histogramBuckets]atomic.Uint64
+}
+
+func (h *histogram) record(d time.Duration, err error) {
+	h.count.Add(1)
+	if err != nil {
+		h.errors.Add(1)
+	}
+	h.buckets[bucketIndex(uint64(max(d, 0)))].Add(1)
+}
+
+func (h *histogram) snapshot() OpMetrics {
+	var counts [histogramBuckets]uint64
+	var total uint64
+	for i := range h.buckets {
+		counts[i] = h.buckets[i].Load()
+		total += counts[i]
+	}
+	return OpMetrics{
+		Count:  h.count.Load(),
+		Errors: h.errors.Load(),
+		P50:    percentile(&counts, total, 0.50),
+		P90:    percentile(&counts, total, 0.90),
+		P99:    percentile(&counts, total, 0.99),
+	}
+}
+
+// percentile returns the value at quantile q of the total values in counts.
+func percentile(counts *[histogramBuckets]uint64, total uint64, q float64) time.Duration {
+	if total == 0 {
+		return 0
+	}
+	rank := uint64(math.Ceil(q * float64(total)))
+	var seen uint64
+	for i, n := range counts {
+		if seen += n; seen >= rank {
+			return time.Duration(bucketValue(i))
+		}
+	}
+	return 0
+}
+
+// bucketIndex returns the bucket holding v. Values below 2^subBucketBits get a bucket
+// each, larger values share a bucket with those equal in their top subBucketBits+1 bits.
+func bucketIndex(v uint64) int {
+	if v < 1<<subBucketBits {
+		return int(v)
+	}
+	shift := bits.Len64(v) - subBucketBits - 1
+	return (shift+1)<<subBucketBits + int(v>>shift) - 1<<subBucketBits
+}
+
+// bucketValue returns the middle of the range of values held by bucket i.
+func bucketValue(i int) uint64 {
+	if i < 1<<subBucketBits {
+		return uint64(i)
+	}
+	shift := i>>subBucketBits - 1
+	low := uint64(i&(1<<subBucketBits-1)+1<<subBucketBits) << shift
+	return low + (1<<shift)>>1
+}
@@ -0,0 +1,98 @@
+package haystack
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/nomasters/haystack/needle"
+)
+
+func TestClientMetrics(t *testing.T) {
+	t.Parallel()
+	c := newLoopbackClient(t, WithMetrics())
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if m := c.Metrics(); m != (Metrics{}) {
+		t.Fatalf("expected zero metrics, got %+v", m)
+	}
+
+	for _, n := range needle.NewDeterministic(3, 10) {
+		if err := c.SetAck(ctx, n); err != nil {
+			t.Fatal(err)
+		}
+		h := n.Hash()
+		if _, err := c.GetContext(ctx, &h); err != nil {
+			t.Fatal(err)
+		}
+	}
+	missCtx, missCancel := context.WithTimeout(ctx, 10*time.Millisecond)
+	defer missCancel()
+	var missing needle.Hash
+	if _, err := c.GetContext(missCtx, &missing); err == nil {
+		t.Fatal("expected a miss to time out")
+	}
+
+	m := c.Metrics()
+	if m.Set.Count != 10 || m.Set.Errors != 0 {
+		t.Errorf("expected 10 sets without errors, got %+v", m.Set)
+	}
+	if m.Get.Count != 11 || m.Get.Errors != 1 {
+		t.Errorf("expected 11 gets with 1 error, got %+v", m.Get)
+	}
+	for _, op := range []OpMetrics{m.Set, m.Get} {
+		if op.P50 <= 0 || op.P50 > op.P90 || op.P90 > op.P99 {
+			t.Errorf("expected ordered, non zero percentiles, got %+v", op)
+		}
+	}
+	if m.Get.P99 < 10*time.Millisecond {
+		t.Errorf("expected the miss to raise p99 to at least 10ms, got %v", m.Get.P99)
+	}
+}
+
+func TestClientMetricsDisabled(t *testing.T) {
+	t.Parallel()
+	c := newLoopbackClient(t)
+	n := needle.NewDeterministic(4, 1)[0]
+	if err := c.SetAck(context.Background(), n); err != nil {
+		t.Fatal(err)
+	}
+	if m := c.Metrics(); m != (Metrics{}) {
+		t.Errorf("expected zero metrics, got %+v", m)
+	}
+}
+
+func TestHistogramPercentiles(t *testing.T) {
+	t.Parallel()
+	var h histogram
+	for i := 1; i <= 1000; i++ {
+		h.record(time.Duration(i)*time.Microsecond, nil)
+	}
+	m := h.snapshot()
+	for _, test := range []struct {
+		got, expected time.Duration
+	}{
+		{m.P50, 500 * time.Microsecond},
+		{m.P90, 900 * time.Microsecond},
+		{m.P99, 990 * time.Microsecond},
+	} {
+		if diff := float64(test.got-test.expected) / float64(test.expected); diff < -0.07 || diff > 0.07 {
+			t.Errorf("expected about %v, got %v", test.expected, test.got)
+		}
+	}
+}
+
+func TestBucketIndex(t *testing.T) {
+	t.Parallel()
+	last := -1
+	for _, v := range []uint64{0, 1, 15, 16, 17, 31, 32, 33, 1000, 1 << 40, 1<<64 - 1} {
+		i := bucketIndex(v)
+		if i < last || i >= histogramBuckets {
+			t.Errorf("bucket %v for %v is out of order or range", i, v)
+		}
+		last = i
+		if b := bucketValue(i); bucketIndex(b) != i {
+			t.Errorf("value %v of bucket %v is in bucket %v", b, i, bucketIndex(b))
+		}
+	}
+}
@@ -0,0 +1,38 @@
+package haystack
+
+import (
+	"context"
+	"sync"
+
+	"github.com/nomasters/haystack/needle"
+)
+
+// multiGetConcurrency is the most GETs MultiGet has in flight at once, which bounds the
+// number of sockets it opens.
+const multiGetConcurrency = 64
+
+// MultiGet requests every hash concurrently, with up to 64 GETs in flight at a time,
+// and returns the needles and errors in the order of hashes. Each GET goes through
+// the same path as GetContext, including the cache and interceptors, so responses
+// are verified against the hash that requested them and late or duplicate datagrams
+// are discarded. A hash that is not returned before ctx is done gets an error wrapping
+// ErrTimeout, so ctx should carry a deadline.
+func (c *Client) MultiGet(ctx context.Context, hashes []needle.Hash) ([]*needle.Needle, []error) {
+	needles := make([]*needle.Needle, len(hashes))
+	errs := make([]error, len(hashes))
+	sem := make(chan struct{}, multiGetConcurrency)
+	var wg sync.WaitGroup
+	for i := range hashes {
+		sem <- struct{}{}
+		wg.Add(1)
+		go func() {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+			needles[i], errs[i] = c.get(ctx, &hashes[i])
+		}()
+	}
+	wg.Wait()
+	return needles, errs
+}
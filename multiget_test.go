@@ -0,0 +1,54 @@
+package haystack
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/nomasters/haystack/needle"
+)
+
+func TestClientMultiGet(t *testing.T) {
+	t.Parallel()
+	for name, opts := range map[string][]option{
+		"dial per operation": nil,
+		"multiplex":          {WithMultiplex()},
+	} {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+			c := newLoopbackClient(t, opts...)
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+
+			needles := needle.NewDeterministic(4, 500)
+			hashes := make([]needle.Hash, 0, len(needles))
+			for _, n := range needles {
+				if err := c.SetAck(ctx, n); err != nil {
+					t.Fatal(err)
+				}
+				hashes = append(hashes, n.Hash())
+			}
+			got, errs := c.MultiGet(ctx, hashes)
+			for i, n := range needles {
+				if errs[i] != nil {
+					t.Fatalf("needle %v: %v", i, errs[i])
+				}
+				if got[i].Hash() != n.Hash() {
+					t.Errorf("needle %v: expected %x, got %x", i, n.Hash(), got[i].Hash())
+				}
+			}
+
+			// a hash that was never set is only given up on once ctx is done
+			missingCtx, cancel := context.WithTimeout(ctx, 200*time.Millisecond)
+			defer cancel()
+			got, errs = c.MultiGet(missingCtx, []needle.Hash{hashes[0], {1}})
+			if errs[0] != nil || got[0].Hash() != hashes[0] {
+				t.Errorf("expected the stored needle alongside a missing one, got: %v", errs[0])
+			}
+			if got[1] != nil || !errors.Is(errs[1], ErrTimeout) {
+				t.Errorf("expected missing hash to time out, got: %v, %v", got[1], errs[1])
+			}
+		})
+	}
+}
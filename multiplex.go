@@ -0,0 +1,129 @@
+package haystack
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+
+	"github.com/nomasters/haystack/needle"
+)
+
+// mux shares a single UDP socket between concurrent operations. Because a needle
+// response carries its own hash, responses can be matched to the GET that asked for
+// them without any extra framing, so one reader goroutine dispatches every response
+// to the waiters registered for its hash.
+type mux struct {
+	conn    net.Conn
+	stream  bool
+	mu      sync.Mutex
+	pending map[needle.Hash][]chan []byte
+	// failed is closed with err set once a stream connection can no longer be read.
+	failed chan struct{}
+	err    error
+}
+
+// newMux returns a mux reading responses from conn until conn is closed. If stream
+// is true, conn is a framed stream connection that is unusable after a read error.
+func newMux(conn net.Conn, stream bool) *mux {
+	m := &mux{
+		conn:    conn,
+		stream:  stream,
+		pending: make(map[needle.Hash][]chan []byte),
+		failed:  make(chan struct{}),
+	}
+	go m.read()
+	return m
+}
+
+func (m *mux) read() {
+	buf := make([]byte, needle.NeedleLength+1)
+	for {
+		n, err := m.conn.Read(buf)
+		if errors.Is(err, net.ErrClosed) {
+			return
+		}
+		// a stream that was hung up or broken returns the same error on every read,
+		// so fail the waiters rather than spin.
+		var ne net.Error
+		if err != nil && m.stream && !(errors.As(err, &ne) && ne.Timeout()) {
+			m.err = fmt.Errorf("multiplexed connection: %w", err)
+			close(m.failed)
+			return
+		}
+		// other read errors, such as a refused connection reported by ICMP, only
+		// affect the datagram that caused them, so keep reading.
+		if err != nil || n != needle.NeedleLength {
+			continue
+		}
+		var hash needle.Hash
+		copy(hash[:], buf)
+		m.mu.Lock()
+		waiters := m.pending[hash]
+		delete(m.pending, hash)
+		m.mu.Unlock()
+		for _, w := range waiters {
+			w <- append([]byte(nil), buf[:n]...)
+		}
+	}
+}
+
+// get writes a request for hash to the shared socket and waits for the matching
+// response or for ctx to be done.
+func (m *mux) get(ctx context.Context, hash needle.Hash) ([]byte, error) {
+	select {
+	case <-m.failed:
+		return nil, m.err
+	default:
+	}
+	w := make(chan []byte, 1)
+	m.mu.Lock()
+	m.pending[hash] = append(m.pending[hash], w)
+	m.mu.Unlock()
+
+	if err := write(m.conn, hash[:]); err != nil {
+		m.cancel(hash, w)
+		return nil, err
+	}
+	select {
+	case b := <-w:
+		return b, nil
+	case <-m.failed:
+		m.cancel(hash, w)
+		return nil, m.err
+	case <-ctx.Done():
+		m.cancel(hash, w)
+		return nil, ctx.Err()
+	}
+}
+
+// cancel removes a waiter that is no longer interested in a response.
+func (m *mux) cancel(hash needle.Hash, w chan []byte) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	waiters := m.pending[hash]
+	for i := range waiters {
+		if waiters[i] == w {
+			waiters = append(waiters[:i], waiters[i+1:]...)
+			break
+		}
+	}
+	if len(waiters) == 0 {
+		delete(m.pending, hash)
+	} else {
+		m.pending[hash] = waiters
+	}
+}
+
+// WithMultiplex makes the client send every Set and Get over the single socket opened
+// by NewClient, instead of a socket per operation, with one reader goroutine matching
+// responses to requests by hash. This scales to many more concurrent GETs since no
+// socket is created per operation. Over TCP, once the server closes the connection
+// every pending and later Get fails with the read error, and a new client must be
+// created to reconnect.
+func WithMultiplex() option {
+	return func(o *options) {
+		o.multiplex = true
+	}
+}
@@ -0,0 +1,92 @@
+package haystack
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/nomasters/haystack/needle"
+)
+
+func TestClientMultiplex(t *testing.T) {
+	t.Parallel()
+
+	srv := newFakeServer(t)
+	needles := make([]*needle.Needle, 200)
+	for i := range needles {
+		p := make([]byte, needle.PayloadLength)
+		rand.Read(p)
+		needles[i], _ = needle.New(p)
+		srv.set(needles[i])
+	}
+
+	c, err := NewClient(srv.addr(), WithMultiplex())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	var wg sync.WaitGroup
+	for _, n := range needles {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			hash := n.Hash()
+			got, err := c.get(ctx, &hash)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			if !bytes.Equal(got.Bytes(), n.Bytes()) {
+				t.Error("multiplexed response matched to the wrong request")
+			}
+		}()
+	}
+	wg.Wait()
+
+	c.mux.mu.Lock()
+	if len(c.mux.pending) != 0 {
+		t.Errorf("expected no pending waiters, got %v", len(c.mux.pending))
+	}
+	c.mux.mu.Unlock()
+}
+
+func TestClientMultiplexMiss(t *testing.T) {
+	t.Parallel()
+
+	srv := newFakeServer(t)
+	c, err := NewClient(srv.addr(), WithMultiplex())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	p := make([]byte, needle.PayloadLength)
+	n, _ := needle.New(p)
+	hash := n.Hash()
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if _, err := c.get(ctx, &hash); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("expected miss to time out, got: %v", err)
+	}
+	c.mux.mu.Lock()
+	if len(c.mux.pending) != 0 {
+		t.Errorf("expected timed out waiter to be removed, got %v", len(c.mux.pending))
+	}
+	c.mux.mu.Unlock()
+
+	if err := c.Set(n); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel = context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if _, err := c.get(ctx, &hash); err != nil {
+		t.Errorf("expected needle set over the shared socket to be found, got: %v", err)
+	}
+}
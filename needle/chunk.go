@@ -0,0 +1,117 @@
+package needle
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"io"
+)
+
+const (
+	// chunkHeaderLength is the number of bytes at the start of a chunk payload
+	// used to record the length of the chunk data that follows.
+	chunkHeaderLength = 2
+	// MaxChunkLength is the largest amount of data a single chunk Needle can hold.
+	MaxChunkLength = PayloadLength - chunkHeaderLength
+)
+
+var (
+	// ErrorInvalidChunk is an error for a Needle that does not contain a valid chunk header
+	ErrorInvalidChunk = errors.New("invalid chunk")
+	// ErrorInvalidCDCOptions is an error for CDCOptions with out of range sizes
+	ErrorInvalidCDCOptions = errors.New("invalid cdc options")
+)
+
+// CDCOptions configures content defined chunking. A boundary is placed once a chunk
+// is at least MinSize bytes and the rolling hash matches Mask, or when the chunk
+// reaches MaxSize bytes. The zero value uses DefaultCDCOptions.
+type CDCOptions struct {
+	MinSize int
+	MaxSize int
+	Mask    uint64
+}
+
+// DefaultCDCOptions targets an average chunk of roughly 64 bytes, which leaves room
+// for boundaries to shift before the MaxChunkLength cap is reached.
+var DefaultCDCOptions = CDCOptions{
+	MinSize: 32,
+	MaxSize: MaxChunkLength,
+	Mask:    1<<5 - 1,
+}
+
+// gear is the table of random values used by the rolling hash. It is derived from
+// a fixed seed so chunk boundaries are identical across processes and versions.
+var gear = func() (t [256]uint64) {
+	x := uint64(0x686179737461636b) // "haystack"
+	for i := range t {
+		// splitmix64
+		x += 0x9e3779b97f4a7c15
+		z := x
+		z = (z ^ (z >> 30)) * 0xbf58476d1ce4e5b9
+		z = (z ^ (z >> 27)) * 0x94d049bb133111eb
+		t[i] = z ^ (z >> 31)
+	}
+	return t
+}()
+
+// ChunkCDC reads r to EOF and splits it into chunk Needles using a gear based rolling
+// hash to choose boundaries. Because boundaries depend on content rather than offset,
+// inserting or removing bytes only changes the chunks around the edit, so identical
+// content elsewhere in the stream produces identical chunk hashes. Each Needle payload
+// holds a 2 byte big endian data length followed by the chunk data and zero padding.
+func ChunkCDC(r io.Reader, opts CDCOptions) ([]*Needle, error) {
+	if opts == (CDCOptions{}) {
+		opts = DefaultCDCOptions
+	}
+	if opts.MinSize < 1 || opts.MaxSize > MaxChunkLength || opts.MinSize > opts.MaxSize {
+		return nil, ErrorInvalidCDCOptions
+	}
+
+	var needles []*Needle
+	br := bufio.NewReader(r)
+	chunk := make([]byte, 0, opts.MaxSize)
+	var h uint64
+	for {
+		b, err := br.ReadByte()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		chunk = append(chunk, b)
+		h = h<<1 + gear[b]
+		if len(chunk) < opts.MinSize {
+			continue
+		}
+		if h&opts.Mask == 0 || len(chunk) == opts.MaxSize {
+			needles = append(needles, newChunk(chunk))
+			chunk = chunk[:0]
+			h = 0
+		}
+	}
+	if len(chunk) > 0 {
+		needles = append(needles, newChunk(chunk))
+	}
+	return needles, nil
+}
+
+// ChunkData returns the chunk data framed in the payload of a Needle created by ChunkCDC.
+func ChunkData(n *Needle) ([]byte, error) {
+	if n == nil {
+		return nil, ErrorNeedleIsNil
+	}
+	l := int(binary.BigEndian.Uint16(n.payload[:chunkHeaderLength]))
+	if l > MaxChunkLength {
+		return nil, ErrorInvalidChunk
+	}
+	return append([]byte(nil), n.payload[chunkHeaderLength:chunkHeaderLength+l]...), nil
+}
+
+func newChunk(data []byte) *Needle {
+	p := make([]byte, PayloadLength)
+	binary.BigEndian.PutUint16(p, uint16(len(data)))
+	copy(p[chunkHeaderLength:], data)
+	n, _ := New(p)
+	return n
+}
@@ -0,0 +1,92 @@
+package needle
+
+import (
+	"bytes"
+	"math/rand"
+	"testing"
+)
+
+func TestChunkCDC(t *testing.T) {
+	t.Parallel()
+
+	data := make([]byte, 16*1024)
+	rand.New(rand.NewSource(1)).Read(data)
+
+	t.Run("round trip", func(t *testing.T) {
+		t.Parallel()
+		needles, err := ChunkCDC(bytes.NewReader(data), CDCOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		var out []byte
+		for _, n := range needles {
+			chunk, err := ChunkData(n)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(chunk) > MaxChunkLength {
+				t.Errorf("chunk exceeds MaxChunkLength: %v", len(chunk))
+			}
+			out = append(out, chunk...)
+		}
+		if !bytes.Equal(out, data) {
+			t.Error("reassembled chunks do not match input")
+		}
+	})
+	t.Run("shared chunks after insert", func(t *testing.T) {
+		t.Parallel()
+		original, _ := ChunkCDC(bytes.NewReader(data), CDCOptions{})
+		shifted, _ := ChunkCDC(bytes.NewReader(append([]byte{0xff}, data...)), CDCOptions{})
+
+		hashes := make(map[Hash]bool)
+		for _, n := range original {
+			hashes[n.Hash()] = true
+		}
+		shared := 0
+		for _, n := range shifted {
+			if hashes[n.Hash()] {
+				shared++
+			}
+		}
+		// a one byte insert should only disturb the first few chunks
+		if shared < len(original)-4 {
+			t.Errorf("expected most chunks to be shared, got %v of %v", shared, len(original))
+		}
+	})
+	t.Run("empty", func(t *testing.T) {
+		t.Parallel()
+		needles, err := ChunkCDC(bytes.NewReader(nil), CDCOptions{})
+		if err != nil || len(needles) != 0 {
+			t.Errorf("expected no chunks, got: %v, %v", len(needles), err)
+		}
+	})
+	t.Run("invalid options", func(t *testing.T) {
+		t.Parallel()
+		testTable := []struct {
+			opts        CDCOptions
+			description string
+		}{
+			{CDCOptions{MinSize: 0, MaxSize: 64}, "min size too small"},
+			{CDCOptions{MinSize: 32, MaxSize: MaxChunkLength + 1}, "max size too large"},
+			{CDCOptions{MinSize: 64, MaxSize: 32}, "min size larger than max size"},
+		}
+		for _, test := range testTable {
+			if _, err := ChunkCDC(bytes.NewReader(data), test.opts); err != ErrorInvalidCDCOptions {
+				t.Errorf("%v: expected ErrorInvalidCDCOptions, got: %v", test.description, err)
+			}
+		}
+	})
+}
+
+func TestChunkData(t *testing.T) {
+	t.Parallel()
+	p := make([]byte, PayloadLength)
+	p[0], p[1] = 0xff, 0xff
+	n, _ := New(p)
+	if _, err := ChunkData(n); err != ErrorInvalidChunk {
+		t.Errorf("expected ErrorInvalidChunk, got: %v", err)
+	}
+	if _, err := ChunkData(nil); err != ErrorNeedleIsNil {
+		t.Errorf("expected ErrorNeedleIsNil, got: %v", err)
+	}
+}
@@ -0,0 +1,62 @@
+package needle
+
+import (
+	"bytes"
+	"compress/flate"
+	"errors"
+	"io"
+)
+
+const (
+	// KindUncompressed is the kind of a needle created by NewCompressed whose data did
+	// not compress to fit, so it is stored as is.
+	KindUncompressed byte = 0
+	// KindCompressed is the kind of a needle created by NewCompressed whose data is
+	// stored DEFLATE compressed.
+	KindCompressed byte = 1
+)
+
+// ErrorUnknownCompression is an error for a needle whose kind is neither
+// KindUncompressed nor KindCompressed passed to DecompressedPayload
+var ErrorUnknownCompression = errors.New("unknown compression kind")
+
+// NewCompressed creates a typed Needle holding data. If the DEFLATE compressed form of
+// data fits in TypedDataLength bytes, the needle has kind KindCompressed and holds it,
+// so low entropy data longer than a payload, such as text or zero padded values, can
+// still fit in a single needle. Otherwise the needle has kind KindUncompressed and
+// holds data as is, which must then fit in TypedDataLength bytes or
+// ErrorByteSliceLength is returned. The returned bool reports whether data was
+// compressed. The hash covers the stored bytes, so servers handle compressed needles
+// like any other.
+func NewCompressed(data []byte) (*Needle, bool, error) {
+	var buf bytes.Buffer
+	w, _ := flate.NewWriter(&buf, flate.BestCompression)
+	w.Write(data)
+	w.Close()
+	if buf.Len() <= TypedDataLength {
+		n, err := NewTyped(KindCompressed, buf.Bytes())
+		return n, true, err
+	}
+	n, err := NewTyped(KindUncompressed, data)
+	return n, false, err
+}
+
+// DecompressedPayload returns the data of a needle created with NewCompressed. For a
+// KindCompressed needle it is exactly the data that was compressed. For a
+// KindUncompressed needle it is the TypedDataLength bytes returned by TypedPayload,
+// including any zero padding. Other kinds return ErrorUnknownCompression.
+func (n *Needle) DecompressedPayload() ([]byte, error) {
+	switch n.Kind() {
+	case KindUncompressed:
+		return n.TypedPayload(), nil
+	case KindCompressed:
+		// the compressed stream marks its own end, so the zero padding after it is
+		// never read. A payload this small cannot decompress to more than about
+		// 160KiB, so the output needs no limit.
+		r := flate.NewReader(bytes.NewReader(n.payload[1:]))
+		defer r.Close()
+		return io.ReadAll(r)
+	default:
+		return nil, ErrorUnknownCompression
+	}
+}
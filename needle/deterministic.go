@@ -0,0 +1,25 @@
+package needle
+
+import (
+	"encoding/binary"
+	"math/rand/v2"
+)
+
+// NewDeterministic returns count valid needles with payloads drawn from a PRNG seeded
+// with seed, so the same seed always produces the same needles and hashes. It is meant
+// for tests and benchmarks that need a reproducible corpus. The payloads are not
+// cryptographically random and must not be used where unpredictability matters.
+func NewDeterministic(seed uint64, count int) []*Needle {
+	r := rand.New(rand.NewPCG(seed, seed))
+	needles := make([]*Needle, count)
+	var p Payload
+	for i := range needles {
+		// PayloadLength is a multiple of 8
+		for j := 0; j < len(p); j += 8 {
+			binary.LittleEndian.PutUint64(p[j:], r.Uint64())
+		}
+		// p is exactly PayloadLength bytes, so New cannot fail
+		needles[i], _ = New(p[:])
+	}
+	return needles
+}
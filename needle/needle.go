@@ -8,11 +8,14 @@ import (
 
 const (
 	// HashLength is the length in bytes of the hash prefix in any message
-	HashLength = 32
+	HashLength = sha256.Size
 	// PayloadLength is the length of the remaining bytes of the message.
 	PayloadLength = 160
 	// NeedleLength is the number of bytes required for a valid needle.
 	NeedleLength = HashLength + PayloadLength
+	// MaxBatchCount is the number of needles that fit in a single UDP datagram without
+	// fragmenting on a 1500 byte Ethernet MTU, after 28 bytes of IPv4 and UDP headers.
+	MaxBatchCount = 7
 )
 
 // Hash represents an array of length HashLength
@@ -21,8 +24,8 @@ type Hash [HashLength]byte
 // Payload represents an array of length PayloadLength
 type Payload [PayloadLength]byte
 
-// Needle is a container for a 160 byte payload
-// and a 32 byte sha256 hash of the payload.
+// Needle is a container for a PayloadLength byte payload
+// and a HashLength byte sha256 hash of the payload.
 type Needle struct {
 	hash    Hash
 	payload Payload
@@ -33,10 +36,14 @@ var (
 	ErrorInvalidHash = errors.New("invalid hash")
 	// ErrorByteSliceLength is an error for an invalid byte slice length passed in to New or FromBytes
 	ErrorByteSliceLength = errors.New("invalid byte slice length")
+	// ErrorNeedleIsNil is an error for a nil *Needle passed where a Needle is required
+	ErrorNeedleIsNil = errors.New("nil *Needle")
+	// ErrorHashIsNil is an error for a nil *Hash passed where a Hash is required
+	ErrorHashIsNil = errors.New("nil *Hash")
 )
 
 // New creates a Needle used for submitting a payload to a Haystack sever. It takes a Payload
-// byte slice that is 160 bytes in length and returns a reference to a
+// byte slice that is PayloadLength bytes in length and returns a reference to a
 // Needle and an error. The purpose of this function is to make it
 // easy to create a new Needle from a payload. This function handles creating a sha256
 // hash of the payload, which is used by the Needle to submit to a haystack server.
@@ -50,11 +57,20 @@ func New(payload []byte) (*Needle, error) {
 	}, nil
 }
 
+// FitPayload copies data into a zero padded Payload. The returned bool is true if data
+// was longer than PayloadLength and had to be truncated, so callers can treat silent
+// data loss as an error.
+func FitPayload(data []byte) (Payload, bool) {
+	var p Payload
+	copy(p[:], data)
+	return p, len(data) > PayloadLength
+}
+
 // FromBytes is intended convert raw bytes (from UDP or storage) into a Needle.
 // It takes a byte slice and expects it to be exactly the length of NeedleLength.
-// The byte slice should consist of the first 32 bytes being the sha256 hash of the
+// The byte slice should consist of the first HashLength bytes being the sha256 hash of the
 // payload and the payload bytes. This function verifies the length of the byte slice,
-// copies the bytes into a private [192]byte array, and validates the Needle. It returns
+// copies the bytes into private Hash and Payload arrays, and validates the Needle. It returns
 // a reference to a Needle and an error.
 func FromBytes(b []byte) (*Needle, error) {
 	if len(b) != NeedleLength {
@@ -70,6 +86,29 @@ func FromBytes(b []byte) (*Needle, error) {
 	return &n, nil
 }
 
+// FromBytesTrusted converts raw bytes into a Needle without validating that the
+// hash prefix matches the sha256 hash of the payload. It only checks that the
+// byte slice is exactly NeedleLength. This must only be used for bytes from a
+// trusted source, such as a client on a private link that has already computed
+// the hash, since a mismatched Needle will be stored and served as-is.
+func FromBytesTrusted(b []byte) (*Needle, error) {
+	if len(b) != NeedleLength {
+		return nil, ErrorByteSliceLength
+	}
+	return &Needle{
+		hash:    Hash(b[:HashLength]),
+		payload: Payload(b[HashLength:]),
+	}, nil
+}
+
+// NewTrusted returns a Needle from a hash that was already computed for payload, such
+// as one kept alongside the payload by a store that validated it on the way in. Like
+// FromBytesTrusted it does not verify the hash, so it must only be used when hash is
+// known to be the sha256 hash of payload, since a mismatched Needle would be served as-is.
+func NewTrusted(hash Hash, payload Payload) *Needle {
+	return &Needle{hash: hash, payload: payload}
+}
+
 // Hash returns a copy of the bytes of the sha256 256 hash of the Needle payload.
 func (n *Needle) Hash() Hash {
 	return n.hash
@@ -80,7 +119,7 @@ func (n *Needle) Payload() Payload {
 	return n.payload
 }
 
-// Bytes returns a byte slice of the entire 192 byte hash + payload
+// Bytes returns a byte slice of the entire NeedleLength byte hash + payload
 func (n *Needle) Bytes() []byte {
 	b := make([]byte, NeedleLength)
 	copy(b, n.hash[:])
@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"crypto/sha256"
 	"encoding/hex"
+	"errors"
 	"testing"
 )
 
@@ -156,6 +157,102 @@ func TestFromBytes(t *testing.T) {
 	}
 }
 
+func TestFromBytesTrusted(t *testing.T) {
+	t.Parallel()
+
+	invalidHash, _ := hex.DecodeString("182e0ca0d2fb1da76da6caf36a9d0d2838655632e85891216dc8b545d8f1410940e4350b03d8b0c9e340321210b259d9a20b19632929b4a219254a4269c11f820c75168c6a91d309f4b134a7d715a5ac408991e1cf9415995053cf8a4e185dae22a06617ac51ebf7d232bc49e567f90be4db815c2b88ca0d9a4ef7a5119c0e592c88dfb96706e6510fb8a657c0f70f6695ea310d24786e6d980e9b33cf2665342b965b2391f6bb982c4c5f6058b9cba58038d32452e07cdee9420a8bd7f514e1")
+
+	testTable := []struct {
+		rawBytes    []byte
+		hasError    bool
+		description string
+	}{
+		{
+			rawBytes:    invalidHash,
+			hasError:    false,
+			description: "invalid hash is trusted",
+		},
+		{
+			rawBytes:    make([]byte, NeedleLength-1),
+			hasError:    true,
+			description: "too few bytes",
+		},
+		{
+			rawBytes:    make([]byte, NeedleLength+1),
+			hasError:    true,
+			description: "too many bytes",
+		},
+	}
+	for _, test := range testTable {
+		n, err := FromBytesTrusted(test.rawBytes)
+		if err != nil {
+			if !test.hasError {
+				t.Errorf("test: %v had error: %v", test.description, err)
+			}
+		} else if !bytes.Equal(n.Bytes(), test.rawBytes) {
+			t.Errorf("%v, bytes not equal\n%x\n%x", test.description, n.Bytes(), test.rawBytes)
+		}
+	}
+}
+
+func TestNewTrusted(t *testing.T) {
+	t.Parallel()
+
+	var p Payload
+	copy(p[:], "trusted")
+	valid, _ := New(p[:])
+	if n := NewTrusted(valid.Hash(), p); !bytes.Equal(n.Bytes(), valid.Bytes()) {
+		t.Errorf("bytes not equal\n%x\n%x", n.Bytes(), valid.Bytes())
+	}
+	if err := NewTrusted(Hash{}, p).validate(); !errors.Is(err, ErrorInvalidHash) {
+		t.Errorf("expected a mismatched hash to fail validation, got: %v", err)
+	}
+}
+
+func TestFitPayload(t *testing.T) {
+	t.Parallel()
+
+	testTable := []struct {
+		data        []byte
+		truncated   bool
+		description string
+	}{
+		{
+			data:        nil,
+			truncated:   false,
+			description: "empty data",
+		},
+		{
+			data:        []byte("hello haystack"),
+			truncated:   false,
+			description: "short data is padded",
+		},
+		{
+			data:        bytes.Repeat([]byte{1}, PayloadLength),
+			truncated:   false,
+			description: "exact length",
+		},
+		{
+			data:        bytes.Repeat([]byte{1}, PayloadLength+1),
+			truncated:   true,
+			description: "long data is truncated",
+		},
+	}
+	for _, test := range testTable {
+		p, truncated := FitPayload(test.data)
+		if truncated != test.truncated {
+			t.Errorf("%v: expected truncated %v, got %v", test.description, test.truncated, truncated)
+		}
+		l := min(len(test.data), PayloadLength)
+		if !bytes.Equal(p[:l], test.data[:l]) {
+			t.Errorf("%v: payload prefix does not match data", test.description)
+		}
+		if !bytes.Equal(p[l:], make([]byte, PayloadLength-l)) {
+			t.Errorf("%v: payload is not zero padded", test.description)
+		}
+	}
+}
+
 func BenchmarkNew(b *testing.B) {
 	p, _ := hex.DecodeString("f1b462c84a0c51dad44293951f0b084a8871b3700ac1b9fc7a53a20bc0ba0fed40e4350b03d8b0c9e340321210b259d9a20b19632929b4a219254a4269c11f820c75168c6a91d309f4b134a7d715a5ac408991e1cf9415995053cf8a4e185dae22a06617ac51ebf7d232bc49e567f90be4db815c2b88ca0d9a4ef7a5119c0e592c88dfb96706e6510fb8a657c0f70f6695ea310d24786e6d980e9b33cf2665342b965b2391f6bb982c4c5f6058b9cba58038d32452e07cdee9420a8bd7f514e1")
 	for n := 0; n < b.N; n++ {
@@ -194,6 +291,13 @@ func BenchmarkFromBytes(b *testing.B) {
 	}
 }
 
+func BenchmarkFromBytesTrusted(b *testing.B) {
+	validRaw, _ := hex.DecodeString("e431c3b024c54b8a8f03a1da5f81678300b3bf5d13fd3fb4969a6bfb85cdf1ae40e4350b03d8b0c9e340321210b259d9a20b19632929b4a219254a4269c11f820c75168c6a91d309f4b134a7d715a5ac408991e1cf9415995053cf8a4e185dae22a06617ac51ebf7d232bc49e567f90be4db815c2b88ca0d9a4ef7a5119c0e592c88dfb96706e6510fb8a657c0f70f6695ea310d24786e6d980e9b33cf2665342b965b2391f6bb982c4c5f6058b9cba58038d32452e07cdee9420a8bd7f514e1")
+	for n := 0; n < b.N; n++ {
+		FromBytesTrusted(validRaw)
+	}
+}
+
 func BenchmarkFullFlow(b *testing.B) {
 	p, _ := hex.DecodeString("40e4350b03d8b0c9e340321210b259d9a20b19632929b4a219254a4269c11f820c75168c6a91d309f4b134a7d715a5ac408991e1cf9415995053cf8a4e185dae22a06617ac51ebf7d232bc49e567f90be4db815c2b88ca0d9a4ef7a5119c0e592c88dfb96706e6510fb8a657c0f70f6695ea310d24786e6d980e9b33cf2665342b965b2391f6bb982c4c5f6058b9cba58038d32452e07cdee9420a8bd7f514e1")
 	for n := 0; n < b.N; n++ {
@@ -203,3 +307,108 @@ func BenchmarkFullFlow(b *testing.B) {
 		n1.Payload()
 	}
 }
+
+func TestNewDeterministic(t *testing.T) {
+	t.Parallel()
+	a, b := NewDeterministic(1, 10), NewDeterministic(1, 10)
+	if len(a) != 10 {
+		t.Fatalf("expected 10 needles, got %v", len(a))
+	}
+	seen := make(map[Hash]bool)
+	for i := range a {
+		if a[i].Hash() != b[i].Hash() {
+			t.Errorf("needle %v: expected the same seed to produce the same needle", i)
+		}
+		if err := a[i].validate(); err != nil {
+			t.Errorf("needle %v: %v", i, err)
+		}
+		seen[a[i].Hash()] = true
+	}
+	if len(seen) != len(a) {
+		t.Errorf("expected %v distinct needles, got %v", len(a), len(seen))
+	}
+	if NewDeterministic(2, 1)[0].Hash() == a[0].Hash() {
+		t.Error("expected a different seed to produce different needles")
+	}
+}
+
+func TestNewTyped(t *testing.T) {
+	t.Parallel()
+	data := []byte(`{"hello":"world"}`)
+	n, err := NewTyped(7, data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n.Kind() != 7 {
+		t.Errorf("expected kind 7, got %v", n.Kind())
+	}
+	p := n.TypedPayload()
+	if len(p) != TypedDataLength || !bytes.Equal(p[:len(data)], data) || !bytes.Equal(p[len(data):], make([]byte, TypedDataLength-len(data))) {
+		t.Errorf("expected zero padded data, got %x", p)
+	}
+	if err := n.validate(); err != nil {
+		t.Error(err)
+	}
+	if _, err := NewTyped(1, make([]byte, TypedDataLength+1)); !errors.Is(err, ErrorByteSliceLength) {
+		t.Errorf("expected ErrorByteSliceLength, got: %v", err)
+	}
+}
+
+func TestNewCompressed(t *testing.T) {
+	t.Parallel()
+	hello := make([]byte, PayloadLength)
+	copy(hello, "Hello Haystack!")
+	var incompressible []byte
+	for i := byte(0); len(incompressible) < TypedDataLength; i++ {
+		sum := sha256.Sum256([]byte{i})
+		incompressible = append(incompressible, sum[:]...)
+	}
+	incompressible = incompressible[:TypedDataLength]
+	for _, test := range []struct {
+		description string
+		data        []byte
+		compressed  bool
+		err         error
+	}{
+		{description: "zero padded text", data: hello, compressed: true},
+		{description: "longer than a payload", data: bytes.Repeat([]byte("haystack "), 100), compressed: true},
+		{description: "empty", data: nil, compressed: true},
+		{description: "incompressible", data: incompressible, compressed: false},
+		{description: "incompressible and too long", data: append(incompressible, 1), err: ErrorByteSliceLength},
+	} {
+		t.Run(test.description, func(t *testing.T) {
+			t.Parallel()
+			n, compressed, err := NewCompressed(test.data)
+			if !errors.Is(err, test.err) {
+				t.Fatalf("expected %v, got: %v", test.err, err)
+			}
+			if err != nil {
+				return
+			}
+			if compressed != test.compressed {
+				t.Errorf("expected compressed to be %v", test.compressed)
+			}
+			if expected := map[bool]byte{true: KindCompressed, false: KindUncompressed}[compressed]; n.Kind() != expected {
+				t.Errorf("expected kind %v, got %v", expected, n.Kind())
+			}
+			if err := n.validate(); err != nil {
+				t.Error(err)
+			}
+			got, err := n.DecompressedPayload()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, test.data) {
+				t.Errorf("expected %x, got %x", test.data, got)
+			}
+		})
+	}
+
+	t.Run("unknown kind", func(t *testing.T) {
+		t.Parallel()
+		n, _ := NewTyped(7, []byte("data"))
+		if _, err := n.DecompressedPayload(); !errors.Is(err, ErrorUnknownCompression) {
+			t.Errorf("expected %v, got: %v", ErrorUnknownCompression, err)
+		}
+	})
+}
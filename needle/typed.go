@@ -0,0 +1,32 @@
+package needle
+
+// TypedDataLength is the number of bytes left for data in a typed needle, after the
+// first payload byte is taken by its kind.
+const TypedDataLength = PayloadLength - 1
+
+// NewTyped creates a Needle following the typed payload convention: the first payload
+// byte holds kind, an application defined tag such as JSON or an encrypted blob, and
+// data fills the remaining TypedDataLength bytes, zero padded. The convention is opt-in
+// and invisible to servers, which store typed needles like any other. Data longer than
+// TypedDataLength returns ErrorByteSliceLength.
+func NewTyped(kind byte, data []byte) (*Needle, error) {
+	if len(data) > TypedDataLength {
+		return nil, ErrorByteSliceLength
+	}
+	var p Payload
+	p[0] = kind
+	copy(p[1:], data)
+	return New(p[:])
+}
+
+// Kind returns the first payload byte, which holds the kind of a needle created with
+// NewTyped. It is meaningless for needles that do not follow the convention.
+func (n *Needle) Kind() byte {
+	return n.payload[0]
+}
+
+// TypedPayload returns a copy of the TypedDataLength bytes after the kind, including
+// any zero padding added by NewTyped.
+func (n *Needle) TypedPayload() []byte {
+	return append([]byte(nil), n.payload[1:]...)
+}
@@ -0,0 +1,68 @@
+package haystack
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/nomasters/haystack/needle"
+)
+
+const (
+	// pingRequest is the single byte datagram of a PING. The server answers it with
+	// pongPrefix followed by its clock as 8 byte big endian unix nanoseconds.
+	pingRequest = 0x00
+	pongPrefix  = "PONG"
+	pongLength  = len(pongPrefix) + 8
+)
+
+// isPing reports whether b is a PING as sent by ping, pingRequest padded with zeros.
+func isPing(b []byte) bool {
+	if l := len(b); l != 1 && (l == 0 || l%needle.NeedleLength != 0 || l/needle.NeedleLength > needle.MaxBatchCount) {
+		return false
+	}
+	for _, x := range b {
+		if x != pingRequest {
+			return false
+		}
+	}
+	return true
+}
+
+// ErrInvalidPong is returned by Ping when the server answers with something other than a PONG
+var ErrInvalidPong = errors.New("Invalid pong")
+
+// Ping sends a PING to the server and returns the round trip time. The server answers
+// without touching its storage, so Ping checks liveness and measures latency without
+// storing or requesting a needle. A server that predates PING drops the request as an
+// invalid length, so, as with a server that is down, Ping waits until ctx is done and
+// returns an error wrapping ErrTimeout. Callers should set a deadline on ctx.
+func (c *Client) Ping(ctx context.Context) (time.Duration, error) {
+	defer c.track()()
+	return c.ping(ctx, 1)
+}
+
+// ping sends a PING padded with zeros to size bytes, which must be 1 or a multiple of
+// needle.NeedleLength up to a full batch, and returns the round trip time.
+func (c *Client) ping(ctx context.Context, size int) (time.Duration, error) {
+	conn, err := c.dialContext(ctx, c.raddr)
+	if err != nil {
+		return 0, timeoutError(ctx, err)
+	}
+	defer conn.Close()
+	defer bind(ctx, conn)()
+	start := time.Now()
+	if err := write(conn, make([]byte, size)); err != nil {
+		return 0, err
+	}
+	resp := make([]byte, pongLength+1)
+	l, err := conn.Read(resp)
+	if err != nil {
+		return 0, timeoutError(ctx, err)
+	}
+	rtt := time.Since(start)
+	if l < len(pongPrefix) || string(resp[:len(pongPrefix)]) != pongPrefix {
+		return 0, ErrInvalidPong
+	}
+	return rtt, nil
+}
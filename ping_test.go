@@ -0,0 +1,44 @@
+package haystack
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestClientPing(t *testing.T) {
+	t.Parallel()
+	c := newLoopbackClient(t)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	rtt, err := c.Ping(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rtt <= 0 || rtt > time.Second {
+		t.Errorf("expected a positive round trip time, got %v", rtt)
+	}
+}
+
+// TestClientPingUnsupported pings a server that drops the request, as servers that
+// predate PING do.
+func TestClientPingUnsupported(t *testing.T) {
+	t.Parallel()
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	c, err := NewClient(conn.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, err := c.Ping(ctx); !errors.Is(err, ErrTimeout) {
+		t.Errorf("expected %v, got: %v", ErrTimeout, err)
+	}
+}
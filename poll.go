@@ -0,0 +1,47 @@
+package haystack
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/nomasters/haystack/needle"
+)
+
+const (
+	minPollInterval = 50 * time.Millisecond
+	maxPollInterval = time.Second
+)
+
+// Poll requests h repeatedly until the server returns it or ctx is done. Since SET is
+// fire-and-forget and misses are not answered, each attempt waits for a response for
+// an interval that doubles from 50ms up to one second. This makes a GET right after a
+// SET reliable when the SET may not have been stored yet. If ctx expires first, the
+// returned error wraps ErrTimeout. A nil hash returns needle.ErrorHashIsNil.
+func (c *Client) Poll(ctx context.Context, h *needle.Hash) (*needle.Needle, error) {
+	if h == nil {
+		return nil, needle.ErrorHashIsNil
+	}
+	interval := minPollInterval
+	for {
+		attempt, cancel := context.WithTimeout(ctx, interval)
+		n, err := c.get(attempt, h)
+		cancel()
+		if err == nil {
+			return n, nil
+		}
+		if ctx.Err() != nil {
+			return nil, timeoutError(ctx, ctx.Err())
+		}
+		if !errors.Is(err, ErrTimeout) {
+			// a failure other than a miss, such as a refused connection, is retried
+			// after the interval rather than immediately.
+			select {
+			case <-ctx.Done():
+				return nil, timeoutError(ctx, ctx.Err())
+			case <-time.After(interval):
+			}
+		}
+		interval = min(2*interval, maxPollInterval)
+	}
+}
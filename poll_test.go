@@ -0,0 +1,41 @@
+package haystack
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/nomasters/haystack/needle"
+)
+
+func TestClientPoll(t *testing.T) {
+	t.Parallel()
+
+	s := newFakeServer(t)
+	c, err := NewClient(s.addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	n, _ := needle.New(make([]byte, needle.PayloadLength))
+	hash := n.Hash()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 80*time.Millisecond)
+	defer cancel()
+	if _, err := c.Poll(ctx, &hash); !errors.Is(err, ErrTimeout) {
+		t.Errorf("expected ErrTimeout for a needle that never appears, got: %v", err)
+	}
+
+	time.AfterFunc(100*time.Millisecond, func() { s.set(n) })
+	ctx, cancel = context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	got, err := c.Poll(ctx, &hash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got.Bytes(), n.Bytes()) {
+		t.Error("unexpected needle returned")
+	}
+}
@@ -0,0 +1,84 @@
+package haystack
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/nomasters/haystack/needle"
+)
+
+// probeTimeout is how long Probe waits for each pong.
+const probeTimeout = time.Second
+
+// ProbeResult describes the path to a server as measured by Probe.
+type ProbeResult struct {
+	// Sent and Received count the PINGs sent and answered.
+	Sent     int
+	Received int
+	// Loss is the fraction of PINGs that were not answered.
+	Loss float64
+	// RTTMin, RTTAvg and RTTMax summarize the round trip times of answered PINGs.
+	RTTMin time.Duration
+	RTTAvg time.Duration
+	RTTMax time.Duration
+	// MaxDatagramBytes is the largest padded PING that was answered, a multiple of
+	// needle.NeedleLength, or zero if none was. It is a good value for WithMaxDatagramBytes.
+	MaxDatagramBytes int
+}
+
+// Probe measures round trip time, loss and the largest datagram that gets through to
+// the server, to help tune timeouts and WithMaxDatagramBytes for a network path. It
+// sends count PINGs, then PINGs padded to the length of 1 up to needle.MaxBatchCount
+// needles, waiting up to a second for each pong. The server stores nothing, and needs
+// no options beyond supporting PING. If no PING is answered, the error wraps
+// ErrTimeout. If ctx is cancelled, the context error is returned with the results so
+// far.
+func (c *Client) Probe(ctx context.Context, count int) (ProbeResult, error) {
+	defer c.track()()
+	var r ProbeResult
+	var total time.Duration
+	for i := 0; i < count; i++ {
+		r.Sent++
+		rtt, err := c.probe(ctx, 1)
+		if errors.Is(ctx.Err(), context.Canceled) {
+			return r, ctx.Err()
+		}
+		if err != nil {
+			continue
+		}
+		if r.Received == 0 || rtt < r.RTTMin {
+			r.RTTMin = rtt
+		}
+		r.RTTMax = max(r.RTTMax, rtt)
+		total += rtt
+		r.Received++
+	}
+	if r.Sent > 0 {
+		r.Loss = float64(r.Sent-r.Received) / float64(r.Sent)
+	}
+	if r.Received == 0 {
+		return r, fmt.Errorf("%w: no probe was answered", ErrTimeout)
+	}
+	r.RTTAvg = total / time.Duration(r.Received)
+
+	for k := 1; k <= needle.MaxBatchCount; k++ {
+		if _, err := c.probe(ctx, k*needle.NeedleLength); err != nil {
+			if errors.Is(ctx.Err(), context.Canceled) {
+				return r, ctx.Err()
+			}
+			break
+		}
+		r.MaxDatagramBytes = k * needle.NeedleLength
+	}
+	return r, nil
+}
+
+// probe sends a PING padded to size bytes and returns the round trip time, waiting at
+// most probeTimeout for the pong.
+func (c *Client) probe(ctx context.Context, size int) (time.Duration, error) {
+	ctx, cancel := context.WithTimeout(ctx, probeTimeout)
+	defer cancel()
+	return c.ping(ctx, size)
+}
@@ -0,0 +1,70 @@
+package haystack
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/nomasters/haystack/needle"
+	"github.com/nomasters/haystack/x/udp/server"
+)
+
+func TestClientProbe(t *testing.T) {
+	t.Parallel()
+	c := newLoopbackClient(t)
+	r, err := c.Probe(context.Background(), 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.Sent != 5 || r.Received != 5 || r.Loss != 0 {
+		t.Errorf("expected 5 of 5 probes with no loss, got %+v", r)
+	}
+	if r.RTTMin <= 0 || r.RTTMin > r.RTTAvg || r.RTTAvg > r.RTTMax {
+		t.Errorf("expected ordered round trip times, got %+v", r)
+	}
+	if r.MaxDatagramBytes != needle.MaxBatchCount*needle.NeedleLength {
+		t.Errorf("expected a full batch to get through, got %v bytes", r.MaxDatagramBytes)
+	}
+}
+
+func TestClientProbeStoresNothing(t *testing.T) {
+	t.Parallel()
+	m := server.NewMetrics(0)
+	l, err := server.NewLoopback(server.WithMetrics(m))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	c, err := NewClient("loopback", WithDialer(l.Dial))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	r, err := c.Probe(context.Background(), 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.Received != 2 || r.MaxDatagramBytes != needle.MaxBatchCount*needle.NeedleLength {
+		t.Errorf("expected a server without acknowledgements to answer every probe, got %+v", r)
+	}
+	if snap := m.Snapshot(); snap.Sets != 0 || snap.Gets != 0 || snap.InvalidRequests != 0 {
+		t.Errorf("expected probes to touch no storage, got %+v", snap)
+	}
+}
+
+// TestClientProbeUnsupported probes a server that drops PINGs, as servers that predate
+// PING do.
+func TestClientProbeUnsupported(t *testing.T) {
+	t.Parallel()
+	c, err := NewClient(listen(t).LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, err := c.Probe(ctx, 1); !errors.Is(err, ErrTimeout) {
+		t.Errorf("expected a timeout, got: %v", err)
+	}
+}
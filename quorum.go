@@ -0,0 +1,71 @@
+package haystack
+
+import (
+	"context"
+	"errors"
+
+	"github.com/nomasters/haystack/needle"
+)
+
+// WithReplicas adds the addresses of servers that may also hold needles. They are
+// queried alongside the primary address by GetQuorum.
+func WithReplicas(addresses ...string) option {
+	return func(o *options) {
+		o.replicas = append(o.replicas, addresses...)
+	}
+}
+
+// GetQuorum requests h from the primary server and up to n-1 replicas in parallel and
+// returns the first response that is a valid needle for h. Because needles are content
+// addressed, any single verified copy is correct, so misses and invalid responses from
+// other servers are ignored. The remaining requests are cancelled once one succeeds.
+// If every server fails, the errors are joined. A nil hash returns needle.ErrorHashIsNil.
+func (c *Client) GetQuorum(ctx context.Context, h *needle.Hash, n int) (*needle.Needle, error) {
+	if h == nil {
+		return nil, needle.ErrorHashIsNil
+	}
+	defer c.track()()
+	call := &Call{Op: OpGet, Hash: *h}
+	err := c.intercept(ctx, call, func(ctx context.Context, call *Call) error {
+		found, err := c.getQuorum(ctx, h, n)
+		call.Needle = found
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return call.Needle, nil
+}
+
+func (c *Client) getQuorum(ctx context.Context, h *needle.Hash, n int) (*needle.Needle, error) {
+	endpoints := append([]string{c.raddr}, c.replicas...)
+	if n < 1 {
+		n = 1
+	}
+	endpoints = endpoints[:min(n, len(endpoints))]
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	type result struct {
+		n   *needle.Needle
+		err error
+	}
+	results := make(chan result, len(endpoints))
+	for _, address := range endpoints {
+		go func() {
+			n, err := c.getFrom(ctx, address, h)
+			results <- result{n: n, err: err}
+		}()
+	}
+
+	var errs []error
+	for range endpoints {
+		r := <-results
+		if r.err == nil {
+			return r.n, nil
+		}
+		errs = append(errs, r.err)
+	}
+	return nil, errors.Join(errs...)
+}
@@ -0,0 +1,43 @@
+package haystack
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/nomasters/haystack/needle"
+)
+
+func TestClientGetQuorum(t *testing.T) {
+	t.Parallel()
+
+	primary, replica, empty := newFakeServer(t), newFakeServer(t), newFakeServer(t)
+	n, _ := needle.New(make([]byte, needle.PayloadLength))
+	hash := n.Hash()
+	replica.set(n)
+
+	c, err := NewClient(primary.addr(), WithReplicas(empty.addr(), replica.addr()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	got, err := c.GetQuorum(ctx, &hash, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got.Bytes(), n.Bytes()) {
+		t.Error("unexpected needle returned")
+	}
+
+	// only the primary and the empty replica are queried
+	ctx, cancel = context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	if _, err := c.GetQuorum(ctx, &hash, 2); !errors.Is(err, ErrTimeout) {
+		t.Errorf("expected ErrTimeout when no queried server holds the needle, got: %v", err)
+	}
+}
@@ -0,0 +1,55 @@
+package haystack
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+// WithRetry makes GETs that time out waiting for a response retry up to maxRetries
+// times, waiting baseBackoff before the first retry and doubling it before each one
+// after. Each attempt gets an equal share of the time left before the deadline of ctx,
+// so a single lost datagram does not use up the whole budget. Without a deadline on
+// ctx an attempt waits indefinitely and is never retried. If every attempt fails, the
+// error from the first attempt is returned. SETs are fire-and-forget and never retried.
+func WithRetry(maxRetries int, baseBackoff time.Duration) option {
+	return func(o *options) {
+		o.retries = maxRetries
+		o.backoff = baseBackoff
+	}
+}
+
+// retry runs attempt until it succeeds, fails with an error other than ErrTimeout, or
+// the retries set by WithRetry are used up.
+func (c *Client) retry(ctx context.Context, attempt func(ctx context.Context) error) error {
+	if c.retries <= 0 {
+		return attempt(ctx)
+	}
+	var first error
+	backoff := c.backoff
+	for i := 0; ; i++ {
+		actx, cancel := ctx, context.CancelFunc(func() {})
+		if deadline, ok := ctx.Deadline(); ok {
+			actx, cancel = context.WithTimeout(ctx, time.Until(deadline)/time.Duration(c.retries-i+1))
+		}
+		err := attempt(actx)
+		cancel()
+		if err == nil {
+			return nil
+		}
+		if first == nil {
+			first = err
+		}
+		if i == c.retries || !errors.Is(err, ErrTimeout) || ctx.Err() != nil {
+			return first
+		}
+		timer := time.NewTimer(backoff)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return first
+		case <-timer.C:
+		}
+		backoff *= 2
+	}
+}
@@ -0,0 +1,86 @@
+package haystack
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/nomasters/haystack/needle"
+	"github.com/nomasters/haystack/x/udp/server"
+)
+
+// dropConn is a net.Conn that discards the first response it reads, as if the
+// datagram had been lost, so the caller waits until its deadline.
+type dropConn struct {
+	net.Conn
+}
+
+func (d dropConn) Read(b []byte) (int, error) {
+	if _, err := d.Conn.Read(b); err != nil {
+		return 0, err
+	}
+	return d.Conn.Read(b)
+}
+
+func TestClientRetry(t *testing.T) {
+	t.Parallel()
+	for _, test := range []struct {
+		description string
+		drops       int64
+		retries     int
+		err         error
+	}{
+		{description: "succeeds on the attempt after the drops", drops: 2, retries: 2},
+		{description: "returns the first error once retries run out", drops: 3, retries: 2, err: ErrTimeout},
+		{description: "does not retry by default", drops: 1, err: ErrTimeout},
+	} {
+		t.Run(test.description, func(t *testing.T) {
+			t.Parallel()
+			l, err := server.NewLoopback(server.WithAckSet())
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer l.Close()
+			var dials, gets atomic.Int64
+			dial := func(ctx context.Context, network, address string) (net.Conn, error) {
+				dials.Add(1)
+				conn, err := l.Dial(ctx, network, address)
+				if err != nil || dials.Load() == 1 {
+					// the first dial is the client's own socket
+					return conn, err
+				}
+				if gets.Add(1) <= test.drops {
+					return dropConn{conn}, nil
+				}
+				return conn, nil
+			}
+			c, err := NewClient("loopback", WithDialer(dial), WithRetry(test.retries, time.Millisecond))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer c.Close()
+			// each dropped attempt waits out its share of the budget, which must leave
+			// the last attempt enough time on a loaded machine
+			ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+			defer cancel()
+
+			n := needle.NewDeterministic(5, 1)[0]
+			setConn, _ := l.Dial(ctx, "", "")
+			setConn.Write(n.Bytes())
+			setConn.Read(make([]byte, needle.HashLength))
+			setConn.Close()
+
+			h := n.Hash()
+			_, err = c.GetContext(ctx, &h)
+			if !errors.Is(err, test.err) || (test.err == nil) != (err == nil) {
+				t.Errorf("expected %v, got: %v", test.err, err)
+			}
+			if attempts, expected := gets.Load(), min(test.drops+1, int64(test.retries+1)); attempts != expected {
+				t.Errorf("expected %v attempts, got %v", expected, attempts)
+			}
+		})
+	}
+}
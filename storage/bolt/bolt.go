@@ -0,0 +1,174 @@
+// Package bolt is a storage backend that keeps needles in a single bbolt database
+// file. Unlike the journal and memory stores it has no fixed capacity, so needles are
+// only limited by disk space. Every Set is committed and synced to disk before it
+// returns, trading write throughput for durability.
+package bolt
+
+import (
+	"context"
+	"encoding/binary"
+	"sync"
+	"time"
+
+	"github.com/nomasters/haystack/needle"
+	"github.com/nomasters/haystack/storage"
+	bolt "go.etcd.io/bbolt"
+)
+
+const (
+	// RecordLength is the size of a stored value: an 8 byte big endian expiration in
+	// unix nanoseconds followed by the needle bytes.
+	RecordLength = expirationLength + needle.NeedleLength
+
+	expirationLength = 8
+	// openTimeout bounds how long New waits for another process to release the file.
+	openTimeout = time.Second
+)
+
+// ErrorDNE is returned when a needle does not exist or has expired. It is the same value
+// as storage.ErrorNotFound so callers can check either.
+var ErrorDNE = storage.ErrorNotFound
+
+var bucketName = []byte("needles")
+
+// Store is a struct that holds the bolt storage state
+type Store struct {
+	db              *bolt.DB
+	ttl             time.Duration
+	cleanupInterval time.Duration
+	now             func() time.Time
+	ctx             context.Context
+	cancel          context.CancelFunc
+	wg              sync.WaitGroup
+}
+
+// Option configures optional Store settings
+type Option func(*Store)
+
+// WithClock replaces time.Now as the source of the current time for expirations.
+// Tests can pass a fake clock to expire needles without sleeping.
+func WithClock(now func() time.Time) Option {
+	return func(s *Store) {
+		s.now = now
+	}
+}
+
+// New opens or creates the database file at path and returns a pointer to a Store.
+// Needles live for ttl after they are Set. Expired needles are never returned and
+// are deleted from the file every cleanupInterval, or only by Sweep if the interval
+// is zero or less. New fails if another process holds the file open.
+func New(ctx context.Context, path string, ttl, cleanupInterval time.Duration, opts ...Option) (*Store, error) {
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: openTimeout})
+	if err != nil {
+		return nil, err
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(bucketName)
+		return err
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	sctx, cancel := context.WithCancel(ctx)
+	s := &Store{
+		db:              db,
+		ttl:             ttl,
+		cleanupInterval: cleanupInterval,
+		now:             time.Now,
+		ctx:             sctx,
+		cancel:          cancel,
+	}
+	for _, opt := range opts {
+		opt(s)
+	}
+	if s.cleanupInterval > 0 {
+		s.wg.Add(1)
+		go s.run()
+	}
+	return s, nil
+}
+
+// Set takes a needle and writes it to the database.
+func (s *Store) Set(n *needle.Needle) error {
+	if n == nil {
+		return storage.ErrorNeedleIsNil
+	}
+	hash := n.Hash()
+	record := make([]byte, RecordLength)
+	binary.BigEndian.PutUint64(record, uint64(s.now().Add(s.ttl).UnixNano()))
+	copy(record[expirationLength:], n.Bytes())
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(bucketName).Put(hash[:], record)
+	})
+}
+
+// Get takes a hash and returns a pointer to a needle and an error
+func (s *Store) Get(hash needle.Hash) (*needle.Needle, error) {
+	b := make([]byte, needle.NeedleLength)
+	err := s.db.View(func(tx *bolt.Tx) error {
+		record := tx.Bucket(bucketName).Get(hash[:])
+		if s.expired(record) {
+			return ErrorDNE
+		}
+		// record is only valid for the life of the transaction
+		copy(b, record[expirationLength:])
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return needle.FromBytes(b)
+}
+
+// Sweep deletes expired needles from the database.
+func (s *Store) Sweep() error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(bucketName)
+		// deleting while iterating with a cursor skips keys, so collect them first
+		var expired [][]byte
+		b.ForEach(func(k, v []byte) error {
+			if s.expired(v) {
+				expired = append(expired, append([]byte(nil), k...))
+			}
+			return nil
+		})
+		for _, k := range expired {
+			if err := b.Delete(k); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// Close stops the background sweep and closes the database.
+func (s *Store) Close() error {
+	s.cancel()
+	s.wg.Wait()
+	return s.db.Close()
+}
+
+func (s *Store) run() {
+	defer s.wg.Done()
+	ticker := time.NewTicker(s.cleanupInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.ctx.Done():
+			return
+		case <-ticker.C:
+			s.Sweep()
+		}
+	}
+}
+
+// expired reports whether the needle stored in record has expired. A missing or
+// malformed record counts as expired.
+func (s *Store) expired(record []byte) bool {
+	if len(record) != RecordLength {
+		return true
+	}
+	expiration := int64(binary.BigEndian.Uint64(record))
+	return s.now().UnixNano() >= expiration
+}
@@ -0,0 +1,175 @@
+package bolt
+
+import (
+	"context"
+	"crypto/rand"
+	"errors"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/nomasters/haystack/needle"
+	"github.com/nomasters/haystack/storage"
+	bolt "go.etcd.io/bbolt"
+)
+
+// randomNeedle returns a needle with a random payload.
+func randomNeedle(t testing.TB) *needle.Needle {
+	t.Helper()
+	p := make([]byte, needle.PayloadLength)
+	rand.Read(p)
+	n, err := needle.New(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return n
+}
+
+// clock is a fake time source that only moves when advanced.
+type clock struct {
+	nanos atomic.Int64
+}
+
+func newClock() *clock {
+	c := new(clock)
+	c.nanos.Store(time.Now().UnixNano())
+	return c
+}
+
+func (c *clock) Now() time.Time {
+	return time.Unix(0, c.nanos.Load())
+}
+
+func (c *clock) Advance(d time.Duration) {
+	c.nanos.Add(int64(d))
+}
+
+func TestStore(t *testing.T) {
+	t.Parallel()
+	s, err := New(context.Background(), filepath.Join(t.TempDir(), "haystack.db"), time.Minute, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	n := randomNeedle(t)
+	if err := s.Set(n); err != nil {
+		t.Fatal(err)
+	}
+	got, err := s.Get(n.Hash())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Hash() != n.Hash() || got.Payload() != n.Payload() {
+		t.Error("expected the needle that was set")
+	}
+	if _, err := s.Get(randomNeedle(t).Hash()); !errors.Is(err, storage.ErrorNotFound) {
+		t.Errorf("expected %v, got: %v", storage.ErrorNotFound, err)
+	}
+	if err := s.Set(nil); err != storage.ErrorNeedleIsNil {
+		t.Errorf("expected %v, got: %v", storage.ErrorNeedleIsNil, err)
+	}
+}
+
+func TestStorePersistence(t *testing.T) {
+	t.Parallel()
+	path := filepath.Join(t.TempDir(), "haystack.db")
+	s, err := New(context.Background(), path, time.Minute, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	needles := []*needle.Needle{randomNeedle(t), randomNeedle(t), randomNeedle(t)}
+	for _, n := range needles {
+		if err := s.Set(n); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	s, err = New(context.Background(), path, time.Minute, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	for _, n := range needles {
+		got, err := s.Get(n.Hash())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got.Payload() != n.Payload() {
+			t.Error("expected the needle to survive reopening")
+		}
+	}
+}
+
+func TestStoreExpiration(t *testing.T) {
+	t.Parallel()
+	c := newClock()
+	s, err := New(context.Background(), filepath.Join(t.TempDir(), "haystack.db"), time.Minute, 0, WithClock(c.Now))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	old, fresh := randomNeedle(t), randomNeedle(t)
+	if err := s.Set(old); err != nil {
+		t.Fatal(err)
+	}
+	c.Advance(30 * time.Second)
+	if err := s.Set(fresh); err != nil {
+		t.Fatal(err)
+	}
+	c.Advance(30 * time.Second)
+	if _, err := s.Get(old.Hash()); err != ErrorDNE {
+		t.Errorf("expected %v, got: %v", ErrorDNE, err)
+	}
+	if _, err := s.Get(fresh.Hash()); err != nil {
+		t.Errorf("expected the fresh needle, got: %v", err)
+	}
+
+	if err := s.Sweep(); err != nil {
+		t.Fatal(err)
+	}
+	if count := s.count(t); count != 1 {
+		t.Errorf("expected 1 needle after the sweep, got %v", count)
+	}
+}
+
+func TestStoreCleanup(t *testing.T) {
+	t.Parallel()
+	c := newClock()
+	s, err := New(context.Background(), filepath.Join(t.TempDir(), "haystack.db"), time.Minute, time.Millisecond, WithClock(c.Now))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	if err := s.Set(randomNeedle(t)); err != nil {
+		t.Fatal(err)
+	}
+	c.Advance(time.Minute)
+	deadline := time.Now().Add(time.Second)
+	for s.count(t) > 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("expected the background sweep to delete the expired needle")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// count returns the number of records in the database, including expired ones.
+func (s *Store) count(t *testing.T) int {
+	t.Helper()
+	var count int
+	err := s.db.View(func(tx *bolt.Tx) error {
+		count = tx.Bucket(bucketName).Stats().KeyN
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return count
+}
@@ -0,0 +1,103 @@
+package journal
+
+import (
+	"encoding/binary"
+	"maps"
+	"slices"
+	"time"
+
+	"github.com/nomasters/haystack/needle"
+)
+
+const defaultAuditBatch = 100
+
+// WithAudit starts a background audit that checks up to batch indexed records every
+// interval, reading each back from the log to confirm that it holds the indexed needle
+// with a payload matching its hash. Each pass walks a snapshot of the index taken when
+// the previous pass finished, so every record that stays indexed for a whole pass is
+// checked once per pass. The audit holds a read lock only while checking a batch, so
+// Gets are never blocked. Failures are counted by AuditFailures and the hashes of the
+// failed records are returned by AuditFailedHashes. The audit is disabled by default.
+// A batch of zero or less uses a batch of 100.
+func WithAudit(interval time.Duration, batch int) Option {
+	return func(s *Store) {
+		s.auditInterval = interval
+		s.auditBatch = batch
+		if s.auditBatch <= 0 {
+			s.auditBatch = defaultAuditBatch
+		}
+	}
+}
+
+// AuditFailures returns the number of records the background audit has found that do
+// not match the index, which indicates corruption of the log. A record that stays
+// corrupt is counted again on every pass.
+func (s *Store) AuditFailures() uint64 {
+	return s.auditFailures.Load()
+}
+
+// AuditFailedHashes returns the hashes of the records the background audit has found
+// that do not match the index, each once, in the order they were found.
+func (s *Store) AuditFailedHashes() []needle.Hash {
+	s.auditMu.Lock()
+	defer s.auditMu.Unlock()
+	return append([]needle.Hash(nil), s.auditFailed...)
+}
+
+func (s *Store) runAudit() {
+	defer s.wg.Done()
+	ticker := time.NewTicker(s.auditInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.ctx.Done():
+			return
+		case <-ticker.C:
+			s.auditFailures.Add(uint64(len(s.audit(s.auditBatch))))
+		}
+	}
+}
+
+// audit checks the next batch records of the current pass, starting a new pass if the
+// last one is done, and returns the hashes of the records that failed.
+func (s *Store) audit(batch int) []needle.Hash {
+	s.auditMu.Lock()
+	defer s.auditMu.Unlock()
+	s.RLock()
+	defer s.RUnlock()
+	if len(s.auditQueue) == 0 {
+		s.auditQueue = slices.Collect(maps.Keys(s.index))
+	}
+	record := make([]byte, RecordLength)
+	var failed []needle.Hash
+	for checked := 0; checked < batch && len(s.auditQueue) > 0; {
+		hash := s.auditQueue[0]
+		s.auditQueue = s.auditQueue[1:]
+		e, ok := s.index[hash]
+		if !ok {
+			// expired or replaced since the pass started
+			continue
+		}
+		checked++
+		if !s.auditRecord(record, hash, e) {
+			failed = append(failed, hash)
+			if !slices.Contains(s.auditFailed, hash) {
+				s.auditFailed = append(s.auditFailed, hash)
+			}
+		}
+	}
+	return failed
+}
+
+// auditRecord reads the record for hash at e into record and reports whether it
+// matches the index.
+func (s *Store) auditRecord(record []byte, hash needle.Hash, e entry) bool {
+	if _, err := s.file.ReadAt(record, e.offset); err != nil {
+		return false
+	}
+	if int64(binary.BigEndian.Uint64(record)) != e.expiration.UnixNano() {
+		return false
+	}
+	n, err := needle.FromBytes(record[expirationLength:])
+	return err == nil && n.Hash() == hash
+}
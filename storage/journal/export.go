@@ -0,0 +1,74 @@
+package journal
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"time"
+
+	"github.com/nomasters/haystack/needle"
+)
+
+// Export writes every needle that has not expired to w as a stream of records in the
+// same format as the log: an 8 byte big endian expiration in unix nanoseconds followed
+// by the needle bytes, RecordLength bytes in all. Since every record is the same
+// length the stream needs no framing. It holds a read lock while writing, so Sets wait
+// until the export is done.
+func (s *Store) Export(w io.Writer) error {
+	bw := bufio.NewWriter(w)
+	record := make([]byte, RecordLength)
+	var werr error
+	err := s.ForEachNeedle(func(n *needle.Needle, expiresAt time.Time) bool {
+		binary.BigEndian.PutUint64(record, uint64(expiresAt.UnixNano()))
+		copy(record[expirationLength:], n.Bytes())
+		_, werr = bw.Write(record)
+		return werr == nil
+	})
+	if err := errors.Join(err, werr); err != nil {
+		return err
+	}
+	return bw.Flush()
+}
+
+// Import reads a stream written by Export into the journal in dir, creating it if
+// needed, and closes it. Needles keep the expiration they were exported with and
+// those that have expired since are skipped, so ttl only applies to needles Set
+// after the store is next opened. The store can hold a different maxItems than the
+// one exported from. Import stops with ctx.Err() if ctx is done, with ErrorStoreFull
+// if the needles do not fit, and with io.ErrUnexpectedEOF if the stream ends part
+// way through a record. Needles imported before an error are kept.
+func Import(ctx context.Context, r io.Reader, dir string, ttl time.Duration, maxItems int, opts ...Option) error {
+	s, err := New(ctx, dir, ttl, maxItems, append(opts, WithCheckpointInterval(0))...)
+	if err != nil {
+		return err
+	}
+	return errors.Join(s.importRecords(ctx, bufio.NewReader(r)), s.Close())
+}
+
+func (s *Store) importRecords(ctx context.Context, r io.Reader) error {
+	record := make([]byte, RecordLength)
+	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if _, err := io.ReadFull(r, record); err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+		expiration := time.Unix(0, int64(binary.BigEndian.Uint64(record)))
+		if !s.now().Before(expiration) {
+			continue
+		}
+		n, err := needle.FromBytes(record[expirationLength:])
+		if err != nil {
+			return err
+		}
+		if err := s.set(n, expiration); err != nil {
+			return err
+		}
+	}
+}
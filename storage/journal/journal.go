@@ -0,0 +1,514 @@
+// Package journal is a log-structured storage backend. Needles are appended to a data
+// log and located through an in-memory index that is checkpointed to disk periodically.
+// On startup the index is loaded from the last checkpoint and the tail of the log
+// written after it is replayed, so writes never shift existing data.
+package journal
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"maps"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/nomasters/haystack/needle"
+	"github.com/nomasters/haystack/storage"
+)
+
+const (
+	// RecordLength is the size of a record in the data log: an 8 byte big endian
+	// expiration in unix nanoseconds followed by the needle bytes.
+	RecordLength = expirationLength + needle.NeedleLength
+
+	expirationLength = 8
+	// an index entry is a hash, an 8 byte log offset and an 8 byte expiration.
+	entryLength = needle.HashLength + 8 + expirationLength
+	// a checkpoint header is the log offset it covers and the number of entries.
+	checkpointHeaderLength = 16
+
+	logFileName        = "haystack.log"
+	checkpointFileName = "haystack.idx"
+
+	defaultCheckpointInterval = time.Minute
+)
+
+var (
+	// ErrorStoreFull is returned when the store holds maxItems active needles. It is the
+	// same value as storage.ErrorFull so callers can check either.
+	ErrorStoreFull = storage.ErrorFull
+	// ErrorDNE is returned when a needle does not exist or has expired. It is the same
+	// value as storage.ErrorNotFound so callers can check either.
+	ErrorDNE = storage.ErrorNotFound
+	// ErrorInvalidCheckpoint is returned when the checkpoint file cannot be decoded
+	ErrorInvalidCheckpoint = errors.New("Invalid checkpoint")
+	// ErrorCompactionInProgress is returned by Compact when another compaction is running
+	ErrorCompactionInProgress = errors.New("Compaction in progress")
+	// ErrorInvalidCapacity is returned by New when neither maxItems nor WithMaxBytes
+	// allow at least one needle
+	ErrorInvalidCapacity = errors.New("Invalid capacity")
+)
+
+type entry struct {
+	offset     int64
+	expiration time.Time
+}
+
+// Store is a struct that holds the journal storage state
+type Store struct {
+	sync.RWMutex
+	dir                string
+	file               *os.File
+	size               int64
+	index              map[needle.Hash]entry
+	ttl                time.Duration
+	maxItems           int
+	maxBytes           int64
+	checkpointInterval time.Duration
+	now                func() time.Time
+	compacting         atomic.Bool
+	ctx                context.Context
+	cancel             context.CancelFunc
+	auditInterval      time.Duration
+	auditBatch         int
+	auditFailures      atomic.Uint64
+	wg                 sync.WaitGroup
+
+	// auditMu guards the audit pass, auditQueue holding the hashes it has yet to
+	// check, and auditFailed.
+	auditMu     sync.Mutex
+	auditQueue  []needle.Hash
+	auditFailed []needle.Hash
+}
+
+// Option configures optional Store settings
+type Option func(*Store)
+
+// WithCheckpointInterval sets how often the index is checkpointed and expired needles
+// are dropped from it. The default is one minute. An interval of zero or less disables
+// the background goroutine, which suits short-lived stores such as imports and tests.
+// The index is then only checkpointed on Close and the log is only compacted by
+// calling Compact.
+func WithCheckpointInterval(d time.Duration) Option {
+	return func(s *Store) {
+		s.checkpointInterval = d
+	}
+}
+
+// WithClock replaces time.Now as the source of the current time for expirations.
+// Tests can pass a fake clock to expire needles without sleeping.
+func WithClock(now func() time.Time) Option {
+	return func(s *Store) {
+		s.now = now
+	}
+}
+
+// WithMaxBytes caps the store at the number of needles whose records fit in n bytes,
+// or at maxItems if that is lower. A maxItems of zero or less is ignored when n is set,
+// so the store can be sized by bytes alone. The log can grow past n with records
+// that are overwritten or expired until the next compaction reclaims them.
+func WithMaxBytes(n int64) Option {
+	return func(s *Store) {
+		s.maxBytes = n
+	}
+}
+
+// New opens or creates a journal in dir and returns a pointer to a Store. Needles live
+// for ttl after they are Set and at most maxItems needles are held at once. New returns
+// ErrorInvalidCapacity unless maxItems or WithMaxBytes allows at least one needle.
+func New(ctx context.Context, dir string, ttl time.Duration, maxItems int, opts ...Option) (*Store, error) {
+	sctx, cancel := context.WithCancel(ctx)
+	s := &Store{
+		dir:                dir,
+		index:              make(map[needle.Hash]entry),
+		ttl:                ttl,
+		maxItems:           maxItems,
+		checkpointInterval: defaultCheckpointInterval,
+		now:                time.Now,
+		ctx:                sctx,
+		cancel:             cancel,
+	}
+	for _, opt := range opts {
+		opt(s)
+	}
+	if s.maxBytes > 0 {
+		if items := int(s.maxBytes / RecordLength); s.maxItems <= 0 || items < s.maxItems {
+			s.maxItems = items
+		}
+	}
+	if s.maxItems <= 0 {
+		cancel()
+		return nil, ErrorInvalidCapacity
+	}
+
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		cancel()
+		return nil, err
+	}
+	file, err := os.OpenFile(filepath.Join(dir, logFileName), os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	s.file = file
+	if err := s.recover(); err != nil {
+		cancel()
+		file.Close()
+		return nil, err
+	}
+	if s.checkpointInterval > 0 {
+		s.wg.Add(1)
+		go s.run()
+	}
+	if s.auditInterval > 0 {
+		s.wg.Add(1)
+		go s.runAudit()
+	}
+	return s, nil
+}
+
+// Set takes a needle and appends it to the log.
+func (s *Store) Set(n *needle.Needle) error {
+	if n == nil {
+		return storage.ErrorNeedleIsNil
+	}
+	return s.set(n, s.now().Add(s.ttl))
+}
+
+// set appends n to the log with expiration.
+func (s *Store) set(n *needle.Needle, expiration time.Time) error {
+	hash := n.Hash()
+	s.Lock()
+	defer s.Unlock()
+	if _, ok := s.index[hash]; !ok && len(s.index) >= s.maxItems {
+		s.expire(s.now())
+		if len(s.index) >= s.maxItems {
+			return ErrorStoreFull
+		}
+	}
+	record := make([]byte, RecordLength)
+	binary.BigEndian.PutUint64(record, uint64(expiration.UnixNano()))
+	copy(record[expirationLength:], n.Bytes())
+	if _, err := s.file.WriteAt(record, s.size); err != nil {
+		return err
+	}
+	s.index[hash] = entry{offset: s.size, expiration: expiration}
+	s.size += RecordLength
+	return nil
+}
+
+// Get takes a hash and returns a pointer to a needle and an error
+func (s *Store) Get(hash needle.Hash) (*needle.Needle, error) {
+	s.RLock()
+	defer s.RUnlock()
+	e, ok := s.index[hash]
+	if !ok || !s.now().Before(e.expiration) {
+		return nil, ErrorDNE
+	}
+	b := make([]byte, needle.NeedleLength)
+	if _, err := s.file.ReadAt(b, e.offset+expirationLength); err != nil {
+		return nil, err
+	}
+	return needle.FromBytes(b)
+}
+
+// ForEachNeedle calls fn with every needle that has not expired and its expiration,
+// in no particular order, stopping early if fn returns false. It holds a read lock for
+// the length of the iteration, so fn must not Set on the store. An error reading or
+// validating a record from the log stops the iteration and is returned.
+func (s *Store) ForEachNeedle(fn func(n *needle.Needle, expiresAt time.Time) bool) error {
+	s.RLock()
+	defer s.RUnlock()
+	now := s.now()
+	b := make([]byte, needle.NeedleLength)
+	for _, e := range s.index {
+		if !now.Before(e.expiration) {
+			continue
+		}
+		if _, err := s.file.ReadAt(b, e.offset+expirationLength); err != nil {
+			return err
+		}
+		n, err := needle.FromBytes(b)
+		if err != nil {
+			return err
+		}
+		if !fn(n, e.expiration) {
+			return nil
+		}
+	}
+	return nil
+}
+
+// Remaining returns the number of needles that can be Set before the store is full.
+// Expired needles count against capacity until the next checkpoint drops them.
+func (s *Store) Remaining() (uint64, bool) {
+	s.RLock()
+	defer s.RUnlock()
+	return uint64(max(s.maxItems-len(s.index), 0)), true
+}
+
+// Compact rewrites the log with only the needles that have not expired and writes a
+// checkpoint. Only one compaction runs at a time, so Compact returns
+// ErrorCompactionInProgress if the store is already compacting. Gets and Sets continue
+// against the existing log while it is copied, and are only blocked briefly while
+// needles Set during the copy are carried over and the new log is swapped in. If ctx
+// is done or the store is closed part way through, the partial log is discarded and
+// the existing log is kept.
+func (s *Store) Compact(ctx context.Context) error {
+	if !s.compacting.CompareAndSwap(false, true) {
+		return ErrorCompactionInProgress
+	}
+	defer s.compacting.Store(false)
+	return s.compact(ctx)
+}
+
+// Close stops the background checkpointing, aborting a compaction in progress, writes
+// a final checkpoint and closes the log.
+func (s *Store) Close() error {
+	s.cancel()
+	s.wg.Wait()
+	s.Lock()
+	defer s.Unlock()
+	if err := s.checkpoint(); err != nil {
+		s.file.Close()
+		return err
+	}
+	return s.file.Close()
+}
+
+func (s *Store) run() {
+	defer s.wg.Done()
+	ticker := time.NewTicker(s.checkpointInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.ctx.Done():
+			return
+		case <-ticker.C:
+			s.Lock()
+			s.checkpoint()
+			sparse := s.sparse()
+			s.Unlock()
+			if sparse && s.compacting.CompareAndSwap(false, true) {
+				s.compact(s.ctx)
+				s.compacting.Store(false)
+			}
+		}
+	}
+}
+
+// sparse reports whether most of the log is garbage. It must be called while holding
+// the lock.
+func (s *Store) sparse() bool {
+	live := int64(len(s.index)) * RecordLength
+	return s.size > 2*live+RecordLength
+}
+
+// checkpoint drops expired entries from the index and writes it to the checkpoint
+// file. It must be called while holding the lock.
+func (s *Store) checkpoint() error {
+	s.expire(s.now())
+	if err := s.file.Sync(); err != nil {
+		return err
+	}
+
+	b := make([]byte, checkpointHeaderLength, checkpointHeaderLength+len(s.index)*entryLength)
+	binary.BigEndian.PutUint64(b, uint64(s.size))
+	binary.BigEndian.PutUint64(b[8:], uint64(len(s.index)))
+	for hash, e := range s.index {
+		b = append(b, hash[:]...)
+		b = binary.BigEndian.AppendUint64(b, uint64(e.offset))
+		b = binary.BigEndian.AppendUint64(b, uint64(e.expiration.UnixNano()))
+	}
+	return writeFile(filepath.Join(s.dir, checkpointFileName), b)
+}
+
+// expire drops entries that have expired by now from the index. It must be called
+// while holding the lock.
+func (s *Store) expire(now time.Time) {
+	for hash, e := range s.index {
+		if !now.Before(e.expiration) {
+			delete(s.index, hash)
+		}
+	}
+}
+
+// compact rewrites the log with only the records referenced by the index, stopping
+// early if ctx or the store is done, and writes a checkpoint. The caller must have set
+// s.compacting. The records are copied from a snapshot of the index without holding
+// the lock, which is safe since the log is append only and only compact replaces it.
+// The lock is then held to copy the records appended since the snapshot and swap in
+// the new log.
+func (s *Store) compact(ctx context.Context) error {
+	s.Lock()
+	s.expire(s.now())
+	snapshot := maps.Clone(s.index)
+	snapshotSize, file := s.size, s.file
+	s.Unlock()
+
+	path := filepath.Join(s.dir, logFileName)
+	tmp, err := os.OpenFile(path+".compact", os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	abort := func(err error) error {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	// moved maps the offset of each copied record in the old log to the new log
+	moved := make(map[int64]int64, len(snapshot))
+	record := make([]byte, RecordLength)
+	var size int64
+	copyRecord := func(from *os.File, offset int64) error {
+		if _, err := from.ReadAt(record, offset); err != nil {
+			return err
+		}
+		if _, err := tmp.WriteAt(record, size); err != nil {
+			return err
+		}
+		moved[offset] = size
+		size += RecordLength
+		return nil
+	}
+	for _, e := range snapshot {
+		if err := errors.Join(ctx.Err(), s.ctx.Err()); err != nil {
+			return abort(err)
+		}
+		if err := copyRecord(file, e.offset); err != nil {
+			return abort(err)
+		}
+	}
+
+	s.Lock()
+	defer s.Unlock()
+	if err := errors.Join(ctx.Err(), s.ctx.Err()); err != nil {
+		return abort(err)
+	}
+	index := make(map[needle.Hash]entry, len(s.index))
+	for hash, e := range s.index {
+		if e.offset >= snapshotSize {
+			if err := copyRecord(s.file, e.offset); err != nil {
+				return abort(err)
+			}
+		}
+		// every entry below snapshotSize was in the snapshot, since the snapshot held
+		// the latest record for each hash at the time
+		index[hash] = entry{offset: moved[e.offset], expiration: e.expiration}
+	}
+	if err := tmp.Sync(); err != nil {
+		return abort(err)
+	}
+	// the old checkpoint refers to offsets in the old log, so remove it before the
+	// rename. A crash before the next checkpoint then replays the whole new log.
+	if err := os.Remove(filepath.Join(s.dir, checkpointFileName)); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return abort(err)
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return abort(err)
+	}
+	s.file.Close()
+	s.file, s.index, s.size = tmp, index, size
+	return s.checkpoint()
+}
+
+// recover loads the last checkpoint, if any, and replays the log written after it.
+// A partial record at the end of the log, left by a crash mid-append, is truncated.
+func (s *Store) recover() error {
+	var offset int64
+	b, err := os.ReadFile(filepath.Join(s.dir, checkpointFileName))
+	switch {
+	case errors.Is(err, os.ErrNotExist):
+	case err != nil:
+		return err
+	default:
+		if offset, err = s.loadCheckpoint(b); err != nil {
+			return err
+		}
+	}
+
+	info, err := s.file.Stat()
+	if err != nil {
+		return err
+	}
+	if offset > info.Size() {
+		// the checkpoint is ahead of the log, so it cannot be trusted
+		s.index = make(map[needle.Hash]entry)
+		offset = 0
+	}
+	s.size = offset + (info.Size()-offset)/RecordLength*RecordLength
+	if s.size != info.Size() {
+		if err := s.file.Truncate(s.size); err != nil {
+			return err
+		}
+	}
+
+	now := s.now()
+	r := io.NewSectionReader(s.file, offset, s.size-offset)
+	record := make([]byte, RecordLength)
+	for ; offset < s.size; offset += RecordLength {
+		if _, err := io.ReadFull(r, record); err != nil {
+			return err
+		}
+		expiration := time.Unix(0, int64(binary.BigEndian.Uint64(record)))
+		var hash needle.Hash
+		copy(hash[:], record[expirationLength:])
+		if now.Before(expiration) {
+			s.index[hash] = entry{offset: offset, expiration: expiration}
+		} else {
+			delete(s.index, hash)
+		}
+	}
+	return nil
+}
+
+// loadCheckpoint decodes a checkpoint into the index and returns the log offset it covers.
+func (s *Store) loadCheckpoint(b []byte) (int64, error) {
+	if len(b) < checkpointHeaderLength {
+		return 0, ErrorInvalidCheckpoint
+	}
+	offset := int64(binary.BigEndian.Uint64(b))
+	count := binary.BigEndian.Uint64(b[8:])
+	b = b[checkpointHeaderLength:]
+	if uint64(len(b)) != count*entryLength {
+		return 0, ErrorInvalidCheckpoint
+	}
+	now := s.now()
+	for ; len(b) > 0; b = b[entryLength:] {
+		var hash needle.Hash
+		copy(hash[:], b)
+		e := entry{
+			offset:     int64(binary.BigEndian.Uint64(b[needle.HashLength:])),
+			expiration: time.Unix(0, int64(binary.BigEndian.Uint64(b[needle.HashLength+8:]))),
+		}
+		if now.Before(e.expiration) {
+			s.index[hash] = e
+		}
+	}
+	return offset, nil
+}
+
+// writeFile atomically replaces path with b by writing to a temporary file and renaming it.
+func writeFile(path string, b []byte) error {
+	tmp := path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(b); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
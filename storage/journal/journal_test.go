@@ -0,0 +1,619 @@
+package journal
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/nomasters/haystack/needle"
+	"github.com/nomasters/haystack/storage"
+)
+
+// randomNeedle returns a needle with a random payload.
+func randomNeedle(t testing.TB) *needle.Needle {
+	t.Helper()
+	p := make([]byte, needle.PayloadLength)
+	rand.Read(p)
+	n, err := needle.New(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return n
+}
+
+// clock is a fake time source that only moves when advanced.
+type clock struct {
+	nanos atomic.Int64
+}
+
+func newClock() *clock {
+	c := new(clock)
+	c.nanos.Store(time.Now().UnixNano())
+	return c
+}
+
+func (c *clock) Now() time.Time {
+	return time.Unix(0, c.nanos.Load())
+}
+
+func (c *clock) Advance(d time.Duration) {
+	c.nanos.Add(int64(d))
+}
+
+func TestStore(t *testing.T) {
+	t.Parallel()
+	t.Run("set and get", func(t *testing.T) {
+		t.Parallel()
+		s, err := New(context.Background(), t.TempDir(), time.Minute, 10)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer s.Close()
+
+		n := randomNeedle(t)
+		if err := s.Set(n); err != nil {
+			t.Fatal(err)
+		}
+		got, err := s.Get(n.Hash())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got.Bytes(), n.Bytes()) {
+			t.Error("needle returned by Get does not match")
+		}
+		if _, err := s.Get(randomNeedle(t).Hash()); !errors.Is(err, ErrorDNE) {
+			t.Errorf("expected ErrorDNE, got: %v", err)
+		}
+		if err := s.Set(nil); !errors.Is(err, storage.ErrorNeedleIsNil) {
+			t.Errorf("expected storage.ErrorNeedleIsNil, got: %v", err)
+		}
+	})
+	t.Run("full", func(t *testing.T) {
+		t.Parallel()
+		s, err := New(context.Background(), t.TempDir(), time.Minute, 2)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer s.Close()
+
+		n := randomNeedle(t)
+		s.Set(n)
+		s.Set(randomNeedle(t))
+		if err := s.Set(randomNeedle(t)); !errors.Is(err, ErrorStoreFull) {
+			t.Errorf("expected ErrorStoreFull, got: %v", err)
+		}
+		if err := s.Set(n); err != nil {
+			t.Errorf("expected re-setting an existing needle to succeed, got: %v", err)
+		}
+	})
+	t.Run("max bytes", func(t *testing.T) {
+		t.Parallel()
+		s, err := New(context.Background(), t.TempDir(), time.Minute, 0, WithMaxBytes(2*RecordLength+1))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer s.Close()
+
+		s.Set(randomNeedle(t))
+		s.Set(randomNeedle(t))
+		if err := s.Set(randomNeedle(t)); !errors.Is(err, ErrorStoreFull) {
+			t.Errorf("expected ErrorStoreFull, got: %v", err)
+		}
+	})
+	t.Run("invalid capacity", func(t *testing.T) {
+		t.Parallel()
+		dir := filepath.Join(t.TempDir(), "journal")
+		if _, err := New(context.Background(), dir, time.Minute, 10, WithMaxBytes(RecordLength-1)); !errors.Is(err, ErrorInvalidCapacity) {
+			t.Errorf("expected ErrorInvalidCapacity, got: %v", err)
+		}
+		if _, err := os.Stat(dir); !os.IsNotExist(err) {
+			t.Errorf("expected no journal to be created, got: %v", err)
+		}
+	})
+	t.Run("no background checkpoints", func(t *testing.T) {
+		t.Parallel()
+		dir := t.TempDir()
+		s, err := New(context.Background(), dir, time.Minute, 10, WithCheckpointInterval(0))
+		if err != nil {
+			t.Fatal(err)
+		}
+		n := randomNeedle(t)
+		s.Set(n)
+		if err := s.Close(); err != nil {
+			t.Fatal(err)
+		}
+		s, err = New(context.Background(), dir, time.Minute, 10, WithCheckpointInterval(-1))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer s.Close()
+		if _, err := s.Get(n.Hash()); err != nil {
+			t.Errorf("expected needle after reopening, got: %v", err)
+		}
+	})
+	t.Run("ttl", func(t *testing.T) {
+		t.Parallel()
+		c := newClock()
+		s, err := New(context.Background(), t.TempDir(), time.Minute, 10, WithClock(c.Now))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer s.Close()
+
+		n := randomNeedle(t)
+		s.Set(n)
+		c.Advance(time.Minute)
+		if _, err := s.Get(n.Hash()); !errors.Is(err, ErrorDNE) {
+			t.Errorf("expected expired needle to return ErrorDNE, got: %v", err)
+		}
+	})
+	t.Run("revive", func(t *testing.T) {
+		t.Parallel()
+		c := newClock()
+		s, err := New(context.Background(), t.TempDir(), time.Minute, 1, WithClock(c.Now))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer s.Close()
+
+		n := randomNeedle(t)
+		s.Set(n)
+		c.Advance(time.Minute)
+		if _, err := s.Get(n.Hash()); !errors.Is(err, ErrorDNE) {
+			t.Fatalf("expected expired needle to return ErrorDNE, got: %v", err)
+		}
+		// re-setting the expired needle must succeed even though its stale entry
+		// still fills the store.
+		if err := s.Set(n); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := s.Get(n.Hash()); err != nil {
+			t.Errorf("expected revived needle, got: %v", err)
+		}
+		if len(s.index) != 1 || s.size != 2*RecordLength {
+			t.Errorf("expected 1 entry in a log of 2 records, got %v entries and %v bytes", len(s.index), s.size)
+		}
+	})
+	t.Run("for each needle", func(t *testing.T) {
+		t.Parallel()
+		c := newClock()
+		s, err := New(context.Background(), t.TempDir(), time.Minute, 100, WithClock(c.Now))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer s.Close()
+		for _, n := range needle.NewDeterministic(1, 5) {
+			s.Set(n)
+		}
+		c.Advance(40 * time.Second)
+		expected := make(map[needle.Hash]bool)
+		for _, n := range needle.NewDeterministic(2, 50) {
+			s.Set(n)
+			expected[n.Hash()] = true
+		}
+		c.Advance(30 * time.Second)
+
+		seen := make(map[needle.Hash]bool)
+		err = s.ForEachNeedle(func(n *needle.Needle, expiresAt time.Time) bool {
+			if !expected[n.Hash()] || seen[n.Hash()] {
+				t.Errorf("unexpected needle %x", n.Hash())
+			}
+			if !expiresAt.After(c.Now()) {
+				t.Errorf("expected a needle that has not expired, got expiration %v", expiresAt)
+			}
+			seen[n.Hash()] = true
+			return true
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(seen) != len(expected) {
+			t.Errorf("expected %v needles, got %v", len(expected), len(seen))
+		}
+
+		count := 0
+		s.ForEachNeedle(func(*needle.Needle, time.Time) bool {
+			count++
+			return count < 10
+		})
+		if count != 10 {
+			t.Errorf("expected iteration to stop after 10 needles, got %v", count)
+		}
+	})
+}
+
+func TestRecovery(t *testing.T) {
+	t.Parallel()
+	t.Run("from checkpoint and log tail", func(t *testing.T) {
+		t.Parallel()
+		dir := t.TempDir()
+		s, err := New(context.Background(), dir, time.Minute, 100)
+		if err != nil {
+			t.Fatal(err)
+		}
+		needles := make([]*needle.Needle, 20)
+		for i := range needles {
+			needles[i] = randomNeedle(t)
+			if i == 10 {
+				s.Lock()
+				s.checkpoint()
+				s.Unlock()
+			}
+			s.Set(needles[i])
+		}
+		// simulate a crash by closing the log without a final checkpoint
+		s.cancel()
+		s.wg.Wait()
+		s.file.Close()
+
+		s, err = New(context.Background(), dir, time.Minute, 100)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer s.Close()
+		for i, n := range needles {
+			if _, err := s.Get(n.Hash()); err != nil {
+				t.Errorf("needle %v not recovered: %v", i, err)
+			}
+		}
+	})
+	t.Run("truncates partial record", func(t *testing.T) {
+		t.Parallel()
+		dir := t.TempDir()
+		s, err := New(context.Background(), dir, time.Minute, 100)
+		if err != nil {
+			t.Fatal(err)
+		}
+		n := randomNeedle(t)
+		s.Set(n)
+		s.cancel()
+		s.wg.Wait()
+		s.file.Close()
+
+		f, err := os.OpenFile(filepath.Join(dir, logFileName), os.O_WRONLY|os.O_APPEND, 0600)
+		if err != nil {
+			t.Fatal(err)
+		}
+		f.Write(make([]byte, RecordLength/2))
+		f.Close()
+
+		s, err = New(context.Background(), dir, time.Minute, 100)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer s.Close()
+		if s.size != RecordLength {
+			t.Errorf("expected partial record to be truncated, size is %v", s.size)
+		}
+		if _, err := s.Get(n.Hash()); err != nil {
+			t.Errorf("needle not recovered: %v", err)
+		}
+	})
+	t.Run("after compaction", func(t *testing.T) {
+		t.Parallel()
+		dir := t.TempDir()
+		s, err := New(context.Background(), dir, time.Minute, 100)
+		if err != nil {
+			t.Fatal(err)
+		}
+		n := randomNeedle(t)
+		for i := 0; i < 10; i++ {
+			s.Set(n)
+		}
+		if err := s.Compact(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+		if err := s.Close(); err != nil {
+			t.Fatal(err)
+		}
+		info, err := os.Stat(filepath.Join(dir, logFileName))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.Size() != RecordLength {
+			t.Errorf("expected compacted log of one record, got %v bytes", info.Size())
+		}
+
+		s, err = New(context.Background(), dir, time.Minute, 100)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer s.Close()
+		if _, err := s.Get(n.Hash()); err != nil {
+			t.Errorf("needle not recovered after compaction: %v", err)
+		}
+	})
+}
+
+func TestCompact(t *testing.T) {
+	t.Parallel()
+	t.Run("one at a time", func(t *testing.T) {
+		t.Parallel()
+		s, err := New(context.Background(), t.TempDir(), time.Minute, 100)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer s.Close()
+		needles := make([]*needle.Needle, 20)
+		for i := range needles {
+			needles[i] = randomNeedle(t)
+			s.Set(needles[i])
+			s.Set(needles[i])
+		}
+
+		s.compacting.Store(true)
+		if err := s.Compact(context.Background()); !errors.Is(err, ErrorCompactionInProgress) {
+			t.Errorf("expected ErrorCompactionInProgress, got: %v", err)
+		}
+		s.compacting.Store(false)
+
+		errs := make(chan error, 4)
+		for i := 0; i < cap(errs); i++ {
+			go func() { errs <- s.Compact(context.Background()) }()
+		}
+		for i := 0; i < cap(errs); i++ {
+			if err := <-errs; err != nil && !errors.Is(err, ErrorCompactionInProgress) {
+				t.Errorf("unexpected compaction error: %v", err)
+			}
+		}
+		if s.size != int64(len(needles))*RecordLength {
+			t.Errorf("expected a compacted log of %v records, got %v bytes", len(needles), s.size)
+		}
+		for i, n := range needles {
+			if _, err := s.Get(n.Hash()); err != nil {
+				t.Errorf("needle %v lost by compaction: %v", i, err)
+			}
+		}
+	})
+	t.Run("concurrent with gets and sets", func(t *testing.T) {
+		t.Parallel()
+		dir := t.TempDir()
+		s, err := New(context.Background(), dir, time.Minute, 2000, WithCheckpointInterval(0))
+		if err != nil {
+			t.Fatal(err)
+		}
+		needles := make([]*needle.Needle, 500)
+		for i := range needles {
+			needles[i] = randomNeedle(t)
+			s.Set(needles[i])
+			s.Set(needles[i])
+		}
+
+		done := make(chan struct{})
+		var added []*needle.Needle
+		var wg sync.WaitGroup
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			for i := 0; ; i++ {
+				select {
+				case <-done:
+					return
+				default:
+				}
+				n := needles[i%len(needles)]
+				got, err := s.Get(n.Hash())
+				if err != nil {
+					t.Errorf("get failed during compaction: %v", err)
+					return
+				}
+				if got.Payload() != n.Payload() {
+					t.Error("get returned the wrong needle during compaction")
+					return
+				}
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			// stay within the capacity left after the existing needles
+			for len(added) < 1000 {
+				select {
+				case <-done:
+					return
+				default:
+				}
+				n := randomNeedle(t)
+				if err := s.Set(n); err != nil {
+					t.Errorf("set failed during compaction: %v", err)
+					return
+				}
+				added = append(added, n)
+			}
+		}()
+		err = s.Compact(context.Background())
+		close(done)
+		wg.Wait()
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i, n := range append(needles, added...) {
+			if _, err := s.Get(n.Hash()); err != nil {
+				t.Errorf("needle %v lost by compaction: %v", i, err)
+			}
+		}
+
+		// the compacted log and its checkpoint must recover every needle
+		if err := s.Close(); err != nil {
+			t.Fatal(err)
+		}
+		s, err = New(context.Background(), dir, time.Minute, 2000, WithCheckpointInterval(0))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer s.Close()
+		for i, n := range append(needles, added...) {
+			if _, err := s.Get(n.Hash()); err != nil {
+				t.Errorf("needle %v not recovered after compaction: %v", i, err)
+			}
+		}
+	})
+	t.Run("cancelled", func(t *testing.T) {
+		t.Parallel()
+		dir := t.TempDir()
+		s, err := New(context.Background(), dir, time.Minute, 100)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer s.Close()
+		n := randomNeedle(t)
+		for i := 0; i < 10; i++ {
+			s.Set(n)
+		}
+
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		if err := s.Compact(ctx); !errors.Is(err, context.Canceled) {
+			t.Errorf("expected context.Canceled, got: %v", err)
+		}
+		if _, err := os.Stat(filepath.Join(dir, logFileName+".compact")); !errors.Is(err, os.ErrNotExist) {
+			t.Errorf("expected the partial log to be removed, got: %v", err)
+		}
+		if s.size != 10*RecordLength {
+			t.Errorf("expected the log to be unchanged, got %v bytes", s.size)
+		}
+		if _, err := s.Get(n.Hash()); err != nil {
+			t.Errorf("needle lost by cancelled compaction: %v", err)
+		}
+	})
+}
+
+func TestAudit(t *testing.T) {
+	t.Parallel()
+	dir := t.TempDir()
+	s, err := New(context.Background(), dir, time.Minute, 10, WithAudit(10*time.Millisecond, 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	needles := make([]*needle.Needle, 5)
+	for i := range needles {
+		needles[i] = randomNeedle(t)
+		s.Set(needles[i])
+	}
+	if failed := s.audit(len(needles)); len(failed) != 0 {
+		t.Fatalf("expected no failures in an intact log, got %x", failed)
+	}
+
+	// flip a payload byte of the third record behind the store's back
+	f, err := os.OpenFile(filepath.Join(dir, logFileName), os.O_RDWR, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := make([]byte, 1)
+	f.ReadAt(b, 3*RecordLength-1)
+	b[0] ^= 0xff
+	f.WriteAt(b, 3*RecordLength-1)
+	f.Close()
+
+	deadline := time.Now().Add(time.Second)
+	for s.AuditFailures() == 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if s.AuditFailures() == 0 {
+		t.Error("expected the background audit to find the corrupt record")
+	}
+	if failed := s.AuditFailedHashes(); len(failed) != 1 || failed[0] != needles[2].Hash() {
+		t.Errorf("expected the hash of the third record, got %x", failed)
+	}
+}
+
+func TestAuditPass(t *testing.T) {
+	t.Parallel()
+	s, err := New(context.Background(), t.TempDir(), time.Minute, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	for i := 0; i < 5; i++ {
+		s.Set(randomNeedle(t))
+	}
+	// batches of two cover the five records in three batches, then a new pass starts
+	for i, remaining := range []int{3, 1, 0, 3} {
+		s.audit(2)
+		if l := len(s.auditQueue); l != remaining {
+			t.Errorf("batch %v: expected %v records left in the pass, got %v", i, remaining, l)
+		}
+	}
+}
+
+func TestExportImport(t *testing.T) {
+	t.Parallel()
+	c := newClock()
+	s, err := New(context.Background(), t.TempDir(), time.Minute, 100, WithClock(c.Now))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	expired := randomNeedle(t)
+	s.Set(expired)
+	c.Advance(40 * time.Second)
+	needles := needle.NewDeterministic(3, 50)
+	for _, n := range needles {
+		s.Set(n)
+	}
+	c.Advance(30 * time.Second)
+
+	var buf bytes.Buffer
+	if err := s.Export(&buf); err != nil {
+		t.Fatal(err)
+	}
+	if buf.Len() != len(needles)*RecordLength {
+		t.Errorf("expected %v records, got %v bytes", len(needles), buf.Len())
+	}
+
+	// import into a smaller store, which only needs room for the live needles
+	dir := t.TempDir()
+	stream := buf.Bytes()
+	if err := Import(context.Background(), bytes.NewReader(stream), dir, time.Hour, len(needles), WithClock(c.Now)); err != nil {
+		t.Fatal(err)
+	}
+	imported, err := New(context.Background(), dir, time.Hour, len(needles), WithClock(c.Now))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer imported.Close()
+	for i, n := range needles {
+		if _, err := imported.Get(n.Hash()); err != nil {
+			t.Errorf("needle %v not imported: %v", i, err)
+		}
+	}
+	if _, err := imported.Get(expired.Hash()); err != ErrorDNE {
+		t.Errorf("expected the expired needle to be skipped, got: %v", err)
+	}
+	if err := Import(context.Background(), bytes.NewReader(stream), t.TempDir(), time.Hour, 10, WithClock(c.Now)); !errors.Is(err, ErrorStoreFull) {
+		t.Errorf("expected %v, got: %v", ErrorStoreFull, err)
+	}
+	if err := Import(context.Background(), bytes.NewReader(stream[:RecordLength+1]), t.TempDir(), time.Hour, 10, WithClock(c.Now)); !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Errorf("expected %v, got: %v", io.ErrUnexpectedEOF, err)
+	}
+
+	// needles keep their exported expiration rather than the new ttl
+	c.Advance(30 * time.Second)
+	if _, err := imported.Get(needles[0].Hash()); err != ErrorDNE {
+		t.Errorf("expected the needle to expire with its exported expiration, got: %v", err)
+	}
+}
+
+func TestStorageErrors(t *testing.T) {
+	t.Parallel()
+	s, err := New(context.Background(), t.TempDir(), time.Minute, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	if _, err := s.Get(needle.Hash{}); !errors.Is(err, storage.ErrorNotFound) {
+		t.Errorf("expected storage.ErrorNotFound, got: %v", err)
+	}
+	s.Set(randomNeedle(t))
+	if err := s.Set(randomNeedle(t)); !errors.Is(err, storage.ErrorFull) {
+		t.Errorf("expected storage.ErrorFull, got: %v", err)
+	}
+}
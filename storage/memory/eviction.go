@@ -0,0 +1,73 @@
+package memory
+
+import (
+	"container/list"
+
+	"github.com/nomasters/haystack/needle"
+)
+
+// EvictionPolicy chooses which needle to evict when a Set would otherwise fail with
+// ErrorStoreFull. The store calls its methods with the store locked, so an
+// implementation needs no locking of its own but must not call back into the store.
+type EvictionPolicy interface {
+	// RecordAccess is called when hash is Set and each time it is read.
+	RecordAccess(hash needle.Hash)
+	// Remove is called when hash leaves the store by expiring.
+	Remove(hash needle.Hash)
+	// Victim removes and returns the hash that should be evicted next, or false if the
+	// policy holds no hashes.
+	Victim() (needle.Hash, bool)
+}
+
+// WithEvictionPolicy makes a full store evict the needle chosen by p to make room for
+// a new one instead of returning ErrorStoreFull.
+func WithEvictionPolicy(p EvictionPolicy) Option {
+	return func(s *Store) {
+		s.eviction = p
+	}
+}
+
+// listPolicy keeps hashes in a list ordered from the next victim to the last.
+type listPolicy struct {
+	order        *list.List
+	elements     map[needle.Hash]*list.Element
+	moveOnAccess bool
+}
+
+// NewLRU returns an EvictionPolicy that evicts the least recently Set or read needle.
+func NewLRU() EvictionPolicy {
+	return &listPolicy{order: list.New(), elements: make(map[needle.Hash]*list.Element), moveOnAccess: true}
+}
+
+// NewFIFO returns an EvictionPolicy that evicts the needle that was first Set, no
+// matter how recently it was read or Set again.
+func NewFIFO() EvictionPolicy {
+	return &listPolicy{order: list.New(), elements: make(map[needle.Hash]*list.Element)}
+}
+
+func (p *listPolicy) RecordAccess(hash needle.Hash) {
+	if e, ok := p.elements[hash]; ok {
+		if p.moveOnAccess {
+			p.order.MoveToBack(e)
+		}
+		return
+	}
+	p.elements[hash] = p.order.PushBack(hash)
+}
+
+func (p *listPolicy) Remove(hash needle.Hash) {
+	if e, ok := p.elements[hash]; ok {
+		p.order.Remove(e)
+		delete(p.elements, hash)
+	}
+}
+
+func (p *listPolicy) Victim() (needle.Hash, bool) {
+	e := p.order.Front()
+	if e == nil {
+		return needle.Hash{}, false
+	}
+	hash := p.order.Remove(e).(needle.Hash)
+	delete(p.elements, hash)
+	return hash, true
+}
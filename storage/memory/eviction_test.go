@@ -0,0 +1,75 @@
+package memory
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/nomasters/haystack/needle"
+)
+
+// numberedNeedle returns a needle whose payload starts with i.
+func numberedNeedle(i int) *needle.Needle {
+	p := make([]byte, needle.PayloadLength)
+	p[0] = byte(i)
+	n, _ := needle.New(p)
+	return n
+}
+
+func TestEvictionPolicy(t *testing.T) {
+	t.Parallel()
+	for _, test := range []struct {
+		description string
+		policy      EvictionPolicy
+		evicted     int
+	}{
+		{description: "LRU evicts the least recently read", policy: NewLRU(), evicted: 1},
+		{description: "FIFO evicts the first set", policy: NewFIFO(), evicted: 0},
+	} {
+		t.Run(test.description, func(t *testing.T) {
+			t.Parallel()
+			s := New(context.Background(), time.Minute, 2, WithEvictionPolicy(test.policy))
+			defer s.Close()
+			s.Set(numberedNeedle(0))
+			s.Set(numberedNeedle(1))
+			if _, err := s.Get(numberedNeedle(0).Hash()); err != nil {
+				t.Fatal(err)
+			}
+			if _, ok := s.Remaining(); ok {
+				t.Error("expected a store that evicts to report no capacity limit")
+			}
+			if err := s.Set(numberedNeedle(2)); err != nil {
+				t.Fatalf("expected a needle to be evicted, got: %v", err)
+			}
+			for i := 0; i < 3; i++ {
+				_, err := s.Get(numberedNeedle(i).Hash())
+				if evicted := errors.Is(err, ErrorDNE); evicted != (i == test.evicted) {
+					t.Errorf("needle %v: unexpected error: %v", i, err)
+				}
+			}
+		})
+	}
+	t.Run("expired needles leave the policy", func(t *testing.T) {
+		t.Parallel()
+		lru := NewLRU()
+		s := New(context.Background(), 10*time.Millisecond, 2, WithEvictionPolicy(lru))
+		defer s.Close()
+		s.Set(numberedNeedle(0))
+		time.Sleep(50 * time.Millisecond)
+		s.Lock()
+		defer s.Unlock()
+		if hash, ok := lru.Victim(); ok {
+			t.Errorf("expected expired needle to be removed from the policy, got %x", hash)
+		}
+	})
+	t.Run("no policy", func(t *testing.T) {
+		t.Parallel()
+		s := New(context.Background(), time.Minute, 1)
+		defer s.Close()
+		s.Set(numberedNeedle(0))
+		if err := s.Set(numberedNeedle(1)); !errors.Is(err, ErrorStoreFull) {
+			t.Errorf("expected ErrorStoreFull, got: %v", err)
+		}
+	})
+}
@@ -2,7 +2,7 @@ package memory
 
 import (
 	"context"
-	"errors"
+	"math/bits"
 	"sync"
 	"time"
 
@@ -11,10 +11,12 @@ import (
 )
 
 var (
-	// ErrorStoreFull is used when the Set method receives a nil pointer
-	ErrorStoreFull = errors.New("Store is full")
-	// ErrorDNE is returned when a key/value par does not exist
-	ErrorDNE = errors.New("Does Not Exist")
+	// ErrorStoreFull is returned when the store holds maxItems needles. It is the same
+	// value as storage.ErrorFull so callers can check either.
+	ErrorStoreFull = storage.ErrorFull
+	// ErrorDNE is returned when a key/value par does not exist. It is the same value as
+	// storage.ErrorNotFound so callers can check either.
+	ErrorDNE = storage.ErrorNotFound
 )
 
 type value struct {
@@ -22,6 +24,8 @@ type value struct {
 	expiration time.Time
 }
 
+// cleanup records when a needle set at expiration can be removed. Since every needle
+// has the same ttl, cleanups are queued in expiration order.
 type cleanup struct {
 	hash       needle.Hash
 	expiration time.Time
@@ -32,52 +36,183 @@ type Store struct {
 	sync.RWMutex
 	internal map[needle.Hash]value
 	ttl      time.Duration
-	cleanups chan cleanup
+	cleanups []cleanup
+	wake     chan struct{}
 	maxItems int
+	maxBytes int64
+	grace    time.Duration
+	eviction EvictionPolicy
+	now      func() time.Time
 	ctx      context.Context
 	cancel   context.CancelFunc
 }
 
+// Option configures optional Store settings
+type Option func(*Store)
+
+// WithStaleGrace keeps needles for grace after they expire so they can still be read
+// with GetStale, for callers that prefer a slightly stale value over a miss. Get
+// never returns expired needles.
+func WithStaleGrace(grace time.Duration) Option {
+	return func(s *Store) {
+		s.grace = grace
+	}
+}
+
+// WithClock replaces time.Now as the source of the current time for expirations.
+// Tests can pass a fake clock to expire needles without sleeping. Background cleanup
+// still waits in real time, so needles expired by a fake clock may linger in memory
+// but are never returned.
+func WithClock(now func() time.Time) Option {
+	return func(s *Store) {
+		s.now = now
+	}
+}
+
+// WithMaxBytes caps the store at the number of needles whose hash and payload fit in
+// n bytes, or at maxItems if that is lower. A maxItems of zero or less is ignored when
+// n is set, so the store can be sized by bytes alone. Per needle bookkeeping such as
+// the expiration and map overhead is not counted, so memory use is somewhat higher.
+func WithMaxBytes(n int64) Option {
+	return func(s *Store) {
+		s.maxBytes = n
+	}
+}
+
 // Set takes a needle and writes it to the memory store.
 func (s *Store) Set(n *needle.Needle) error {
 	if n == nil {
 		return storage.ErrorNeedleIsNil
 	}
 	s.Lock()
-	if len(s.internal) > s.maxItems {
+	hash := n.Hash()
+	if _, ok := s.internal[hash]; !ok && len(s.internal) >= s.maxItems && !s.evict() {
 		s.Unlock()
 		return ErrorStoreFull
 	}
-	hash := n.Hash()
-	expiration := time.Now().Add(s.ttl)
+	expiration := s.now().Add(s.ttl)
 	s.internal[hash] = value{
 		payload:    n.Payload(),
 		expiration: expiration,
 	}
-	s.Unlock()
-
-	go func() {
+	if s.eviction != nil {
+		s.eviction.RecordAccess(hash)
+	}
+	s.cleanups = append(s.cleanups, cleanup{hash: hash, expiration: expiration})
+	if len(s.cleanups) == 1 {
 		select {
-		case <-s.ctx.Done():
-			return
-		case <-time.After(s.ttl):
-			s.cleanups <- cleanup{hash: hash, expiration: expiration}
+		case s.wake <- struct{}{}:
+		default:
 		}
-	}()
-
+	}
+	s.Unlock()
 	return nil
 }
 
-// Get takes a 32 byte hash and returns a pointer to a needle and an error
+// evict removes the needle chosen by the eviction policy, if there is one, and reports
+// whether a needle was removed. It must be called with s locked.
+func (s *Store) evict() bool {
+	if s.eviction == nil {
+		return false
+	}
+	hash, ok := s.eviction.Victim()
+	if ok {
+		delete(s.internal, hash)
+	}
+	return ok
+}
+
+// Get takes a hash and returns a pointer to a needle and an error
 func (s *Store) Get(hash needle.Hash) (*needle.Needle, error) {
-	s.RLock()
+	n, stale, err := s.GetStale(hash)
+	if err != nil {
+		return nil, err
+	}
+	if stale {
+		return nil, ErrorDNE
+	}
+	return n, nil
+}
+
+// GetStale is like Get but also returns needles that have expired within the grace
+// period set by WithStaleGrace, reporting them as stale.
+func (s *Store) GetStale(hash needle.Hash) (*needle.Needle, bool, error) {
+	lock, unlock := s.RLock, s.RUnlock
+	if s.eviction != nil {
+		// recording the access changes the policy, so a read lock is not enough
+		lock, unlock = s.Lock, s.Unlock
+	}
+	lock()
 	v, ok := s.internal[hash]
-	s.RUnlock()
+	now := s.now()
+	ok = ok && now.Before(v.expiration.Add(s.grace))
+	if ok && s.eviction != nil {
+		s.eviction.RecordAccess(hash)
+	}
+	unlock()
 	if !ok {
-		return nil, ErrorDNE
+		return nil, false, ErrorDNE
+	}
+	// the payload was validated against hash when it was Set and has not left the
+	// process since, so it is not hashed again.
+	return needle.NewTrusted(hash, v.payload), !now.Before(v.expiration), nil
+}
+
+// ForEachNeedle calls fn with every needle that has not expired and its expiration,
+// in no particular order, stopping early if fn returns false. It holds a read lock for
+// the length of the iteration, so fn must not Set on the store. The error is always
+// nil and is returned to match the journal store.
+func (s *Store) ForEachNeedle(fn func(n *needle.Needle, expiresAt time.Time) bool) error {
+	s.RLock()
+	defer s.RUnlock()
+	now := s.now()
+	for hash, v := range s.internal {
+		if !now.Before(v.expiration) {
+			continue
+		}
+		if !fn(needle.NewTrusted(hash, v.payload), v.expiration) {
+			return nil
+		}
+	}
+	return nil
+}
+
+// Nearest scans the store for the hash sharing the longest bit prefix with hash.
+// It holds a read lock for the length of the scan and is intended for debugging.
+func (s *Store) Nearest(hash needle.Hash) (needle.Hash, int, bool) {
+	s.RLock()
+	defer s.RUnlock()
+	var nearest needle.Hash
+	best := -1
+	for h := range s.internal {
+		if l := prefixBits(hash, h); l > best {
+			nearest, best = h, l
+		}
+	}
+	return nearest, best, best >= 0
+}
+
+// prefixBits returns the number of leading bits a and b have in common.
+func prefixBits(a, b needle.Hash) int {
+	for i := range a {
+		if x := a[i] ^ b[i]; x != 0 {
+			return i*8 + bits.LeadingZeros8(x)
+		}
 	}
-	b := append(hash[:], v.payload[:]...)
-	return needle.FromBytes(b)
+	return len(a) * 8
+}
+
+// Remaining returns the number of needles that can be Set before the store is full.
+// Expired needles count against capacity until they are cleaned up. With an eviction
+// policy a full store makes room rather than rejecting a Set, so Remaining reports no
+// limit and callers such as the server's WithHeadroom keep accepting writes.
+func (s *Store) Remaining() (uint64, bool) {
+	if s.eviction != nil {
+		return 0, false
+	}
+	s.RLock()
+	defer s.RUnlock()
+	return uint64(max(s.maxItems-len(s.internal), 0)), true
 }
 
 // Close is meant to conform to the GetSetCloser interface.
@@ -86,8 +221,11 @@ func (s *Store) Close() error {
 	return nil
 }
 
-// New returns a pointer to a Store
-func New(ctx context.Context, ttl time.Duration, maxItems int) *Store {
+// New returns a pointer to a Store that holds up to maxItems needles. Unlike
+// journal.New, which returns ErrorInvalidCapacity, New has no error to return, so a
+// maxItems of zero or less without WithMaxBytes gives a store that rejects every Set
+// with ErrorStoreFull. shardedmemory relies on this for shards that get no capacity.
+func New(ctx context.Context, ttl time.Duration, maxItems int, opts ...Option) *Store {
 	sctx, cancel := context.WithCancel(ctx)
 
 	s := Store{
@@ -96,24 +234,61 @@ func New(ctx context.Context, ttl time.Duration, maxItems int) *Store {
 		maxItems: maxItems,
 		ctx:      sctx,
 		cancel:   cancel,
-		cleanups: make(chan cleanup, maxItems),
-	}
-
-	go func() {
-		for {
-			select {
-			case <-s.ctx.Done():
-				return
-			case task := <-s.cleanups:
-				s.Lock()
-				v := s.internal[task.hash]
-				if v.expiration.Equal(task.expiration) {
-					delete(s.internal, task.hash)
+		wake:     make(chan struct{}, 1),
+		now:      time.Now,
+	}
+	for _, opt := range opts {
+		opt(&s)
+	}
+	if s.maxBytes > 0 {
+		if items := int(s.maxBytes / needle.NeedleLength); s.maxItems <= 0 || items < s.maxItems {
+			s.maxItems = items
+		}
+	}
+	go s.run()
+	return &s
+}
+
+// run removes needles once they are past their grace period. A single goroutine
+// works through the cleanup queue, sleeping until the oldest entry is due, so Set
+// never spawns a goroutine of its own.
+func (s *Store) run() {
+	for {
+		s.Lock()
+		wait := time.Duration(-1)
+		now := s.now()
+		for len(s.cleanups) > 0 {
+			task := s.cleanups[0]
+			if d := task.expiration.Add(s.grace).Sub(now); d > 0 {
+				wait = d
+				break
+			}
+			// a needle set again since this cleanup was queued has a later expiration
+			if v, ok := s.internal[task.hash]; ok && v.expiration.Equal(task.expiration) {
+				delete(s.internal, task.hash)
+				if s.eviction != nil {
+					s.eviction.Remove(task.hash)
 				}
-				s.Unlock()
 			}
+			s.cleanups[0] = cleanup{}
+			s.cleanups = s.cleanups[1:]
 		}
-	}()
+		s.Unlock()
 
-	return &s
+		var timer *time.Timer
+		var due <-chan time.Time
+		if wait >= 0 {
+			timer = time.NewTimer(wait)
+			due = timer.C
+		}
+		select {
+		case <-s.ctx.Done():
+			return
+		case <-due:
+		case <-s.wake:
+		}
+		if timer != nil {
+			timer.Stop()
+		}
+	}
 }
@@ -1,13 +1,258 @@
 package memory
 
-import "testing"
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"runtime"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/nomasters/haystack/needle"
+	"github.com/nomasters/haystack/storage"
+)
+
+// clock is a fake time source that only moves when advanced.
+type clock struct {
+	nanos atomic.Int64
+}
+
+func newClock() *clock {
+	c := new(clock)
+	c.nanos.Store(time.Now().UnixNano())
+	return c
+}
+
+func (c *clock) Now() time.Time {
+	return time.Unix(0, c.nanos.Load())
+}
+
+func (c *clock) Advance(d time.Duration) {
+	c.nanos.Add(int64(d))
+}
 
 func TestStore(t *testing.T) {
 	t.Parallel()
 	t.Run("set", func(t *testing.T) {
 		t.Parallel()
+		s := New(context.Background(), time.Minute, 10)
+		defer s.Close()
+		if err := s.Set(nil); !errors.Is(err, storage.ErrorNeedleIsNil) {
+			t.Errorf("expected storage.ErrorNeedleIsNil, got: %v", err)
+		}
 	})
 	t.Run("get", func(t *testing.T) {
 		t.Parallel()
 	})
+	t.Run("full", func(t *testing.T) {
+		t.Parallel()
+		s := New(context.Background(), time.Minute, 0, WithMaxBytes(2*needle.NeedleLength+1))
+		defer s.Close()
+		var first *needle.Needle
+		for i := 0; i < 2; i++ {
+			p := make([]byte, needle.PayloadLength)
+			p[0] = byte(i)
+			n, _ := needle.New(p)
+			if err := s.Set(n); err != nil {
+				t.Fatal(err)
+			}
+			if first == nil {
+				first = n
+			}
+		}
+		p := make([]byte, needle.PayloadLength)
+		p[0] = 2
+		n, _ := needle.New(p)
+		if err := s.Set(n); !errors.Is(err, ErrorStoreFull) {
+			t.Errorf("expected ErrorStoreFull, got: %v", err)
+		}
+		if err := s.Set(first); err != nil {
+			t.Errorf("expected re-setting an existing needle to succeed, got: %v", err)
+		}
+	})
+	t.Run("no capacity", func(t *testing.T) {
+		t.Parallel()
+		for _, maxItems := range []int{0, -1} {
+			s := New(context.Background(), time.Minute, maxItems)
+			n, _ := needle.New(make([]byte, needle.PayloadLength))
+			if err := s.Set(n); !errors.Is(err, ErrorStoreFull) {
+				t.Errorf("maxItems %v: expected ErrorStoreFull, got: %v", maxItems, err)
+			}
+			if remaining, _ := s.Remaining(); remaining != 0 {
+				t.Errorf("maxItems %v: expected 0 remaining, got %v", maxItems, remaining)
+			}
+			s.Close()
+		}
+	})
+	t.Run("stale", func(t *testing.T) {
+		t.Parallel()
+		c := newClock()
+		s := New(context.Background(), time.Minute, 10, WithStaleGrace(3*time.Minute), WithClock(c.Now))
+		defer s.Close()
+		n, _ := needle.New(make([]byte, needle.PayloadLength))
+		s.Set(n)
+
+		if _, stale, err := s.GetStale(n.Hash()); err != nil || stale {
+			t.Errorf("expected fresh needle, got stale: %v, err: %v", stale, err)
+		}
+		c.Advance(2 * time.Minute)
+		if _, err := s.Get(n.Hash()); !errors.Is(err, ErrorDNE) {
+			t.Errorf("expected Get to miss an expired needle, got: %v", err)
+		}
+		if _, stale, err := s.GetStale(n.Hash()); err != nil || !stale {
+			t.Errorf("expected stale needle within grace, got stale: %v, err: %v", stale, err)
+		}
+		c.Advance(2 * time.Minute)
+		if _, _, err := s.GetStale(n.Hash()); !errors.Is(err, ErrorDNE) {
+			t.Errorf("expected GetStale to miss past the grace period, got: %v", err)
+		}
+	})
+	t.Run("revive", func(t *testing.T) {
+		t.Parallel()
+		s := New(context.Background(), 100*time.Millisecond, 10, WithStaleGrace(100*time.Millisecond))
+		defer s.Close()
+		n, _ := needle.New(make([]byte, needle.PayloadLength))
+		s.Set(n)
+
+		time.Sleep(150 * time.Millisecond)
+		if _, err := s.Get(n.Hash()); !errors.Is(err, ErrorDNE) {
+			t.Fatalf("expected Get to miss an expired needle, got: %v", err)
+		}
+		if err := s.Set(n); err != nil {
+			t.Fatal(err)
+		}
+		// the cleanup scheduled by the first Set has run by now and must not remove
+		// the needle that was set again.
+		time.Sleep(70 * time.Millisecond)
+		if _, err := s.Get(n.Hash()); err != nil {
+			t.Errorf("expected revived needle, got: %v", err)
+		}
+		s.RLock()
+		defer s.RUnlock()
+		if len(s.internal) != 1 {
+			t.Errorf("expected 1 stored needle, got %v", len(s.internal))
+		}
+	})
+	t.Run("cleanup", func(t *testing.T) {
+		s := New(context.Background(), 20*time.Millisecond, 2000)
+		defer s.Close()
+		before := runtime.NumGoroutine()
+		for i := 0; i < 1000; i++ {
+			p := make([]byte, needle.PayloadLength)
+			binary.BigEndian.PutUint32(p, uint32(i))
+			n, _ := needle.New(p)
+			s.Set(n)
+		}
+		// other parallel tests may start goroutines, so only check growth is bounded
+		if after := runtime.NumGoroutine(); after-before > 100 {
+			t.Errorf("expected Set not to spawn a goroutine per needle, grew by %v", after-before)
+		}
+		time.Sleep(60 * time.Millisecond)
+		s.RLock()
+		defer s.RUnlock()
+		if len(s.internal) != 0 || len(s.cleanups) != 0 {
+			t.Errorf("expected expired needles to be removed, %v remain with %v cleanups", len(s.internal), len(s.cleanups))
+		}
+	})
+	t.Run("for each needle", func(t *testing.T) {
+		t.Parallel()
+		c := newClock()
+		s := New(context.Background(), time.Minute, 100, WithClock(c.Now))
+		defer s.Close()
+		for _, n := range needle.NewDeterministic(1, 5) {
+			s.Set(n)
+		}
+		c.Advance(40 * time.Second)
+		expected := make(map[needle.Hash]bool)
+		for _, n := range needle.NewDeterministic(2, 50) {
+			s.Set(n)
+			expected[n.Hash()] = true
+		}
+		c.Advance(30 * time.Second)
+
+		seen := make(map[needle.Hash]bool)
+		err := s.ForEachNeedle(func(n *needle.Needle, expiresAt time.Time) bool {
+			if !expected[n.Hash()] || seen[n.Hash()] {
+				t.Errorf("unexpected needle %x", n.Hash())
+			}
+			if !expiresAt.After(c.Now()) {
+				t.Errorf("expected a needle that has not expired, got expiration %v", expiresAt)
+			}
+			seen[n.Hash()] = true
+			return true
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(seen) != len(expected) {
+			t.Errorf("expected %v needles, got %v", len(expected), len(seen))
+		}
+
+		count := 0
+		s.ForEachNeedle(func(*needle.Needle, time.Time) bool {
+			count++
+			return count < 10
+		})
+		if count != 10 {
+			t.Errorf("expected iteration to stop after 10 needles, got %v", count)
+		}
+	})
+	t.Run("nearest", func(t *testing.T) {
+		t.Parallel()
+		s := New(context.Background(), time.Minute, 10)
+		defer s.Close()
+		if _, _, ok := s.Nearest(needle.Hash{}); ok {
+			t.Error("expected no nearest hash in an empty store")
+		}
+		var stored needle.Hash
+		for i := 0; i < 5; i++ {
+			p := make([]byte, needle.PayloadLength)
+			p[0] = byte(i)
+			n, _ := needle.New(p)
+			s.Set(n)
+			stored = n.Hash()
+		}
+		typo := stored
+		typo[needle.HashLength-1] ^= 1
+		nearest, prefix, ok := s.Nearest(typo)
+		if !ok || nearest != stored {
+			t.Errorf("expected nearest to be %x, got %x", stored, nearest)
+		}
+		if prefix != needle.HashLength*8-1 {
+			t.Errorf("expected %v prefix bits, got %v", needle.HashLength*8-1, prefix)
+		}
+	})
+}
+
+func BenchmarkStore_Get(b *testing.B) {
+	s := New(context.Background(), time.Minute, 10)
+	defer s.Close()
+	n, _ := needle.New(make([]byte, needle.PayloadLength))
+	s.Set(n)
+	hash := n.Hash()
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := s.Get(hash); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func TestStorageErrors(t *testing.T) {
+	t.Parallel()
+	s := New(context.Background(), time.Minute, 1)
+	defer s.Close()
+	if _, err := s.Get(needle.Hash{}); !errors.Is(err, storage.ErrorNotFound) {
+		t.Errorf("expected storage.ErrorNotFound, got: %v", err)
+	}
+	p := make([]byte, needle.PayloadLength)
+	n, _ := needle.New(p)
+	s.Set(n)
+	p[0] = 1
+	n, _ = needle.New(p)
+	if err := s.Set(n); !errors.Is(err, storage.ErrorFull) {
+		t.Errorf("expected storage.ErrorFull, got: %v", err)
+	}
 }
@@ -0,0 +1,309 @@
+// Package redis is a storage backend that keeps needles in a Redis server, so several
+// haystack servers can share the same needles. Each needle is stored under its 32 byte
+// hash with the 192 byte needle as the value and expires through Redis after the ttl.
+//
+// The package speaks the Redis protocol directly over a small pool of connections
+// rather than depending on a client library. New fails if Redis cannot be reached.
+// Once the store is running, an unreachable Redis fails each Set and Get with the
+// network error instead of blocking past the operation timeout, and a broken
+// connection is dropped from the pool. The haystack server then answers a failed Get
+// as a miss and a failed Set as a failed write. Connections are redialed on the next
+// operation, so the store recovers once Redis is reachable again.
+package redis
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/nomasters/haystack/needle"
+	"github.com/nomasters/haystack/storage"
+)
+
+const (
+	defaultPoolSize = 16
+	defaultTimeout  = 2 * time.Second
+)
+
+var (
+	// ErrorDNE is returned when a needle does not exist or has expired. It is the same
+	// value as storage.ErrorNotFound so callers can check either.
+	ErrorDNE = storage.ErrorNotFound
+	// ErrorClosed is returned by Set and Get once the store has been closed
+	ErrorClosed = errors.New("Store is closed")
+	// ErrorUnexpectedReply is returned when Redis replies with something other than
+	// what the command returns
+	ErrorUnexpectedReply = errors.New("Unexpected reply")
+	// ErrorInvalidTTL is returned by New when ttl is not positive, since Redis rejects
+	// a SET with an expire time of zero
+	ErrorInvalidTTL = errors.New("Invalid ttl")
+)
+
+// Store is a struct that holds the redis storage state
+type Store struct {
+	addr     string
+	ttl      time.Duration
+	poolSize int
+	timeout  time.Duration
+
+	mu     sync.Mutex
+	idle   []*conn
+	closed bool
+}
+
+// Option configures optional Store settings
+type Option func(*Store)
+
+// WithPoolSize sets the number of idle connections kept open to Redis. More
+// connections can be open at once under load, but those beyond n are closed once
+// their operation finishes. The default is 16.
+func WithPoolSize(n int) Option {
+	return func(s *Store) {
+		s.poolSize = n
+	}
+}
+
+// WithTimeout sets how long a single Set or Get may wait on Redis, including dialing
+// a new connection. The default is two seconds.
+func WithTimeout(d time.Duration) Option {
+	return func(s *Store) {
+		s.timeout = d
+	}
+}
+
+// New connects to the Redis server at addr and returns a pointer to a Store. Needles
+// live for ttl after they are Set, rounded up to a whole second since Redis expires
+// keys set with EX in seconds. New returns ErrorInvalidTTL if ttl is not positive, and
+// an error if Redis does not answer a PING before ctx is done or the operation timeout
+// passes.
+func New(ctx context.Context, addr string, ttl time.Duration, opts ...Option) (*Store, error) {
+	if ttl <= 0 {
+		return nil, ErrorInvalidTTL
+	}
+	s := &Store{
+		addr:     addr,
+		ttl:      ttl,
+		poolSize: defaultPoolSize,
+		timeout:  defaultTimeout,
+	}
+	for _, opt := range opts {
+		opt(s)
+	}
+	c, err := s.dial(ctx)
+	if err != nil {
+		return nil, err
+	}
+	reply, err := c.do(time.Now().Add(s.timeout), "PING")
+	if err != nil {
+		c.Close()
+		return nil, err
+	}
+	if reply.s != "PONG" {
+		c.Close()
+		return nil, fmt.Errorf("%w to PING: %q", ErrorUnexpectedReply, reply.s)
+	}
+	s.put(c)
+	return s, nil
+}
+
+// Set takes a needle and writes it to Redis with the store's ttl.
+func (s *Store) Set(n *needle.Needle) error {
+	if n == nil {
+		return storage.ErrorNeedleIsNil
+	}
+	hash := n.Hash()
+	seconds := strconv.FormatInt(int64((s.ttl+time.Second-1)/time.Second), 10)
+	reply, err := s.do("SET", hash[:], n.Bytes(), []byte("EX"), []byte(seconds))
+	if err != nil {
+		return err
+	}
+	if reply.s != "OK" {
+		return fmt.Errorf("%w to SET: %q", ErrorUnexpectedReply, reply.s)
+	}
+	return nil
+}
+
+// Get takes a hash and returns a pointer to a needle and an error. A value that is
+// not a valid needle for hash is treated as an error rather than returned.
+func (s *Store) Get(hash needle.Hash) (*needle.Needle, error) {
+	reply, err := s.do("GET", hash[:])
+	if err != nil {
+		return nil, err
+	}
+	if reply.null {
+		return nil, ErrorDNE
+	}
+	n, err := needle.FromBytes(reply.b)
+	if err != nil {
+		return nil, err
+	}
+	if n.Hash() != hash {
+		return nil, needle.ErrorInvalidHash
+	}
+	return n, nil
+}
+
+// Close closes the idle connections to Redis. Needles are left in Redis to expire.
+func (s *Store) Close() error {
+	s.mu.Lock()
+	idle := s.idle
+	s.idle = nil
+	s.closed = true
+	s.mu.Unlock()
+	var errs []error
+	for _, c := range idle {
+		errs = append(errs, c.Close())
+	}
+	return errors.Join(errs...)
+}
+
+// do runs a single command on a pooled connection, dropping the connection if the
+// command fails on the network.
+func (s *Store) do(cmd string, args ...[]byte) (reply, error) {
+	deadline := time.Now().Add(s.timeout)
+	c, err := s.get(deadline)
+	if err != nil {
+		return reply{}, err
+	}
+	r, err := c.do(deadline, cmd, args...)
+	var redisErr redisError
+	if err != nil && !errors.As(err, &redisErr) {
+		c.Close()
+		return reply{}, err
+	}
+	s.put(c)
+	return r, err
+}
+
+// get returns an idle connection or dials a new one.
+func (s *Store) get(deadline time.Time) (*conn, error) {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return nil, ErrorClosed
+	}
+	if l := len(s.idle); l > 0 {
+		c := s.idle[l-1]
+		s.idle = s.idle[:l-1]
+		s.mu.Unlock()
+		return c, nil
+	}
+	s.mu.Unlock()
+	ctx, cancel := context.WithDeadline(context.Background(), deadline)
+	defer cancel()
+	return s.dial(ctx)
+}
+
+// put returns c to the pool, closing it if the pool is full or the store is closed.
+func (s *Store) put(c *conn) {
+	s.mu.Lock()
+	if !s.closed && len(s.idle) < s.poolSize {
+		s.idle = append(s.idle, c)
+		c = nil
+	}
+	s.mu.Unlock()
+	if c != nil {
+		c.Close()
+	}
+}
+
+func (s *Store) dial(ctx context.Context) (*conn, error) {
+	ctx, cancel := context.WithTimeout(ctx, s.timeout)
+	defer cancel()
+	var d net.Dialer
+	nc, err := d.DialContext(ctx, "tcp", s.addr)
+	if err != nil {
+		return nil, err
+	}
+	return &conn{Conn: nc, r: bufio.NewReader(nc), w: bufio.NewWriter(nc)}, nil
+}
+
+// conn is a connection to Redis speaking RESP, the Redis serialization protocol.
+type conn struct {
+	net.Conn
+	r *bufio.Reader
+	w *bufio.Writer
+}
+
+// reply holds a RESP reply. s is set for simple strings, b for bulk strings and null
+// for a null bulk string.
+type reply struct {
+	s    string
+	b    []byte
+	null bool
+}
+
+// redisError is an error reply from Redis. The connection is still usable after one.
+type redisError string
+
+func (e redisError) Error() string {
+	return "redis: " + string(e)
+}
+
+// do writes cmd with args as a RESP array of bulk strings and reads the reply.
+func (c *conn) do(deadline time.Time, cmd string, args ...[]byte) (reply, error) {
+	if err := c.SetDeadline(deadline); err != nil {
+		return reply{}, err
+	}
+	fmt.Fprintf(c.w, "*%d\r\n$%d\r\n%s\r\n", len(args)+1, len(cmd), cmd)
+	for _, arg := range args {
+		fmt.Fprintf(c.w, "$%d\r\n", len(arg))
+		c.w.Write(arg)
+		c.w.WriteString("\r\n")
+	}
+	if err := c.w.Flush(); err != nil {
+		return reply{}, err
+	}
+	return c.read()
+}
+
+// read reads a single reply. Arrays and integers are not returned by any command the
+// store sends, so they are reported as ErrorUnexpectedReply.
+func (c *conn) read() (reply, error) {
+	line, err := c.readLine()
+	if err != nil {
+		return reply{}, err
+	}
+	if len(line) == 0 {
+		return reply{}, ErrorUnexpectedReply
+	}
+	switch line[0] {
+	case '+':
+		return reply{s: string(line[1:])}, nil
+	case '-':
+		return reply{}, redisError(line[1:])
+	case '$':
+		l, err := strconv.Atoi(string(line[1:]))
+		if err != nil {
+			return reply{}, fmt.Errorf("%w: %w", ErrorUnexpectedReply, err)
+		}
+		if l < 0 {
+			return reply{null: true}, nil
+		}
+		b := make([]byte, l+2)
+		if _, err := io.ReadFull(c.r, b); err != nil {
+			return reply{}, err
+		}
+		return reply{b: b[:l]}, nil
+	default:
+		return reply{}, fmt.Errorf("%w: %q", ErrorUnexpectedReply, line)
+	}
+}
+
+// readLine reads a line terminated by CRLF and returns it without the terminator.
+func (c *conn) readLine() ([]byte, error) {
+	line, err := c.r.ReadSlice('\n')
+	if err != nil {
+		return nil, err
+	}
+	if len(line) < 2 || line[len(line)-2] != '\r' {
+		return nil, ErrorUnexpectedReply
+	}
+	return line[:len(line)-2], nil
+}
@@ -0,0 +1,275 @@
+package redis
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/nomasters/haystack/needle"
+	"github.com/nomasters/haystack/storage"
+)
+
+// randomNeedle returns a needle with a random payload.
+func randomNeedle(t testing.TB) *needle.Needle {
+	t.Helper()
+	p := make([]byte, needle.PayloadLength)
+	rand.Read(p)
+	n, err := needle.New(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return n
+}
+
+// fakeRedis is an in-process server that answers PING, SET and GET like Redis,
+// recording the arguments of every SET. It ignores expirations.
+type fakeRedis struct {
+	ln   net.Listener
+	mu   sync.Mutex
+	kv   map[string][]byte
+	sets [][]string
+}
+
+func newFakeRedis(t *testing.T) *fakeRedis {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := &fakeRedis{ln: ln, kv: make(map[string][]byte)}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go f.serve(c)
+		}
+	}()
+	return f
+}
+
+func (f *fakeRedis) addr() string {
+	return f.ln.Addr().String()
+}
+
+func (f *fakeRedis) serve(c net.Conn) {
+	defer c.Close()
+	r := bufio.NewReader(c)
+	for {
+		args, err := readCommand(r)
+		if err != nil {
+			return
+		}
+		f.mu.Lock()
+		switch args[0] {
+		case "PING":
+			io.WriteString(c, "+PONG\r\n")
+		case "SET":
+			f.kv[args[1]] = []byte(args[2])
+			f.sets = append(f.sets, args[3:])
+			io.WriteString(c, "+OK\r\n")
+		case "GET":
+			if v, ok := f.kv[args[1]]; ok {
+				fmt.Fprintf(c, "$%d\r\n%s\r\n", len(v), v)
+			} else {
+				io.WriteString(c, "$-1\r\n")
+			}
+		default:
+			io.WriteString(c, "-ERR unknown command\r\n")
+		}
+		f.mu.Unlock()
+	}
+}
+
+// readCommand reads a RESP array of bulk strings.
+func readCommand(r *bufio.Reader) ([]string, error) {
+	var count int
+	if _, err := fmt.Fscanf(r, "*%d\r\n", &count); err != nil {
+		return nil, err
+	}
+	args := make([]string, count)
+	for i := range args {
+		var l int
+		if _, err := fmt.Fscanf(r, "$%d\r\n", &l); err != nil {
+			return nil, err
+		}
+		b := make([]byte, l+2)
+		if _, err := io.ReadFull(r, b); err != nil {
+			return nil, err
+		}
+		args[i] = string(b[:l])
+	}
+	return args, nil
+}
+
+func TestStore(t *testing.T) {
+	t.Parallel()
+	f := newFakeRedis(t)
+	s, err := New(context.Background(), f.addr(), 1500*time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	n := randomNeedle(t)
+	if err := s.Set(n); err != nil {
+		t.Fatal(err)
+	}
+	got, err := s.Get(n.Hash())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Hash() != n.Hash() || got.Payload() != n.Payload() {
+		t.Error("expected the needle that was set")
+	}
+	f.mu.Lock()
+	if expected := []string{"EX", "2"}; fmt.Sprint(f.sets) != fmt.Sprint([][]string{expected}) {
+		t.Errorf("expected SET with %v, got %v", expected, f.sets)
+	}
+	f.mu.Unlock()
+
+	if _, err := s.Get(randomNeedle(t).Hash()); !errors.Is(err, storage.ErrorNotFound) {
+		t.Errorf("expected %v, got: %v", storage.ErrorNotFound, err)
+	}
+	if err := s.Set(nil); err != storage.ErrorNeedleIsNil {
+		t.Errorf("expected %v, got: %v", storage.ErrorNeedleIsNil, err)
+	}
+
+	// a value stored under the wrong key must not be returned
+	other := randomNeedle(t)
+	hash := other.Hash()
+	f.mu.Lock()
+	f.kv[string(hash[:])] = n.Bytes()
+	f.mu.Unlock()
+	if _, err := s.Get(hash); !errors.Is(err, needle.ErrorInvalidHash) {
+		t.Errorf("expected %v, got: %v", needle.ErrorInvalidHash, err)
+	}
+
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Get(n.Hash()); err != ErrorClosed {
+		t.Errorf("expected %v, got: %v", ErrorClosed, err)
+	}
+}
+
+func TestStoreInvalidTTL(t *testing.T) {
+	t.Parallel()
+	f := newFakeRedis(t)
+	for _, ttl := range []time.Duration{0, -time.Second} {
+		if _, err := New(context.Background(), f.addr(), ttl); !errors.Is(err, ErrorInvalidTTL) {
+			t.Errorf("ttl %v: expected %v, got: %v", ttl, ErrorInvalidTTL, err)
+		}
+	}
+	// a ttl under a second is rounded up rather than sent as EX 0
+	s, err := New(context.Background(), f.addr(), time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	if err := s.Set(randomNeedle(t)); err != nil {
+		t.Fatal(err)
+	}
+	f.mu.Lock()
+	if expected := []string{"EX", "1"}; fmt.Sprint(f.sets) != fmt.Sprint([][]string{expected}) {
+		t.Errorf("expected SET with %v, got %v", expected, f.sets)
+	}
+	f.mu.Unlock()
+}
+
+func TestStoreConcurrent(t *testing.T) {
+	t.Parallel()
+	f := newFakeRedis(t)
+	s, err := New(context.Background(), f.addr(), time.Minute, WithPoolSize(2))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			n := randomNeedle(t)
+			if err := s.Set(n); err != nil {
+				t.Error(err)
+				return
+			}
+			if _, err := s.Get(n.Hash()); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+	if l := len(s.idle); l > 2 {
+		t.Errorf("expected at most 2 idle connections, got %v", l)
+	}
+}
+
+func TestStoreUnreachable(t *testing.T) {
+	t.Parallel()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := ln.Addr().String()
+	ln.Close()
+	if _, err := New(context.Background(), addr, time.Minute, WithTimeout(100*time.Millisecond)); err == nil {
+		t.Error("expected an error connecting to a closed port")
+	}
+
+	// a running store fails operations once redis goes away
+	f := newFakeRedis(t)
+	s, err := New(context.Background(), f.addr(), time.Minute, WithTimeout(100*time.Millisecond))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	f.ln.Close()
+	for _, c := range s.idle {
+		c.Close()
+	}
+	if err := s.Set(randomNeedle(t)); err == nil {
+		t.Error("expected an error once redis is unreachable")
+	}
+	if _, err := s.Get(randomNeedle(t).Hash()); err == nil || errors.Is(err, storage.ErrorNotFound) {
+		t.Errorf("expected a network error, got: %v", err)
+	}
+}
+
+// TestStoreRedis runs against a real Redis server when REDIS_ADDR is set.
+func TestStoreRedis(t *testing.T) {
+	addr := os.Getenv("REDIS_ADDR")
+	if addr == "" {
+		t.Skip("REDIS_ADDR is not set")
+	}
+	t.Parallel()
+	s, err := New(context.Background(), addr, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	n := randomNeedle(t)
+	if err := s.Set(n); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Get(n.Hash()); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(2100 * time.Millisecond)
+	if _, err := s.Get(n.Hash()); !errors.Is(err, ErrorDNE) {
+		t.Errorf("expected %v after the ttl, got: %v", ErrorDNE, err)
+	}
+}
@@ -0,0 +1,135 @@
+// Package shardedmemory is an in memory storage backend that spreads needles across
+// several memory stores by hash, so concurrent Sets and Gets for different needles
+// rarely wait on the same lock.
+package shardedmemory
+
+import (
+	"context"
+	"encoding/binary"
+	"runtime"
+	"time"
+
+	"github.com/nomasters/haystack/needle"
+	"github.com/nomasters/haystack/storage"
+	"github.com/nomasters/haystack/storage/memory"
+)
+
+var (
+	// ErrorStoreFull is returned when the shard for a needle is full. It is the same
+	// value as storage.ErrorFull so callers can check either.
+	ErrorStoreFull = storage.ErrorFull
+	// ErrorDNE is returned when a needle does not exist or has expired. It is the same
+	// value as storage.ErrorNotFound so callers can check either.
+	ErrorDNE = storage.ErrorNotFound
+)
+
+// Store is a struct that holds the sharded memory storage state
+type Store struct {
+	shards []*memory.Store
+}
+
+type options struct {
+	shardCount int
+}
+
+// Option configures optional Store settings
+type Option func(*options)
+
+// WithShardCount sets the number of shards. The default is four per CPU.
+func WithShardCount(n int) Option {
+	return func(o *options) {
+		o.shardCount = n
+	}
+}
+
+// New returns a pointer to a Store that holds needles for ttl. maxItems is divided as
+// evenly as possible between the shards, so together they hold exactly maxItems, and
+// each shard expires its own needles. Since needles are spread by hash, a shard can
+// fill up while others still have room, so Set may return ErrorStoreFull slightly
+// before maxItems needles are held, or well before if maxItems is not much larger
+// than the number of shards.
+func New(ctx context.Context, ttl time.Duration, maxItems int, opts ...Option) *Store {
+	o := options{shardCount: runtime.NumCPU() * 4}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	o.shardCount = max(o.shardCount, 1)
+	maxItems = max(maxItems, 0)
+	s := &Store{shards: make([]*memory.Store, o.shardCount)}
+	for i := range s.shards {
+		perShard := maxItems / o.shardCount
+		if i < maxItems%o.shardCount {
+			perShard++
+		}
+		s.shards[i] = memory.New(ctx, ttl, perShard)
+	}
+	return s
+}
+
+// shard returns the shard that holds hash. Hashes are uniformly distributed, so the
+// first 8 bytes are enough to spread needles evenly.
+func (s *Store) shard(hash needle.Hash) *memory.Store {
+	return s.shards[binary.BigEndian.Uint64(hash[:8])%uint64(len(s.shards))]
+}
+
+// Set takes a needle and writes it to its shard.
+func (s *Store) Set(n *needle.Needle) error {
+	if n == nil {
+		return storage.ErrorNeedleIsNil
+	}
+	return s.shard(n.Hash()).Set(n)
+}
+
+// Get takes a hash and returns a pointer to a needle and an error
+func (s *Store) Get(hash needle.Hash) (*needle.Needle, error) {
+	return s.shard(hash).Get(hash)
+}
+
+// Remaining returns the number of needles that can be Set across all shards before
+// they are full.
+func (s *Store) Remaining() (uint64, bool) {
+	var total uint64
+	for _, shard := range s.shards {
+		n, _ := shard.Remaining()
+		total += n
+	}
+	return total, true
+}
+
+// ForEachNeedle calls fn with every needle that has not expired and its expiration,
+// one shard at a time, stopping early if fn returns false. Each shard is read locked
+// while it is iterated, so fn must not Set on the store.
+func (s *Store) ForEachNeedle(fn func(n *needle.Needle, expiresAt time.Time) bool) error {
+	more := true
+	for _, shard := range s.shards {
+		shard.ForEachNeedle(func(n *needle.Needle, expiresAt time.Time) bool {
+			more = fn(n, expiresAt)
+			return more
+		})
+		if !more {
+			break
+		}
+	}
+	return nil
+}
+
+// Nearest scans every shard for the hash sharing the longest bit prefix with hash.
+// It is intended for debugging.
+func (s *Store) Nearest(hash needle.Hash) (needle.Hash, int, bool) {
+	var nearest needle.Hash
+	best := -1
+	for _, shard := range s.shards {
+		if h, l, ok := shard.Nearest(hash); ok && l > best {
+			nearest, best = h, l
+		}
+	}
+	return nearest, best, best >= 0
+}
+
+// Close stops the cleanup of every shard.
+func (s *Store) Close() error {
+	for _, shard := range s.shards {
+		shard.Close()
+	}
+	return nil
+}
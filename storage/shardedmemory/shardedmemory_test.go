@@ -0,0 +1,163 @@
+package shardedmemory
+
+import (
+	"context"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/nomasters/haystack/needle"
+	"github.com/nomasters/haystack/storage"
+	"github.com/nomasters/haystack/storage/memory"
+)
+
+// randomNeedle returns a needle with a random payload.
+func randomNeedle(t testing.TB) *needle.Needle {
+	t.Helper()
+	p := make([]byte, needle.PayloadLength)
+	rand.Read(p)
+	n, err := needle.New(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return n
+}
+
+func TestStore(t *testing.T) {
+	t.Parallel()
+	s := New(context.Background(), time.Minute, 1000, WithShardCount(8))
+	defer s.Close()
+
+	needles := make([]*needle.Needle, 100)
+	for i := range needles {
+		needles[i] = randomNeedle(t)
+		if err := s.Set(needles[i]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, n := range needles {
+		got, err := s.Get(n.Hash())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got.Payload() != n.Payload() {
+			t.Error("expected the needle that was set")
+		}
+	}
+	used := 0
+	for _, shard := range s.shards {
+		if r, _ := shard.Remaining(); r < 125 {
+			used++
+		}
+	}
+	if used < 2 {
+		t.Errorf("expected needles to be spread across shards, %v shards used", used)
+	}
+	if r, ok := s.Remaining(); !ok || r != 900 {
+		t.Errorf("expected 900 remaining, got %v", r)
+	}
+
+	seen := make(map[needle.Hash]bool)
+	s.ForEachNeedle(func(n *needle.Needle, _ time.Time) bool {
+		seen[n.Hash()] = true
+		return true
+	})
+	if len(seen) != len(needles) {
+		t.Errorf("expected to iterate %v needles, got %v", len(needles), len(seen))
+	}
+	count := 0
+	s.ForEachNeedle(func(*needle.Needle, time.Time) bool {
+		count++
+		return count < 10
+	})
+	if count != 10 {
+		t.Errorf("expected iteration to stop after 10 needles, got %v", count)
+	}
+
+	stored := needles[0].Hash()
+	typo := stored
+	typo[needle.HashLength-1] ^= 1
+	if nearest, _, ok := s.Nearest(typo); !ok || nearest != stored {
+		t.Errorf("expected nearest to be %x, got %x", stored, nearest)
+	}
+
+	if _, err := s.Get(randomNeedle(t).Hash()); !errors.Is(err, storage.ErrorNotFound) {
+		t.Errorf("expected %v, got: %v", storage.ErrorNotFound, err)
+	}
+	if err := s.Set(nil); err != storage.ErrorNeedleIsNil {
+		t.Errorf("expected %v, got: %v", storage.ErrorNeedleIsNil, err)
+	}
+}
+
+func TestStoreFull(t *testing.T) {
+	t.Parallel()
+	s := New(context.Background(), time.Minute, 1, WithShardCount(1))
+	defer s.Close()
+	if err := s.Set(randomNeedle(t)); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Set(randomNeedle(t)); !errors.Is(err, storage.ErrorFull) {
+		t.Errorf("expected %v, got: %v", storage.ErrorFull, err)
+	}
+}
+
+func TestStoreCapacity(t *testing.T) {
+	t.Parallel()
+	for _, test := range []struct {
+		maxItems int
+		opts     []Option
+	}{
+		{maxItems: 10, opts: []Option{WithShardCount(4)}},
+		{maxItems: 10},
+		{maxItems: 1000, opts: []Option{WithShardCount(7)}},
+	} {
+		s := New(context.Background(), time.Minute, test.maxItems, test.opts...)
+		if remaining, _ := s.Remaining(); remaining != uint64(test.maxItems) {
+			t.Errorf("maxItems %v over %v shards: expected %v remaining, got %v", test.maxItems, len(s.shards), test.maxItems, remaining)
+		}
+		s.Close()
+	}
+}
+
+// BenchmarkStore compares a single memory store with a sharded one under parallel
+// Sets and Gets, with the parallelism of a busy server.
+func BenchmarkStore(b *testing.B) {
+	const items = 1 << 16
+	needles := make([]*needle.Needle, 1024)
+	for i := range needles {
+		needles[i] = randomNeedle(b)
+	}
+	for _, store := range []struct {
+		name string
+		new  func() storage.GetSetCloser
+	}{
+		{"memory", func() storage.GetSetCloser { return memory.New(context.Background(), time.Minute, items) }},
+		{"shardedmemory", func() storage.GetSetCloser { return New(context.Background(), time.Minute, items) }},
+	} {
+		for _, parallelism := range []int{1, 16, 64} {
+			b.Run(fmt.Sprintf("%v/parallelism=%v", store.name, parallelism), func(b *testing.B) {
+				s := store.new()
+				defer s.Close()
+				for _, n := range needles {
+					s.Set(n)
+				}
+				b.SetParallelism(parallelism)
+				b.ResetTimer()
+				b.RunParallel(func(pb *testing.PB) {
+					i := 0
+					for pb.Next() {
+						n := needles[i%len(needles)]
+						if i%4 == 0 {
+							s.Set(n)
+						} else if _, err := s.Get(n.Hash()); err != nil {
+							b.Error(err)
+						}
+						i++
+					}
+				})
+			})
+		}
+	}
+}
@@ -7,8 +7,16 @@ import (
 )
 
 var (
-	// ErrorNeedleIsNil is used when the Set method receives a nil pointer
-	ErrorNeedleIsNil = errors.New("Cannot Set a nil *Needle")
+	// ErrorNeedleIsNil is used when the Set method receives a nil pointer. It is the
+	// same value as needle.ErrorNeedleIsNil so callers can check either.
+	ErrorNeedleIsNil = needle.ErrorNeedleIsNil
+	// ErrorNotFound is returned by a Getter when a needle does not exist or has expired.
+	// Every backend returns it, directly or wrapped, so callers can check for a miss with
+	// errors.Is regardless of the backend.
+	ErrorNotFound = errors.New("Does Not Exist")
+	// ErrorFull is returned by a Setter that has no room for another needle. Every
+	// backend returns it, directly or wrapped.
+	ErrorFull = errors.New("Store is full")
 )
 
 // Getter takes a needle.Hash and returns a reference to needle.Needle and an error.
@@ -29,6 +37,20 @@ type Closer interface {
 	Close() error
 }
 
+// NearestFinder takes a needle.Hash and returns the stored hash that shares the longest
+// bit prefix with it, along with the length of that prefix in bits. It is an optional
+// debugging aid for telling a mistyped hash apart from one that was never stored.
+type NearestFinder interface {
+	Nearest(hash needle.Hash) (nearest needle.Hash, prefixBits int, ok bool)
+}
+
+// CapacityReporter returns the number of additional needles a storage can accept and
+// whether that number is known. It lets callers refuse writes ahead of a store filling
+// up instead of failing abruptly once it is full.
+type CapacityReporter interface {
+	Remaining() (items uint64, ok bool)
+}
+
 // GetSetCloser is the primary interface used by the haystack server, it allows for Getting, Setting, and Closings
 type GetSetCloser interface {
 	Getter
@@ -0,0 +1,72 @@
+package storage
+
+import (
+	"sync"
+
+	"github.com/nomasters/haystack/needle"
+)
+
+// Swappable is a GetSetCloser that forwards to a backend which can be replaced while
+// it is in use. A server given a Swappable keeps its listener open while an operator
+// swaps in a freshly prepared or compacted store.
+type Swappable struct {
+	mu      sync.RWMutex
+	backend GetSetCloser
+}
+
+// NewSwappable returns a pointer to a Swappable that starts with backend.
+func NewSwappable(backend GetSetCloser) *Swappable {
+	return &Swappable{backend: backend}
+}
+
+// Swap replaces the backend with next and closes the old one. It waits for operations
+// already using the old backend to finish, and operations that start after it returns
+// use next. The error is from closing the old backend.
+func (s *Swappable) Swap(next GetSetCloser) error {
+	s.mu.Lock()
+	old := s.backend
+	s.backend = next
+	s.mu.Unlock()
+	return old.Close()
+}
+
+// Get forwards to the current backend.
+func (s *Swappable) Get(hash needle.Hash) (*needle.Needle, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.backend.Get(hash)
+}
+
+// Set forwards to the current backend.
+func (s *Swappable) Set(n *needle.Needle) error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.backend.Set(n)
+}
+
+// Close closes the current backend.
+func (s *Swappable) Close() error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.backend.Close()
+}
+
+// Remaining forwards to the current backend if it is a CapacityReporter.
+func (s *Swappable) Remaining() (uint64, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if r, ok := s.backend.(CapacityReporter); ok {
+		return r.Remaining()
+	}
+	return 0, false
+}
+
+// Nearest forwards to the current backend if it is a NearestFinder.
+func (s *Swappable) Nearest(hash needle.Hash) (needle.Hash, int, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if f, ok := s.backend.(NearestFinder); ok {
+		return f.Nearest(hash)
+	}
+	return needle.Hash{}, 0, false
+}
@@ -0,0 +1,89 @@
+package haystack
+
+import (
+	"errors"
+	"fmt"
+	"net"
+
+	"github.com/nomasters/haystack/needle"
+	"github.com/nomasters/haystack/x/frame"
+)
+
+// ErrUnknownNetwork is returned by NewClient when WithNetwork is given a network other
+// than "udp" or "tcp"
+var ErrUnknownNetwork = errors.New("Unknown network")
+
+// WithNetwork sets the transport used to reach the server, either "udp", the default,
+// or "tcp" for a server started with server.ListenAndServeTCP. Over TCP each request
+// and response is sent as a frame from the x/frame package, which the client converts
+// to and from datagrams, so every method works as it does over UDP. Each operation
+// still opens its own connection, so TCP adds a handshake to every Get. Misses are not
+// answered over TCP either, so a Get for a needle the server does not hold waits for
+// its context to be done. If WithDialer is also set, the dialer is called with the
+// network and must return a stream connection.
+func WithNetwork(network string) option {
+	return func(o *options) {
+		o.network = network
+	}
+}
+
+// frameConn adapts a stream connection to the message per Write and Read semantics the
+// client expects of a datagram socket.
+type frameConn struct {
+	net.Conn
+	dec *frame.Decoder
+}
+
+func newFrameConn(conn net.Conn) *frameConn {
+	return &frameConn{Conn: conn, dec: frame.NewDecoder(conn)}
+}
+
+// Write sends b as an OpGet frame if it is a hash, as one OpSet frame per needle if it
+// holds needles, or as OpPing if it is a PING, padded or not. The frames are written
+// with a single call so they do not interleave with those of concurrent writers.
+func (f *frameConn) Write(b []byte) (int, error) {
+	var op frame.Op
+	var l int
+	switch {
+	case isPing(b):
+		if err := frame.Encode(f.Conn, frame.OpPing, nil); err != nil {
+			return 0, err
+		}
+		return len(b), nil
+	case len(b) == needle.HashLength:
+		op, l = frame.OpGet, needle.HashLength
+	case len(b) > 0 && len(b)%needle.NeedleLength == 0:
+		op, l = frame.OpSet, needle.NeedleLength
+	default:
+		return 0, fmt.Errorf("%w: %d", frame.ErrorBodyLength, len(b))
+	}
+	buf := make([]byte, 0, len(b)+len(b)/l)
+	for i := 0; i < len(b); i += l {
+		buf = append(buf, byte(op))
+		buf = append(buf, b[i:i+l]...)
+	}
+	if _, err := f.Conn.Write(buf); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+// Read reads the body of the next OpNeedle or OpAck frame into b, truncating it if b
+// is too small as a datagram read would. OpPong is read as the pong datagram, pongPrefix
+// followed by the server time. Other frames carry nothing the client waits for and are
+// skipped.
+func (f *frameConn) Read(b []byte) (int, error) {
+	for {
+		op, body, err := f.dec.Decode()
+		if err != nil {
+			return 0, err
+		}
+		switch op {
+		case frame.OpNeedle, frame.OpAck:
+			return copy(b, body), nil
+		case frame.OpPong:
+			n := copy(b, pongPrefix)
+			return n + copy(b[n:], body), nil
+		}
+	}
+}
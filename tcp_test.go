@@ -0,0 +1,119 @@
+package haystack
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/nomasters/haystack/needle"
+	"github.com/nomasters/haystack/x/udp/server"
+)
+
+func TestClientTCP(t *testing.T) {
+	t.Parallel()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() {
+		done <- server.Serve(server.NewListenerSource(ln), server.WithContext(ctx), server.WithAckSet())
+	}()
+	defer func() {
+		cancel()
+		if err := <-done; err != nil {
+			t.Error(err)
+		}
+	}()
+
+	for name, opts := range map[string][]option{
+		"dial per operation": nil,
+		"multiplex":          {WithMultiplex()},
+	} {
+		t.Run(name, func(t *testing.T) {
+			c, err := NewClient(ln.Addr().String(), append(opts, WithNetwork("tcp"))...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer c.Close()
+			// each Poll attempt dials a new connection, so allow for a slow machine
+			ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+			defer cancel()
+
+			needles := needle.NewDeterministic(8, 3)
+			if err := c.SetAck(ctx, needles[0]); err != nil {
+				t.Fatal(err)
+			}
+			h := needles[0].Hash()
+			if _, err := c.GetContext(ctx, &h); err != nil {
+				t.Fatal(err)
+			}
+			if err := c.Set(needles[1]); err != nil {
+				t.Fatal(err)
+			}
+			if err := c.BatchSet(ctx, needles[2:]); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := c.Ping(ctx); err != nil {
+				t.Fatal(err)
+			}
+			// Set and BatchSet are not acknowledged, so poll for them
+			for _, n := range needles[1:] {
+				h := n.Hash()
+				got, err := c.Poll(ctx, &h)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if got.Hash() != h {
+					t.Errorf("expected %x, got %x", h, got.Hash())
+				}
+			}
+		})
+	}
+
+	if _, err := NewClient(ln.Addr().String(), WithNetwork("sctp")); !errors.Is(err, ErrUnknownNetwork) {
+		t.Errorf("expected %v, got: %v", ErrUnknownNetwork, err)
+	}
+}
+
+// TestClientTCPHangUp checks that a multiplexed client fails pending GETs once the
+// server closes the connection instead of waiting for their deadlines.
+func TestClientTCPHangUp(t *testing.T) {
+	t.Parallel()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		// wait for the first request, then hang up
+		conn.Read(make([]byte, 1))
+		conn.Close()
+	}()
+
+	c, err := NewClient(ln.Addr().String(), WithNetwork("tcp"), WithMultiplex())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	h := needle.NewDeterministic(9, 1)[0].Hash()
+	start := time.Now()
+	// the hang up reads as EOF or a reset, depending on whether the request was read
+	for i := 0; i < 2; i++ {
+		if _, err := c.GetContext(ctx, &h); err == nil || errors.Is(err, ErrTimeout) {
+			t.Errorf("expected GET %d to fail with a connection error, got: %v", i, err)
+		}
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("expected GETs to fail once the server hung up, took %v", elapsed)
+	}
+}
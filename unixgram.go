@@ -0,0 +1,42 @@
+package haystack
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"net"
+	"os"
+	"path/filepath"
+)
+
+// DialUnixgram connects to the haystack server listening on the unix datagram socket
+// at address. It has the signature of net.Dialer.DialContext and ignores network, so
+// it can be passed to WithDialer to run the client over a unix socket instead of UDP.
+// Since a unix datagram socket can only receive replies once it is bound to a path,
+// each connection is bound to a unique path in os.TempDir that is removed when the
+// connection is closed.
+func DialUnixgram(ctx context.Context, network, address string) (net.Conn, error) {
+	b := make([]byte, 8)
+	rand.Read(b)
+	path := filepath.Join(os.TempDir(), "haystack-"+hex.EncodeToString(b)+".sock")
+	d := net.Dialer{LocalAddr: &net.UnixAddr{Name: path, Net: "unixgram"}}
+	conn, err := d.DialContext(ctx, "unixgram", address)
+	if err != nil {
+		// the socket may have been bound to path before the dial failed
+		os.Remove(path)
+		return nil, err
+	}
+	return &unixgramConn{Conn: conn, path: path}, nil
+}
+
+// unixgramConn removes the path its socket is bound to when it is closed.
+type unixgramConn struct {
+	net.Conn
+	path string
+}
+
+func (u *unixgramConn) Close() error {
+	err := u.Conn.Close()
+	os.Remove(u.path)
+	return err
+}
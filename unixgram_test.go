@@ -0,0 +1,75 @@
+package haystack
+
+import (
+	"context"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/nomasters/haystack/needle"
+	"github.com/nomasters/haystack/x/udp/server"
+)
+
+func TestClientUnixgram(t *testing.T) {
+	t.Parallel()
+	path := filepath.Join(t.TempDir(), "haystack.sock")
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: path, Net: "unixgram"})
+	if err != nil {
+		t.Skip("unix datagram sockets are not supported:", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() {
+		done <- server.Serve(server.NewPacketConnSource(conn), server.WithContext(ctx), server.WithAckSet())
+	}()
+	defer func() {
+		cancel()
+		if err := <-done; err != nil {
+			t.Error(err)
+		}
+	}()
+
+	for name, opts := range map[string][]option{
+		"dial per operation": nil,
+		"multiplex":          {WithMultiplex()},
+	} {
+		t.Run(name, func(t *testing.T) {
+			c, err := NewClient(path, append(opts, WithDialer(DialUnixgram))...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer c.Close()
+			ctx, cancel := context.WithTimeout(ctx, time.Second)
+			defer cancel()
+
+			for _, n := range needle.NewDeterministic(7, 3) {
+				if err := c.SetAck(ctx, n); err != nil {
+					t.Fatal(err)
+				}
+				h := n.Hash()
+				got, err := c.GetContext(ctx, &h)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if got.Hash() != h {
+					t.Errorf("expected %x, got %x", h, got.Hash())
+				}
+			}
+		})
+	}
+}
+
+// TestDialUnixgramCleanup checks that a failed dial does not leave its socket behind.
+// It sets TMPDIR, so it cannot run in parallel.
+func TestDialUnixgramCleanup(t *testing.T) {
+	dir := t.TempDir()
+	t.Setenv("TMPDIR", dir)
+	if _, err := DialUnixgram(context.Background(), "unixgram", filepath.Join(dir, "missing.sock")); err == nil {
+		t.Fatal("expected dialing a missing socket to fail")
+	}
+	if entries, _ := os.ReadDir(dir); len(entries) != 0 {
+		t.Errorf("expected the local socket to be removed, found %v", entries[0].Name())
+	}
+}
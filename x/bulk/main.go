@@ -2,6 +2,7 @@ package main
 
 import (
 	"crypto/rand"
+	"flag"
 	"fmt"
 	"runtime"
 	"sync"
@@ -21,8 +22,10 @@ type task struct {
 var procs = runtime.NumCPU()
 
 func main() {
+	seed := flag.Uint64("seed", 0, "generate the needles from this seed so runs are reproducible, 0 for random needles")
+	flag.Parse()
 
-	client, err := haystack.NewClient("127.0.0.1:1337")
+	client, err := haystack.NewClient("127.0.0.1:1337", haystack.WithMetrics())
 	if err != nil {
 		fmt.Println(err)
 		return
@@ -42,15 +45,20 @@ func main() {
 	reqCount := 10000
 	randReq := make([][]byte, reqCount)
 
-	for i := 0; i < reqCount; i++ {
-		p := make([]byte, 160)
-		rand.Read(p)
-		n, err := needle.New(p)
-		if err != nil {
-			fmt.Println(err)
+	if *seed != 0 {
+		for i, n := range needle.NewDeterministic(*seed, reqCount) {
+			randReq[i] = n.Bytes()
+		}
+	} else {
+		for i := 0; i < reqCount; i++ {
+			p := make([]byte, needle.PayloadLength)
+			rand.Read(p)
+			n, err := needle.New(p)
+			if err != nil {
+				fmt.Println(err)
+			}
+			randReq[i] = n.Bytes()
 		}
-		randReq[i] = n.Bytes()
-
 	}
 
 	// hash, _ := hex.DecodeString("b4c2d91741ae9e73141e58169141ce0b45b61855e5185b9ae308779dd9720788")
@@ -70,6 +78,8 @@ func main() {
 	t2 := time.Now()
 	d := t2.Sub(t1)
 	fmt.Println("count:", counter, float64(reqCount)/d.Seconds())
+	m := client.Metrics().Set
+	fmt.Println("set latency p50:", m.P50, "p90:", m.P90, "p99:", m.P99, "errors:", m.Errors)
 }
 
 func worker(job chan task, client *haystack.Client) {
@@ -26,7 +26,7 @@ func main() {
 		fmt.Println(err)
 	}
 	var h needle.Hash
-	copy(h[:], b[:32])
+	copy(h[:], b[:needle.HashLength])
 	n2, err := client.Get(&h)
 	if err != nil {
 		fmt.Println(err)
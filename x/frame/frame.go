@@ -0,0 +1,144 @@
+// Package frame encodes haystack requests and responses for stream transports such as
+// TCP. A datagram carries exactly one message, so its length identifies it, but a
+// stream may deliver a message in pieces or several at once. Each frame therefore
+// starts with a one byte Op that determines the fixed length of the body that follows.
+package frame
+
+import (
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/nomasters/haystack/needle"
+)
+
+// Op identifies the kind of message in a frame.
+type Op byte
+
+const (
+	// OpGet requests the needle for a hash. The body is the hash.
+	OpGet Op = iota + 1
+	// OpSet stores a needle. The body is the needle.
+	OpSet
+	// OpExists asks whether a needle is stored without transferring it. The body is the hash.
+	OpExists
+	// OpPing checks that the peer is responsive. It has no body.
+	OpPing
+	// OpNeedle answers OpGet with the needle. The body is the needle.
+	OpNeedle
+	// OpAck answers OpSet or a successful OpExists. The body is the hash.
+	OpAck
+	// OpMiss answers OpGet or OpExists for a needle that is not stored. It has no body.
+	OpMiss
+	// OpPong answers OpPing. The body is the clock of the peer that answered as 8 byte
+	// big endian unix nanoseconds.
+	OpPong
+)
+
+// timeLength is the length of a unix nanosecond timestamp in an OpPong body.
+const timeLength = 8
+
+var (
+	// ErrorUnknownOp is returned when a frame starts with a byte that is not an Op
+	ErrorUnknownOp = errors.New("Unknown op")
+	// ErrorBodyLength is returned by Encode when the body does not match the length of the Op
+	ErrorBodyLength = errors.New("Invalid body length for op")
+)
+
+// BodyLength returns the number of body bytes that follow o, or false if o is unknown.
+func (o Op) BodyLength() (int, bool) {
+	switch o {
+	case OpGet, OpExists, OpAck:
+		return needle.HashLength, true
+	case OpSet, OpNeedle:
+		return needle.NeedleLength, true
+	case OpPong:
+		return timeLength, true
+	case OpPing, OpMiss:
+		return 0, true
+	default:
+		return 0, false
+	}
+}
+
+// String returns the lower case name of the op.
+func (o Op) String() string {
+	switch o {
+	case OpGet:
+		return "get"
+	case OpSet:
+		return "set"
+	case OpExists:
+		return "exists"
+	case OpPing:
+		return "ping"
+	case OpNeedle:
+		return "needle"
+	case OpAck:
+		return "ack"
+	case OpMiss:
+		return "miss"
+	case OpPong:
+		return "pong"
+	default:
+		return fmt.Sprintf("op(%d)", byte(o))
+	}
+}
+
+// Encode writes op and body to w as a single frame with one call to Write, so frames
+// from concurrent callers do not interleave on writers that serialize Write calls.
+func Encode(w io.Writer, op Op, body []byte) error {
+	l, ok := op.BodyLength()
+	if !ok {
+		return fmt.Errorf("%w: %v", ErrorUnknownOp, op)
+	}
+	if len(body) != l {
+		return fmt.Errorf("%w %v: %d", ErrorBodyLength, op, len(body))
+	}
+	var buf [1 + needle.NeedleLength]byte
+	buf[0] = byte(op)
+	copy(buf[1:], body)
+	n, err := w.Write(buf[:1+l])
+	if err != nil {
+		return err
+	}
+	if n != 1+l {
+		return io.ErrShortWrite
+	}
+	return nil
+}
+
+// Decoder reads frames from a stream, assembling each one from as many reads as it
+// takes to arrive.
+type Decoder struct {
+	r   io.Reader
+	buf [1 + needle.NeedleLength]byte
+}
+
+// NewDecoder returns a pointer to a Decoder reading from r.
+func NewDecoder(r io.Reader) *Decoder {
+	return &Decoder{r: r}
+}
+
+// Decode reads the next frame and returns its op and body. The body is only valid until
+// the next call to Decode. At the end of the stream Decode returns io.EOF if it falls
+// between frames and io.ErrUnexpectedEOF if a frame was cut short. An unknown op
+// returns ErrorUnknownOp, after which the stream cannot be resynchronized.
+func (d *Decoder) Decode() (Op, []byte, error) {
+	if _, err := io.ReadFull(d.r, d.buf[:1]); err != nil {
+		return 0, nil, err
+	}
+	op := Op(d.buf[0])
+	l, ok := op.BodyLength()
+	if !ok {
+		return 0, nil, fmt.Errorf("%w: %v", ErrorUnknownOp, op)
+	}
+	body := d.buf[1 : 1+l]
+	if _, err := io.ReadFull(d.r, body); err != nil {
+		if errors.Is(err, io.EOF) {
+			err = io.ErrUnexpectedEOF
+		}
+		return 0, nil, err
+	}
+	return op, body, nil
+}
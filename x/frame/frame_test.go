@@ -0,0 +1,98 @@
+package frame
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"io"
+	"testing"
+	"testing/iotest"
+
+	"github.com/nomasters/haystack/needle"
+)
+
+// frames returns a stream holding one frame of every op, along with the ops and bodies.
+func frames(t *testing.T) ([]byte, []Op, [][]byte) {
+	t.Helper()
+	var stream bytes.Buffer
+	var ops []Op
+	var bodies [][]byte
+	for op := OpGet; op <= OpPong; op++ {
+		l, _ := op.BodyLength()
+		body := make([]byte, l)
+		rand.Read(body)
+		if err := Encode(&stream, op, body); err != nil {
+			t.Fatal(err)
+		}
+		ops = append(ops, op)
+		bodies = append(bodies, body)
+	}
+	return stream.Bytes(), ops, bodies
+}
+
+func TestDecode(t *testing.T) {
+	t.Parallel()
+	stream, ops, bodies := frames(t)
+	for name, r := range map[string]func(io.Reader) io.Reader{
+		"whole":    func(r io.Reader) io.Reader { return r },
+		"one byte": iotest.OneByteReader,
+		"halves":   iotest.HalfReader,
+		"data err": iotest.DataErrReader,
+	} {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+			d := NewDecoder(r(bytes.NewReader(stream)))
+			for i := range ops {
+				op, body, err := d.Decode()
+				if err != nil {
+					t.Fatalf("frame %v: %v", i, err)
+				}
+				if op != ops[i] || !bytes.Equal(body, bodies[i]) {
+					t.Errorf("frame %v: expected %v %x, got %v %x", i, ops[i], bodies[i], op, body)
+				}
+			}
+			if _, _, err := d.Decode(); err != io.EOF {
+				t.Errorf("expected io.EOF between frames, got: %v", err)
+			}
+		})
+	}
+}
+
+func TestDecodeErrors(t *testing.T) {
+	t.Parallel()
+	var set bytes.Buffer
+	Encode(&set, OpSet, make([]byte, needle.NeedleLength))
+
+	for _, test := range []struct {
+		description string
+		stream      []byte
+		err         error
+	}{
+		{description: "cut inside body", stream: set.Bytes()[:100], err: io.ErrUnexpectedEOF},
+		{description: "op without body", stream: set.Bytes()[:1], err: io.ErrUnexpectedEOF},
+		{description: "unknown op", stream: []byte{0xff}, err: ErrorUnknownOp},
+		{description: "zero op", stream: []byte{0}, err: ErrorUnknownOp},
+	} {
+		d := NewDecoder(iotest.OneByteReader(bytes.NewReader(test.stream)))
+		if _, _, err := d.Decode(); !errors.Is(err, test.err) {
+			t.Errorf("%v: expected %v, got: %v", test.description, test.err, err)
+		}
+	}
+}
+
+func TestEncode(t *testing.T) {
+	t.Parallel()
+	var b bytes.Buffer
+	if err := Encode(&b, OpGet, make([]byte, needle.NeedleLength)); !errors.Is(err, ErrorBodyLength) {
+		t.Errorf("expected ErrorBodyLength, got: %v", err)
+	}
+	if err := Encode(&b, Op(0), nil); !errors.Is(err, ErrorUnknownOp) {
+		t.Errorf("expected ErrorUnknownOp, got: %v", err)
+	}
+	if b.Len() != 0 {
+		t.Errorf("expected nothing written for invalid frames, got %v bytes", b.Len())
+	}
+	if err := Encode(&b, OpPing, nil); err != nil || !bytes.Equal(b.Bytes(), []byte{byte(OpPing)}) {
+		t.Errorf("expected a single op byte for ping, got %x, %v", b.Bytes(), err)
+	}
+}
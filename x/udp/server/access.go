@@ -0,0 +1,83 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/nomasters/haystack/needle"
+	"github.com/nomasters/haystack/storage"
+)
+
+// WithAccessLog logs every request at info level as a line of key=value fields: the
+// operation (get, set, batch, ping or invalid), the result (hit, miss, stored, rejected,
+// pong, dropped, limited or error), the source address and how long it took to handle. The
+// needle hash is only logged when logHashes is true, since a log of which needles were
+// requested reveals more about clients than haystack otherwise keeps.
+func WithAccessLog(logHashes bool) Option {
+	return func(svr *server) error {
+		svr.accessLog = true
+		svr.logHashes = logHashes
+		return nil
+	}
+}
+
+// accessOp names the operation of a request by its length, as processRequest does.
+func accessOp(body []byte) string {
+	switch l := len(body); {
+	case isPing(body):
+		return "ping"
+	case l == needle.HashLength:
+		return "get"
+	case l == needle.NeedleLength:
+		return "set"
+	case l > needle.NeedleLength && l%needle.NeedleLength == 0 && l/needle.NeedleLength <= needle.MaxBatchCount:
+		return "batch"
+	default:
+		return "invalid"
+	}
+}
+
+// accessResult describes the outcome of a request handled with err.
+func accessResult(body []byte, err error) string {
+	switch op := accessOp(body); {
+	case op == "invalid":
+		return "dropped"
+	case op == "ping":
+		return "pong"
+	case op == "get" && err == nil:
+		return "hit"
+	case op == "get" && errors.Is(err, storage.ErrorNotFound):
+		return "miss"
+	case op == "get":
+		return "error"
+	case err == nil:
+		return "stored"
+	default:
+		return "rejected"
+	}
+}
+
+// logAccess writes the access log line for a request.
+func (s *server) logAccess(body []byte, addr net.Addr, result string, d time.Duration) {
+	op := accessOp(body)
+	source := "-"
+	if addr != nil {
+		source = addr.String()
+	}
+	var b strings.Builder
+	fmt.Fprintf(&b, "access op=%s result=%s source=%s duration=%v", op, result, source, d)
+	if s.logHashes && op != "invalid" && op != "ping" {
+		b.WriteString(" hash=")
+		// a batch logs the hash of each of its needles
+		for i := 0; i < len(body); i += needle.NeedleLength {
+			if i > 0 {
+				b.WriteByte(',')
+			}
+			fmt.Fprintf(&b, "%x", body[i:i+needle.HashLength])
+		}
+	}
+	s.logger.Info(b.String())
+}
@@ -0,0 +1,70 @@
+package server
+
+import (
+	"fmt"
+	"net"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+func TestAccessLog(t *testing.T) {
+	t.Parallel()
+	addr := &net.UDPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 4000}
+	n := randomNeedle(t)
+	hash := n.Hash()
+	for _, logHashes := range []bool{false, true} {
+		t.Run(fmt.Sprintf("log hashes %v", logHashes), func(t *testing.T) {
+			t.Parallel()
+			l := new(captureLogger)
+			s := newTestServer(t, WithAccessLog(logHashes))
+			s.logger = l
+			s.processRequest(n.Bytes(), addr)
+			s.processRequest(hash[:], addr)
+			missing := randomNeedle(t).Hash()
+			s.processRequest(missing[:], nil)
+			s.processRequest([]byte{1, 2, 3}, addr)
+			s.processRequest([]byte{pingRequest}, addr)
+
+			expected := []string{
+				"access op=set result=stored source=192.0.2.1:4000 duration=",
+				"access op=get result=hit source=192.0.2.1:4000 duration=",
+				"access op=get result=miss source=- duration=",
+				"access op=invalid result=dropped source=192.0.2.1:4000 duration=",
+				"access op=ping result=pong source=192.0.2.1:4000 duration=",
+			}
+			messages := l.Messages()
+			if len(messages) != len(expected) {
+				t.Fatalf("expected %v log messages, got: %v", len(expected), messages)
+			}
+			hashes := []string{fmt.Sprintf("%x", hash), fmt.Sprintf("%x", hash), fmt.Sprintf("%x", missing), "", ""}
+			for i, m := range messages {
+				if !strings.HasPrefix(m, expected[i]) {
+					t.Errorf("expected a message starting with %q, got %q", expected[i], m)
+				}
+				if !regexp.MustCompile(`duration=[0-9.]+[µnm]?s`).MatchString(m) {
+					t.Errorf("expected a duration in %q", m)
+				}
+				logged := strings.Contains(m, "hash=")
+				if logged != (logHashes && hashes[i] != "") || (logged && !strings.HasSuffix(m, "hash="+hashes[i])) {
+					t.Errorf("unexpected hash logging in %q", m)
+				}
+			}
+		})
+	}
+}
+
+func TestAccessLogRateLimited(t *testing.T) {
+	t.Parallel()
+	l := new(captureLogger)
+	s := newTestServer(t, WithAccessLog(false), WithRateLimit(1, 1))
+	s.logger = l
+	addr := &net.UDPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 4000}
+	hash := randomNeedle(t).Hash()
+	s.processRequest(hash[:], addr)
+	s.processRequest(hash[:], addr)
+	messages := l.Messages()
+	if len(messages) != 2 || !strings.HasPrefix(messages[1], "access op=get result=limited") {
+		t.Errorf("expected the second GET to be logged as limited, got: %v", messages)
+	}
+}
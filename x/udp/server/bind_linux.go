@@ -0,0 +1,9 @@
+package server
+
+import "syscall"
+
+// bindToDevice restricts the socket fd to the network interface named iface.
+// Binding to a device usually requires CAP_NET_RAW.
+func bindToDevice(fd uintptr, iface string) error {
+	return syscall.SetsockoptString(int(fd), syscall.SOL_SOCKET, syscall.SO_BINDTODEVICE, iface)
+}
@@ -0,0 +1,10 @@
+//go:build !linux
+
+package server
+
+import "errors"
+
+// bindToDevice is only supported on linux.
+func bindToDevice(fd uintptr, iface string) error {
+	return errors.New("binding to a network interface is not supported on this platform")
+}
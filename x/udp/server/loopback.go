@@ -0,0 +1,66 @@
+package server
+
+import (
+	"context"
+	"net"
+)
+
+// Loopback is an in-process server reached through net.Pipe connections instead of a
+// UDP socket. Requests are handled exactly as ListenAndServe handles them, so client
+// benchmarks can measure client CPU cost without kernel UDP overhead or socket limits.
+// As with UDP, a GET that misses receives no response.
+type Loopback struct {
+	s *server
+}
+
+// NewLoopback returns a pointer to a Loopback configured with opts. The address and
+// worker count options have no effect since each connection is served by its own
+// goroutine.
+func NewLoopback(opts ...Option) (*Loopback, error) {
+	s, err := newServer("", opts...)
+	if err != nil {
+		return nil, err
+	}
+	s.startMirror()
+	return &Loopback{s: s}, nil
+}
+
+// Dial returns a connection to the loopback server. It has the signature of
+// net.Dialer.DialContext and ignores network and address.
+func (l *Loopback) Dial(ctx context.Context, network, address string) (net.Conn, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	client, conn := net.Pipe()
+	go l.serve(conn)
+	return client, nil
+}
+
+// Close closes the storage used by the loopback server.
+func (l *Loopback) Close() error {
+	return l.s.closeStorage()
+}
+
+// serve handles each write to conn as a single request until conn is closed.
+func (l *Loopback) serve(conn net.Conn) {
+	defer conn.Close()
+	buf := make([]byte, maxRequestLength)
+	for {
+		n, err := conn.Read(buf)
+		if err != nil {
+			return
+		}
+		resp, err := l.s.processRequest(buf[:n], conn.RemoteAddr())
+		if resp == nil {
+			continue
+		}
+		_, err = conn.Write(resp)
+		if err == nil && l.s.metrics != nil {
+			l.s.metrics.response(len(resp))
+		}
+		putResponse(resp)
+		if err != nil {
+			return
+		}
+	}
+}
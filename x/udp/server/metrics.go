@@ -0,0 +1,166 @@
+package server
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// windowBuckets is the number of time buckets a sliding window is divided into.
+const windowBuckets = 60
+
+// Metrics holds counters for a running server. It is safe for concurrent use and is
+// passed to the server with WithMetrics so callers can read the counters at any time.
+type Metrics struct {
+	hits        atomic.Uint64
+	misses      atomic.Uint64
+	mirrorDrops atomic.Uint64
+	invalid     atomic.Uint64
+	timeouts    atomic.Uint64
+	rateLimited atomic.Uint64
+	gets        atomic.Uint64
+	sets        atomic.Uint64
+	invalidReqs atomic.Uint64
+	respBytes   atomic.Uint64
+
+	width   int64 // nanoseconds per bucket, zero when the window is disabled
+	buckets [windowBuckets]bucket
+	now     func() time.Time
+}
+
+// bucket counts hits and misses for a single slice of the sliding window.
+type bucket struct {
+	epoch  atomic.Int64
+	hits   atomic.Uint64
+	misses atomic.Uint64
+}
+
+// Snapshot is a point in time copy of the values in Metrics.
+type Snapshot struct {
+	// Gets and Sets count GET and SET requests. A datagram holding a batch of needles
+	// counts as a single SET.
+	Gets   uint64
+	Sets   uint64
+	Hits   uint64
+	Misses uint64
+	// WindowHits and WindowMisses only count GETs within the sliding window.
+	WindowHits   uint64
+	WindowMisses uint64
+	// WindowHitRatio is WindowHits / (WindowHits + WindowMisses), or zero if there were no GETs.
+	WindowHitRatio float64
+	// MirrorDrops counts stored needles that were not mirrored because the queue was full.
+	MirrorDrops uint64
+	// InvalidHashes counts SET needles rejected because the hash did not match the payload.
+	InvalidHashes uint64
+	// StorageTimeouts counts storage operations abandoned after the handler timeout.
+	StorageTimeouts uint64
+	// RateLimited counts requests dropped because their source exceeded the rate limit.
+	RateLimited uint64
+	// InvalidRequests counts requests dropped because of their length.
+	InvalidRequests uint64
+	// ResponseBytes counts the bytes of every response sent.
+	ResponseBytes uint64
+}
+
+// NewMetrics returns a pointer to Metrics. If window is greater than zero, the GET hit
+// ratio is also tracked over a sliding window of that duration, which reflects recent
+// cache effectiveness better than the cumulative counters.
+func NewMetrics(window time.Duration) *Metrics {
+	m := &Metrics{now: time.Now}
+	if window > 0 {
+		m.width = max(int64(window/windowBuckets), 1)
+	}
+	return m
+}
+
+// Snapshot returns a copy of the current values.
+func (m *Metrics) Snapshot() Snapshot {
+	s := Snapshot{
+		Hits:            m.hits.Load(),
+		Misses:          m.misses.Load(),
+		MirrorDrops:     m.mirrorDrops.Load(),
+		InvalidHashes:   m.invalid.Load(),
+		StorageTimeouts: m.timeouts.Load(),
+		RateLimited:     m.rateLimited.Load(),
+		Gets:            m.gets.Load(),
+		Sets:            m.sets.Load(),
+		InvalidRequests: m.invalidReqs.Load(),
+		ResponseBytes:   m.respBytes.Load(),
+	}
+	if m.width == 0 {
+		return s
+	}
+	current := m.now().UnixNano() / m.width
+	for i := range m.buckets {
+		b := &m.buckets[i]
+		if current-b.epoch.Load() < windowBuckets {
+			s.WindowHits += b.hits.Load()
+			s.WindowMisses += b.misses.Load()
+		}
+	}
+	if total := s.WindowHits + s.WindowMisses; total > 0 {
+		s.WindowHitRatio = float64(s.WindowHits) / float64(total)
+	}
+	return s
+}
+
+func (m *Metrics) hit() {
+	m.hits.Add(1)
+	if b := m.bucket(); b != nil {
+		b.hits.Add(1)
+	}
+}
+
+func (m *Metrics) miss() {
+	m.misses.Add(1)
+	if b := m.bucket(); b != nil {
+		b.misses.Add(1)
+	}
+}
+
+func (m *Metrics) mirrorDrop() {
+	m.mirrorDrops.Add(1)
+}
+
+func (m *Metrics) invalidHash() {
+	m.invalid.Add(1)
+}
+
+func (m *Metrics) storageTimeout() {
+	m.timeouts.Add(1)
+}
+
+func (m *Metrics) rateLimit() {
+	m.rateLimited.Add(1)
+}
+
+func (m *Metrics) get() {
+	m.gets.Add(1)
+}
+
+func (m *Metrics) set() {
+	m.sets.Add(1)
+}
+
+func (m *Metrics) invalidRequest() {
+	m.invalidReqs.Add(1)
+}
+
+func (m *Metrics) response(n int) {
+	m.respBytes.Add(uint64(n))
+}
+
+// bucket returns the bucket for the current time, resetting it first if it still
+// holds counts from a previous trip around the ring. Increments racing with a reset
+// may be lost, which is an acceptable error for a sliding window estimate.
+func (m *Metrics) bucket() *bucket {
+	if m.width == 0 {
+		return nil
+	}
+	epoch := m.now().UnixNano() / m.width
+	b := &m.buckets[epoch%windowBuckets]
+	if old := b.epoch.Load(); old != epoch && b.epoch.CompareAndSwap(old, epoch) {
+		b.hits.Store(0)
+		b.misses.Store(0)
+	}
+	return b
+}
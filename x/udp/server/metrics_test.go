@@ -0,0 +1,60 @@
+package server
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestMetrics(t *testing.T) {
+	t.Parallel()
+	t.Run("cumulative", func(t *testing.T) {
+		t.Parallel()
+		m := NewMetrics(0)
+		s := newTestServer(t, WithMetrics(m))
+		n := randomNeedle(t)
+		hash := n.Hash()
+		s.processRequest(hash[:], nil)
+		s.processRequest(n.Bytes(), nil)
+		s.processRequest(hash[:], nil)
+		s.processRequest(hash[:], &net.UDPAddr{})
+
+		snap := m.Snapshot()
+		if snap.Hits != 2 || snap.Misses != 1 {
+			t.Errorf("expected 2 hits and 1 miss, got: %+v", snap)
+		}
+		if snap.WindowHits != 0 || snap.WindowMisses != 0 {
+			t.Errorf("expected window to be disabled, got: %+v", snap)
+		}
+	})
+	t.Run("sliding window", func(t *testing.T) {
+		t.Parallel()
+		now := time.Unix(0, 0)
+		m := NewMetrics(time.Minute)
+		m.now = func() time.Time { return now }
+
+		for i := 0; i < 3; i++ {
+			m.miss()
+		}
+		now = now.Add(30 * time.Second)
+		m.hit()
+		if snap := m.Snapshot(); snap.WindowHits != 1 || snap.WindowMisses != 3 || snap.WindowHitRatio != 0.25 {
+			t.Errorf("unexpected window: %+v", snap)
+		}
+
+		// the misses fall out of the window while the hit remains
+		now = now.Add(45 * time.Second)
+		if snap := m.Snapshot(); snap.WindowHits != 1 || snap.WindowMisses != 0 || snap.WindowHitRatio != 1 {
+			t.Errorf("unexpected window after rotation: %+v", snap)
+		}
+		if snap := m.Snapshot(); snap.Hits != 1 || snap.Misses != 3 {
+			t.Errorf("cumulative counters changed after rotation: %+v", snap)
+		}
+
+		now = now.Add(2 * time.Minute)
+		m.hit()
+		if snap := m.Snapshot(); snap.WindowHits != 1 || snap.WindowMisses != 0 {
+			t.Errorf("expected only the latest hit in the window: %+v", snap)
+		}
+	})
+}
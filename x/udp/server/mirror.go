@@ -0,0 +1,101 @@
+package server
+
+import (
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	"github.com/nomasters/haystack/needle"
+	"github.com/nomasters/haystack/storage"
+)
+
+const (
+	defaultMirrorQueueSize = 1024
+	mirrorLogInterval      = 10 * time.Second
+)
+
+// mirror copies stored needles to a secondary storage.Setter from a bounded queue, so a
+// slow mirror never delays the primary store.
+type mirror struct {
+	setter  storage.Setter
+	queue   chan *needle.Needle
+	dropped atomic.Uint64
+	done    chan struct{}
+	// started is set once runMirror is running, so closeStorage only waits for it then.
+	started bool
+}
+
+// WithMirror makes the server also write every stored SET to m, such as a second store
+// on another disk for live backup. Writes to m happen asynchronously through a queue of
+// queueSize needles; when it is full the needle is dropped from the mirror only, which
+// is counted in Metrics and logged. A queueSize of zero uses a default of 1024. The
+// server does not close m.
+func WithMirror(m storage.Setter, queueSize int) Option {
+	if queueSize <= 0 {
+		queueSize = defaultMirrorQueueSize
+	}
+	return func(svr *server) error {
+		svr.mirror = &mirror{
+			setter: m,
+			queue:  make(chan *needle.Needle, queueSize),
+			done:   make(chan struct{}),
+		}
+		return nil
+	}
+}
+
+// startMirror starts writing queued needles to the mirror, if any. It is called once
+// the server is about to handle requests, so a server that fails to start or is only
+// checked does not leave the goroutine running.
+func (s *server) startMirror() {
+	if s.mirror != nil && !s.mirror.started {
+		s.mirror.started = true
+		go s.runMirror(s.mirror)
+	}
+}
+
+// enqueueMirror queues n for the mirror without blocking.
+func (s *server) enqueueMirror(n *needle.Needle) {
+	select {
+	case s.mirror.queue <- n:
+	default:
+		s.mirror.dropped.Add(1)
+		if s.metrics != nil {
+			s.metrics.mirrorDrop()
+		}
+	}
+}
+
+// runMirror writes queued needles to the mirror until the queue is closed, logging
+// how many were dropped at most once every mirrorLogInterval.
+func (s *server) runMirror(m *mirror) {
+	defer close(m.done)
+	ticker := time.NewTicker(mirrorLogInterval)
+	defer ticker.Stop()
+	var logged uint64
+	for {
+		select {
+		case n, ok := <-m.queue:
+			if !ok {
+				return
+			}
+			if err := m.setter.Set(n); err != nil {
+				s.logger.Info(fmt.Sprintf("mirror set %x: %v", n.Hash(), err))
+			}
+		case <-ticker.C:
+			if dropped := m.dropped.Load(); dropped != logged {
+				s.logger.Info(fmt.Sprintf("mirror queue full, dropped %d needles", dropped-logged))
+				logged = dropped
+			}
+		}
+	}
+}
+
+// closeStorage drains the mirror, if any, and closes the primary storage.
+func (s *server) closeStorage() error {
+	if s.mirror != nil && s.mirror.started {
+		close(s.mirror.queue)
+		<-s.mirror.done
+	}
+	return s.storage.Close()
+}
@@ -0,0 +1,79 @@
+package server
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/nomasters/haystack/needle"
+	"github.com/nomasters/haystack/storage/memory"
+)
+
+// blockingSetter is a storage.Setter that blocks every Set until release is closed.
+type blockingSetter struct {
+	release chan struct{}
+}
+
+func (b blockingSetter) Set(*needle.Needle) error {
+	<-b.release
+	return nil
+}
+
+func TestMirror(t *testing.T) {
+	t.Parallel()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	secondary := memory.New(ctx, time.Minute, 10)
+	s := newTestServer(t, WithMirror(secondary, 1))
+	n := randomNeedle(t)
+	if _, err := s.processRequest(n.Bytes(), nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.closeStorage(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := secondary.Get(n.Hash()); err != nil {
+		t.Errorf("expected needle to be mirrored once the queue drained, got: %v", err)
+	}
+}
+
+func TestMirrorDrops(t *testing.T) {
+	t.Parallel()
+
+	release := make(chan struct{})
+	m := NewMetrics(0)
+	s := newTestServer(t, WithMetrics(m), WithMirror(blockingSetter{release}, 1))
+	// the first needle may be taken by the mirror goroutine and block there, the
+	// second fills the queue and the rest are dropped.
+	for i := 0; i < 5; i++ {
+		if _, err := s.processRequest(randomNeedle(t).Bytes(), nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if drops := m.Snapshot().MirrorDrops; drops < 3 {
+		t.Errorf("expected at least 3 mirror drops, got %v", drops)
+	}
+	close(release)
+	s.closeStorage()
+}
+
+func TestMirrorStartsWithServer(t *testing.T) {
+	t.Parallel()
+
+	release := make(chan struct{})
+	defer close(release)
+	s, err := newServer("", WithMirror(blockingSetter{release}, 1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.mirror.started {
+		t.Error("expected the mirror to start only once the server serves")
+	}
+	if err := s.closeStorage(); err != nil {
+		t.Fatal(err)
+	}
+	if err := Check("127.0.0.1:0", WithMirror(blockingSetter{release}, 1)); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,73 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"time"
+)
+
+// metricsReadHeaderTimeout bounds how long a scrape may take to send its headers.
+const metricsReadHeaderTimeout = 5 * time.Second
+
+// WithMetricsAddr serves the server's Metrics in the Prometheus text format at
+// /metrics on an HTTP listener bound to address, such as "localhost:9100". If no
+// Metrics were passed with WithMetrics, a Metrics without a sliding window is created.
+// The listener is opened when the server starts, so a bad address fails
+// ListenAndServe, Serve and Check, and is closed when the server shuts down.
+func WithMetricsAddr(address string) Option {
+	return func(svr *server) error {
+		svr.metricsAddr = address
+		return nil
+	}
+}
+
+// ServeHTTP writes the metrics in the Prometheus text exposition format, so Metrics
+// can be mounted on any HTTP server.
+func (m *Metrics) ServeHTTP(w http.ResponseWriter, _ *http.Request) {
+	s := m.Snapshot()
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	for _, metric := range []struct {
+		name, kind, help string
+		value            any
+	}{
+		{"haystack_get_requests_total", "counter", "GET requests received.", s.Gets},
+		{"haystack_set_requests_total", "counter", "SET requests received, counting a batch datagram once.", s.Sets},
+		{"haystack_get_hits_total", "counter", "GETs answered with a needle.", s.Hits},
+		{"haystack_get_misses_total", "counter", "GETs for needles that were not stored.", s.Misses},
+		{"haystack_invalid_requests_total", "counter", "Requests dropped because of their length.", s.InvalidRequests},
+		{"haystack_invalid_hashes_total", "counter", "SET needles rejected because the hash did not match the payload.", s.InvalidHashes},
+		{"haystack_rate_limited_total", "counter", "Requests dropped because their source exceeded the rate limit.", s.RateLimited},
+		{"haystack_storage_timeouts_total", "counter", "Storage operations abandoned after the handler timeout.", s.StorageTimeouts},
+		{"haystack_mirror_drops_total", "counter", "Stored needles not mirrored because the queue was full.", s.MirrorDrops},
+		{"haystack_response_bytes_total", "counter", "Bytes of responses sent.", s.ResponseBytes},
+		{"haystack_window_hit_ratio", "gauge", "GET hit ratio over the sliding window, zero when it is disabled.", s.WindowHitRatio},
+	} {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n%s %v\n", metric.name, metric.help, metric.name, metric.kind, metric.name, metric.value)
+	}
+}
+
+// startMetrics starts serving Metrics on metricsAddr, if it is set, and returns a func
+// that stops it.
+func (s *server) startMetrics() (func() error, error) {
+	if s.metricsAddr == "" {
+		return func() error { return nil }, nil
+	}
+	if s.metrics == nil {
+		s.metrics = NewMetrics(0)
+	}
+	ln, err := net.Listen("tcp", s.metricsAddr)
+	if err != nil {
+		return nil, err
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", s.metrics)
+	srv := &http.Server{Handler: mux, ReadHeaderTimeout: metricsReadHeaderTimeout}
+	go func() {
+		if err := srv.Serve(ln); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			s.logger.Info(fmt.Sprintf("metrics server: %v", err))
+		}
+	}()
+	return srv.Close, nil
+}
@@ -0,0 +1,114 @@
+package server
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/nomasters/haystack/needle"
+)
+
+func TestMetricsServeHTTP(t *testing.T) {
+	t.Parallel()
+	m := NewMetrics(0)
+	s := newTestServer(t, WithMetrics(m))
+	n := randomNeedle(t)
+	hash := n.Hash()
+	s.processRequest(hash[:], nil)
+	s.processRequest(n.Bytes(), nil)
+	s.processRequest(hash[:], nil)
+	s.processRequest([]byte{1, 2, 3}, nil)
+
+	rec := httptest.NewRecorder()
+	m.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	body := rec.Body.String()
+	for _, line := range []string{
+		"# TYPE haystack_get_requests_total counter",
+		"haystack_get_requests_total 2",
+		"haystack_set_requests_total 1",
+		"haystack_get_hits_total 1",
+		"haystack_get_misses_total 1",
+		"haystack_invalid_requests_total 1",
+	} {
+		if !strings.Contains(body, line+"\n") {
+			t.Errorf("expected %q in:\n%s", line, body)
+		}
+	}
+}
+
+func TestWithMetricsAddr(t *testing.T) {
+	t.Parallel()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := ln.Addr().String()
+	ln.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	source := newChanSource()
+	done := make(chan error, 1)
+	go func() {
+		done <- Serve(source, WithContext(ctx), WithAckSet(), WithWorkerCount(1), WithMetricsAddr(addr))
+	}()
+
+	n := randomNeedle(t)
+	hash := n.Hash()
+	source.packets <- n.Bytes()
+	<-source.replies
+	source.packets <- hash[:]
+	<-source.replies
+
+	scrape := func() (string, error) {
+		resp, err := http.Get("http://" + addr + "/metrics")
+		if err != nil {
+			return "", err
+		}
+		defer resp.Body.Close()
+		b, err := io.ReadAll(resp.Body)
+		return string(b), err
+	}
+	body, err := scrape()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, line := range []string{
+		"haystack_set_requests_total 1",
+		"haystack_get_requests_total 1",
+		"haystack_get_hits_total 1",
+		"haystack_response_bytes_total " + strconv.Itoa(needle.HashLength+needle.NeedleLength),
+	} {
+		if !strings.Contains(body, line+"\n") {
+			t.Errorf("expected %q in:\n%s", line, body)
+		}
+	}
+
+	cancel()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("server did not shut down")
+	}
+	if _, err := scrape(); err == nil {
+		t.Error("expected the metrics listener to be closed after shutdown")
+	}
+}
+
+func TestWithMetricsAddrInvalid(t *testing.T) {
+	t.Parallel()
+	if err := Check("127.0.0.1:0", WithMetricsAddr("127.0.0.1:-1")); err == nil {
+		t.Error("expected Check to fail for an invalid metrics address")
+	}
+	if err := Serve(newChanSource(), WithMetricsAddr("127.0.0.1:-1")); err == nil {
+		t.Error("expected Serve to fail for an invalid metrics address")
+	}
+}
@@ -0,0 +1,111 @@
+package server
+
+import (
+	"container/list"
+	"errors"
+	"net"
+	"net/netip"
+	"sync"
+	"time"
+)
+
+// maxRateLimitedSources is the number of source addresses whose token buckets are kept.
+// When more sources are seen, the least recently seen loses its bucket and starts
+// again with a full burst, which bounds memory when addresses churn.
+const maxRateLimitedSources = 1 << 16
+
+var errInvalidRateLimit = errors.New("rate limit must be positive with a burst of at least one")
+
+// WithRateLimit limits each source address to perSecond requests per second on
+// average, with bursts of up to burst requests. Requests over the limit are dropped
+// silently, like invalid requests, so a SET is not stored and a GET receives no
+// response. Drops are counted by Metrics. Sources are identified by IP address
+// without the port, since a client can change its port freely, and the buckets of at
+// most 65536 sources are kept.
+func WithRateLimit(perSecond float64, burst int) Option {
+	return func(svr *server) error {
+		if perSecond <= 0 || burst < 1 {
+			return errInvalidRateLimit
+		}
+		svr.limiter = newRateLimiter(perSecond, burst, maxRateLimitedSources)
+		return nil
+	}
+}
+
+// rateLimiter is a token bucket per source address held in an LRU list.
+type rateLimiter struct {
+	mu      sync.Mutex
+	rate    float64
+	burst   float64
+	size    int
+	order   *list.List
+	buckets map[sourceKey]*list.Element
+	now     func() time.Time
+}
+
+// sourceKey identifies a source by IP address for UDP and TCP, or by its string form
+// for other transports.
+type sourceKey struct {
+	ip    netip.Addr
+	other string
+}
+
+type tokenBucket struct {
+	key    sourceKey
+	tokens float64
+	last   time.Time
+}
+
+func newRateLimiter(perSecond float64, burst, size int) *rateLimiter {
+	return &rateLimiter{
+		rate:    perSecond,
+		burst:   float64(burst),
+		size:    size,
+		order:   list.New(),
+		buckets: make(map[sourceKey]*list.Element),
+		now:     time.Now,
+	}
+}
+
+// allow reports whether a request from addr is within its limit, taking a token if it
+// is. Requests without an address are always allowed.
+func (r *rateLimiter) allow(addr net.Addr) bool {
+	if addr == nil {
+		return true
+	}
+	var key sourceKey
+	switch a := addr.(type) {
+	case *net.UDPAddr:
+		ip, _ := netip.AddrFromSlice(a.IP)
+		key.ip = ip.Unmap()
+	case *net.TCPAddr:
+		ip, _ := netip.AddrFromSlice(a.IP)
+		key.ip = ip.Unmap()
+	default:
+		key.other = addr.String()
+	}
+
+	now := r.now()
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	e, ok := r.buckets[key]
+	if !ok {
+		if r.order.Len() >= r.size {
+			oldest := r.order.Back()
+			r.order.Remove(oldest)
+			delete(r.buckets, oldest.Value.(*tokenBucket).key)
+		}
+		e = r.order.PushFront(&tokenBucket{key: key, tokens: r.burst, last: now})
+		r.buckets[key] = e
+	} else {
+		r.order.MoveToFront(e)
+	}
+	b := e.Value.(*tokenBucket)
+	b.tokens = min(r.burst, b.tokens+now.Sub(b.last).Seconds()*r.rate)
+	b.last = now
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
@@ -0,0 +1,88 @@
+package server
+
+import (
+	"errors"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestRateLimit(t *testing.T) {
+	t.Parallel()
+	m := NewMetrics(0)
+	s := newTestServer(t, WithRateLimit(1, 3), WithMetrics(m))
+	now := time.Now()
+	s.limiter.now = func() time.Time { return now }
+
+	n := randomNeedle(t)
+	if err := s.storage.Set(n); err != nil {
+		t.Fatal(err)
+	}
+	hash := n.Hash()
+	flooder := &net.UDPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 5000}
+	other := &net.UDPAddr{IP: net.IPv4(10, 0, 0, 2), Port: 5000}
+
+	get := func(addr net.Addr) bool {
+		t.Helper()
+		resp, err := s.processRequest(hash[:], addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp != nil
+	}
+	for i := 0; i < 5; i++ {
+		if got, expected := get(flooder), i < 3; got != expected {
+			t.Errorf("request %v: expected response %v, got %v", i, expected, got)
+		}
+	}
+	// a different port on the same host shares the limit
+	if get(&net.UDPAddr{IP: flooder.IP, Port: 6000}) {
+		t.Error("expected a new port on the same host to be limited")
+	}
+	for i := 0; i < 3; i++ {
+		if !get(other) {
+			t.Errorf("expected a response for a second address, request %v", i)
+		}
+	}
+	if got := m.Snapshot().RateLimited; got != 3 {
+		t.Errorf("expected 3 rate limited requests, got %v", got)
+	}
+
+	now = now.Add(time.Second)
+	if !get(flooder) {
+		t.Error("expected a token to be refilled after a second")
+	}
+	if get(flooder) {
+		t.Error("expected only one token to be refilled after a second")
+	}
+}
+
+func TestRateLimiterEviction(t *testing.T) {
+	t.Parallel()
+	r := newRateLimiter(1, 1, 2)
+	a := &net.UDPAddr{IP: net.IPv4(10, 0, 0, 1)}
+	b := &net.UDPAddr{IP: net.IPv4(10, 0, 0, 2)}
+	c := &net.UDPAddr{IP: net.IPv4(10, 0, 0, 3)}
+	for _, addr := range []net.Addr{a, b, a, c} {
+		r.allow(addr)
+	}
+	if len(r.buckets) != 2 || r.order.Len() != 2 {
+		t.Fatalf("expected 2 buckets, got %v", len(r.buckets))
+	}
+	// b was least recently seen, so its bucket was evicted and starts full again
+	if !r.allow(b) {
+		t.Error("expected the evicted source to start with a full bucket")
+	}
+	if r.allow(c) {
+		t.Error("expected the recently seen source to stay limited")
+	}
+}
+
+func TestWithRateLimitInvalid(t *testing.T) {
+	t.Parallel()
+	for _, opt := range []Option{WithRateLimit(0, 1), WithRateLimit(1, 0)} {
+		if err := opt(new(server)); !errors.Is(err, errInvalidRateLimit) {
+			t.Errorf("expected %v, got: %v", errInvalidRateLimit, err)
+		}
+	}
+}
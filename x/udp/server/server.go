@@ -2,11 +2,18 @@ package server
 
 import (
 	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
 	"log"
 	"net"
 	"os"
 	"os/signal"
 	"runtime"
+	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 
 	"github.com/nomasters/haystack/logger"
@@ -52,31 +59,83 @@ type server struct {
 	protocol    string
 	storage     storage.GetSetCloser
 	workers     uint64
+	readers     uint64
 	ctx         context.Context
 	gracePeriod time.Duration
 	logger      logger.Logger
-}
-
-type request struct {
-	body []byte
-	addr net.Addr
+	trustHash   bool
+	ackSet      bool
+	metrics     *Metrics
+	debugMisses bool
+	logInvalid  bool
+	timeout     time.Duration
+	// pending counts storage operations still running after the handler timeout
+	// abandoned them, so shutdown can wait for them before closing the storage.
+	pending     sync.WaitGroup
+	trace       *Trace
+	headroom    uint64
+	mirror      *mirror
+	iface       string
+	respAddress string
+	limiter     *rateLimiter
+	metricsAddr string
+	accessLog   bool
+	logHashes   bool
+	// handling counts requests being handled by a worker, which shutdown reports if
+	// they outlast the grace period.
+	handling atomic.Int64
 }
 
 // Option TBD
 type Option func(*server) error
 
+// responsePool recycles NeedleLength buffers used to build GET replies so that
+// the hot path does not allocate a fresh slice for every response.
+var responsePool = sync.Pool{
+	New: func() any {
+		return new([needle.NeedleLength]byte)
+	},
+}
+
+// requestPool recycles the buffers requests are read into. Each request keeps its own
+// buffer until a worker has handled it, so readers never overwrite a request that is
+// still queued.
+var requestPool = sync.Pool{
+	New: func() any {
+		return new([maxRequestLength]byte)
+	},
+}
+
+var (
+	errInvalidLength = errors.New("invalid length")
+	errNoHeadroom    = errors.New("storage is above its high-water mark")
+	errTimeout       = errors.New("storage operation timed out")
+)
+
 const (
 	defaultAddress     = ":1337"
 	defaultProtocol    = "udp"
 	defaultGracePeriod = 2 * time.Second
 	minGracePeriod     = 0 * time.Millisecond
+	// pingRequest is the first byte of a PING, which is answered with pongPrefix and the
+	// server time as 8 byte big endian unix nanoseconds without touching the storage.
+	// Servers that predate PING drop it as an invalid length. See isPing for padding.
+	pingRequest = 0x00
+	pongPrefix  = "PONG"
+	pongLength  = len(pongPrefix) + 8
+	// maxRequestLength is one byte longer than the largest valid request, a batch of
+	// needles, so that an oversized datagram is read as invalid rather than truncated
+	// into a valid one.
+	maxRequestLength = needle.MaxBatchCount*needle.NeedleLength + 1
 )
 
 // NOTE: this might actually need to move to the cmd. it seems more like a runtime implementation detail
 // UPDATE: this should, in fact, be part of the CMD implementation, it should not be opinionated in the server itself
 // so that others can use it as they see fit.
 
-// WithShutdownGracePeriod allows you to set the gracePeriod
+// WithShutdownGracePeriod sets how long the server waits for requests it has already
+// read to be answered when its context is done, before it gives up and returns an
+// error. The default is two seconds.
 func WithShutdownGracePeriod(duration time.Duration) Option {
 	if duration <= minGracePeriod {
 		duration = defaultGracePeriod
@@ -89,7 +148,8 @@ func WithShutdownGracePeriod(duration time.Duration) Option {
 
 }
 
-// WithStorage allows setting a storage.GetSetCloser in the server runtime
+// WithStorage allows setting a storage.GetSetCloser in the server runtime. Wrap it in a
+// storage.Swappable to replace the storage while the server is running.
 func WithStorage(s storage.GetSetCloser) Option {
 	return func(svr *server) error {
 		svr.storage = s
@@ -117,8 +177,228 @@ func WithWorkerCount(count uint64) Option {
 	}
 }
 
-// ListenAndServe initiates and runs the haystack server and returns an error.
+// WithReaderCount takes count of uint64 and sets how many goroutines read requests from
+// the socket concurrently. A single reader can limit throughput on multicore hosts.
+// If reader count is set to zero, readers are set to runtime.NumCPU(). The default is 1.
+func WithReaderCount(count uint64) Option {
+	if count == 0 {
+		count = uint64(runtime.NumCPU())
+	}
+	return func(svr *server) error {
+		svr.readers = count
+		return nil
+	}
+}
+
+// WithTrustClientHash makes the server accept the hash a client sends with a needle
+// instead of re-hashing the payload to verify it. This trades integrity for CPU and
+// should only be used when every client is trusted, such as on a private link.
+func WithTrustClientHash() Option {
+	return func(svr *server) error {
+		svr.trustHash = true
+		return nil
+	}
+}
+
+// WithMetrics passes a Metrics to the server, which it updates as requests are handled.
+func WithMetrics(m *Metrics) Option {
+	return func(svr *server) error {
+		svr.metrics = m
+		return nil
+	}
+}
+
+// WithDebugNearest makes the server log the nearest stored hash whenever a GET misses,
+// if the storage implements storage.NearestFinder. Nothing extra is sent to the client.
+// This is a debugging aid for telling a mistyped hash from an evicted one and can be
+// slow, since finding the nearest hash may scan the whole store.
+func WithDebugNearest() Option {
+	return func(svr *server) error {
+		svr.debugMisses = true
+		return nil
+	}
+}
+
+// WithHandlerTimeout abandons a storage Get or Set that takes longer than d, so a slow
+// storage cannot stall the worker handling the request. An abandoned GET is treated as
+// a miss and receives no response, and an abandoned SET is not acknowledged. Both are
+// counted by Metrics. The storage operation itself cannot be cancelled and keeps
+// running in the background, so an abandoned SET may still be stored.
+func WithHandlerTimeout(d time.Duration) Option {
+	return func(svr *server) error {
+		svr.timeout = d
+		return nil
+	}
+}
+
+// WithLogInvalidHash makes the server log the source address of every SET whose
+// needle hash does not match its payload. Such needles are always rejected, and are
+// counted by Metrics whether or not they are logged. This helps find buggy or
+// malicious clients, but a flood of invalid needles produces a flood of log lines.
+func WithLogInvalidHash() Option {
+	return func(svr *server) error {
+		svr.logInvalid = true
+		return nil
+	}
+}
+
+// WithAckSet makes the server reply to every stored SET with the HashLength hash of the
+// needle, letting clients confirm delivery without a follow up GET. By default SET is
+// fire-and-forget and receives no response.
+func WithAckSet() Option {
+	return func(svr *server) error {
+		svr.ackSet = true
+		return nil
+	}
+}
+
+// WithHeadroom makes the server refuse SETs once the storage reports that items or
+// fewer needles can still be stored, if it implements storage.CapacityReporter. This
+// keeps room in reserve and degrades predictably rather than failing every write once
+// the store is completely full. Refused SETs are not acknowledged.
+func WithHeadroom(items uint64) Option {
+	return func(svr *server) error {
+		svr.headroom = items
+		return nil
+	}
+}
+
+// WithBindInterface binds the server socket to the network interface named iface, such
+// as "eth1", so that it only receives packets arriving on that interface regardless of
+// the address it listens on. This uses SO_BINDTODEVICE and is only supported on linux,
+// where it usually requires CAP_NET_RAW; on other platforms listening fails.
+func WithBindInterface(iface string) Option {
+	return func(svr *server) error {
+		svr.iface = iface
+		return nil
+	}
+}
+
+// WithResponseAddress makes the server send replies from a socket bound to address,
+// such as a fixed public address, instead of the socket the request arrived on. Clients
+// then receive replies from a different address than the one they sent to, so they
+// must read from unconnected sockets; haystack.Client dials connected sockets by default
+// and would need WithDialer to accept them. Firewalls and NAT in front of clients must
+// also allow inbound UDP from the response address, since stateful rules usually only
+// admit replies from the address a request was sent to.
+func WithResponseAddress(address string) Option {
+	return func(svr *server) error {
+		svr.respAddress = address
+		return nil
+	}
+}
+
+// ListenAndServe initiates and runs the haystack server and returns an error. It runs
+// until an interrupt signal is received or the context passed with WithContext is
+// done, then stops reading requests and closes the storage.
 func ListenAndServe(address string, opts ...Option) error {
+	s, err := newServer(address, opts...)
+	if err != nil {
+		return err
+	}
+
+	conn, err := s.listen()
+	if err != nil {
+		return err
+	}
+	out, err := s.responseConn(conn)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	ctx, stop := signal.NotifyContext(s.ctx, os.Interrupt)
+	defer stop()
+	return s.serve(ctx, newUDPSource(conn, out))
+}
+
+// serve reads requests from source and answers them until ctx is done, then shuts
+// down. The server owns its storage, so serve closes it once nothing can use it.
+func (s *server) serve(ctx context.Context, source PacketSource) error {
+	stopMetrics, err := s.startMetrics()
+	if err != nil {
+		source.Close()
+		s.closeStorage()
+		return err
+	}
+	s.startMirror()
+	// what value should I set here?
+	reqChan := make(chan *Packet, s.workers*64)
+	// stop is closed if shutdown runs out of time, releasing readers blocked on a full
+	// queue and workers still draining it.
+	stop := make(chan struct{})
+	var readers, workers sync.WaitGroup
+	for i := 0; i < int(s.readers); i++ {
+		readers.Add(1)
+		go func() {
+			defer readers.Done()
+			newListener(source, reqChan, stop)
+		}()
+	}
+	for i := 0; i < int(s.workers); i++ {
+		workers.Add(1)
+		go func() {
+			defer workers.Done()
+			s.newWorker(reqChan, stop)
+		}()
+	}
+
+	<-ctx.Done()
+	err = s.shutdown(source, reqChan, stop, &readers, &workers)
+	return errors.Join(err, stopMetrics())
+}
+
+// Check runs the same setup as ListenAndServe without serving any requests. It
+// applies the options, binds the listener and metrics addresses and closes the storage
+// backend, returning the first error encountered. This is intended as a preflight
+// check before deploying a server configuration.
+func Check(address string, opts ...Option) error {
+	return check(address, false, opts)
+}
+
+// CheckTCP is Check for ListenAndServeTCP, binding a TCP listener at address instead
+// of a UDP socket.
+func CheckTCP(address string, opts ...Option) error {
+	return check(address, true, opts)
+}
+
+func check(address string, tcp bool, opts []Option) error {
+	s, err := newServer(address, opts...)
+	if err != nil {
+		return err
+	}
+	var ln io.Closer
+	if tcp {
+		lc := s.listenConfig()
+		ln, err = lc.Listen(s.ctx, "tcp", s.address)
+	} else {
+		var conn net.PacketConn
+		if conn, err = s.listen(); err == nil {
+			ln = conn
+			var out net.PacketConn
+			if out, err = s.responseConn(conn); err == nil && out != conn {
+				err = out.Close()
+			}
+		}
+	}
+	if ln == nil {
+		s.closeStorage()
+		return err
+	}
+	if err == nil && s.metricsAddr != "" {
+		var ml net.Listener
+		if ml, err = net.Listen("tcp", s.metricsAddr); err == nil {
+			err = ml.Close()
+		}
+	}
+	if err := errors.Join(err, ln.Close()); err != nil {
+		s.closeStorage()
+		return err
+	}
+	return s.closeStorage()
+}
+
+// newServer returns a server with defaults for address and opts applied.
+func newServer(address string, opts ...Option) (*server, error) {
 	if address == "" {
 		address = defaultAddress
 	}
@@ -129,6 +409,7 @@ func ListenAndServe(address string, opts ...Option) error {
 		address:     address,
 		protocol:    defaultProtocol,
 		workers:     uint64(runtime.NumCPU()),
+		readers:     1,
 		storage:     memory.New(ctx, 24*time.Hour, 2000000),
 		ctx:         context.Background(),
 		gracePeriod: defaultGracePeriod,
@@ -137,113 +418,422 @@ func ListenAndServe(address string, opts ...Option) error {
 
 	for _, opt := range opts {
 		if err := opt(&s); err != nil {
-			return err
+			return nil, err
 		}
 	}
+	return &s, nil
+}
 
-	conn, err := net.ListenPacket(s.protocol, s.address)
-	if err != nil {
-		return err
-	}
-	// what value should I set here?
-	reqChan := make(chan *request, s.workers*64)
-	go newListener(conn, reqChan)
-
-	ctx, cancel := context.WithCancel(s.ctx)
-	stopSig := make(chan os.Signal, 1)
-	signal.Notify(stopSig, os.Interrupt)
-
-	defer func() {
-		signal.Stop(stopSig)
-	}()
-
-	doneChan := make(chan struct{}, s.workers)
+// listen opens the server socket, binding it to an interface if one was configured.
+func (s *server) listen() (net.PacketConn, error) {
+	lc := s.listenConfig()
+	return lc.ListenPacket(s.ctx, s.protocol, s.address)
+}
 
-	for i := 0; i < int(s.workers); i++ {
-		go s.newWorker(ctx, conn, reqChan, doneChan)
+// listenConfig returns the config server sockets are opened with, which binds them to
+// an interface if one was configured.
+func (s *server) listenConfig() net.ListenConfig {
+	var lc net.ListenConfig
+	if s.iface != "" {
+		lc.Control = func(network, address string, c syscall.RawConn) error {
+			var err error
+			if cerr := c.Control(func(fd uintptr) {
+				err = bindToDevice(fd, s.iface)
+			}); cerr != nil {
+				return cerr
+			}
+			if err != nil {
+				return fmt.Errorf("bind to interface %q: %w", s.iface, err)
+			}
+			return nil
+		}
 	}
-
-	<-stopSig
-	return s.shutdown(cancel, doneChan)
+	return lc
 }
 
-func newListener(conn net.PacketConn, reqChan chan<- *request) {
-	buffer := make([]byte, needle.NeedleLength+1)
+// responseConn returns the socket replies are written to, which is conn unless a
+// response address was configured.
+func (s *server) responseConn(conn net.PacketConn) (net.PacketConn, error) {
+	if s.respAddress == "" {
+		return conn, nil
+	}
+	return net.ListenPacket(s.protocol, s.respAddress)
+}
 
+// newListener reads packets from source and queues them for the workers until the
+// source is closed.
+func newListener(source PacketSource, reqChan chan<- *Packet, stop <-chan struct{}) {
 	for {
-		n, radder, err := conn.ReadFrom(buffer)
+		p, err := source.ReadPacket()
 		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
 			log.Printf("read error: %v", err)
+			continue
 		}
-		if n == needle.NeedleLength || n == needle.HashLength {
-			reqChan <- &request{body: buffer[:n], addr: radder}
-		} else {
-			log.Println("invalid length", n)
+		select {
+		case reqChan <- p:
+		case <-stop:
+			if p.Release != nil {
+				p.Release()
+			}
+			return
 		}
 	}
 }
 
-func (s *server) shutdown(cancel context.CancelFunc, done <-chan struct{}) error {
-	cancel()
-	complete := false
-	go func() {
-		// todo: set this to something longer?
-		time.Sleep(s.gracePeriod)
-		if !complete {
-			s.logger.Fatal("failed to gracefully exit")
-		}
-	}()
+// shutdown stops the server in an order that guarantees every request that was read
+// is answered and the storage is not used once it is closed. Reading stops first, but
+// a source that supports it stays open so handlers can still write their responses.
+// The workers then drain the requests already queued, storage operations abandoned by
+// the handler timeout are waited for, and only then are the source and storage closed.
+// If this takes longer than the grace period, shutdown closes stop and the source,
+// abandoning queued requests, and returns an error wrapping context.DeadlineExceeded,
+// leaving the storage open since handlers may still be using it.
+func (s *server) shutdown(source PacketSource, reqChan chan *Packet, stop chan struct{}, readers, workers *sync.WaitGroup) error {
+	ctx := context.Background()
+	if s.gracePeriod > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, s.gracePeriod)
+		defer cancel()
+		defer context.AfterFunc(ctx, func() { close(stop) })()
+	}
+	timedOut := func() error {
+		source.Close()
+		return fmt.Errorf("shutdown: %w with %d handlers still running and %d requests queued",
+			ctx.Err(), s.handling.Load(), len(reqChan))
+	}
 
-	for i := 0; i < int(s.workers); i++ {
-		<-done
+	d, drains := source.(drainer)
+	if drains {
+		d.stopReading()
+	} else {
+		source.Close()
 	}
-	if err := s.storage.Close(); err != nil {
+	// reqChan is only closed once no reader can send on it
+	if !wait(ctx, readers) {
+		return timedOut()
+	}
+	close(reqChan)
+	if !wait(ctx, workers) {
+		return timedOut()
+	}
+	var err error
+	if drains {
+		err = source.Close()
+	}
+	if !wait(ctx, &s.pending) {
+		return fmt.Errorf("shutdown: %w waiting for abandoned storage operations", ctx.Err())
+	}
+	if err := errors.Join(err, s.closeStorage()); err != nil {
 		return err
 	}
-	complete = true
-	s.logger.Info("graceful exit")
+	if s.logger != nil {
+		s.logger.Info("graceful exit")
+	}
 	return nil
 }
 
-func (s *server) newWorker(ctx context.Context, conn net.PacketConn, reqChan <-chan *request, done chan<- struct{}) {
+// drainer is implemented by a PacketSource that can stop reading requests while still
+// sending responses, so shutdown can let handlers finish before it calls Close.
+// ReadPacket must return an error wrapping net.ErrClosed once stopReading is called.
+type drainer interface {
+	stopReading()
+}
+
+// wait waits for wg and reports whether it finished before ctx was done.
+func wait(ctx context.Context, wg *sync.WaitGroup) bool {
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// newWorker handles requests from reqChan until it is closed and drained, or until
+// stop is closed.
+func (s *server) newWorker(reqChan <-chan *Packet, stop <-chan struct{}) {
 	for {
 		select {
-		case <-ctx.Done():
-			done <- struct{}{}
+		case <-stop:
 			return
-		case r := <-reqChan:
-			switch len(r.body) {
-			case needle.HashLength:
-				if err := s.handleHash(conn, r); err != nil {
-					log.Println(err)
-				}
-			case needle.NeedleLength:
-				if err := s.handleNeedle(conn, r); err != nil {
-					log.Println(err)
-				}
+		case p, ok := <-reqChan:
+			if !ok {
+				return
 			}
+			s.handling.Add(1)
+			s.handle(p)
+			s.handling.Add(-1)
 		}
 	}
 }
 
-func (s *server) handleHash(conn net.PacketConn, r *request) error {
+// handle processes p, replies with any response and releases the packet.
+func (s *server) handle(p *Packet) {
+	if p.Release != nil {
+		defer p.Release()
+	}
+	resp, err := s.processRequest(p.Data, p.From)
+	if err != nil {
+		log.Println(err)
+	}
+	// a batch that partly failed still acknowledges the needles it stored
+	if resp == nil {
+		return
+	}
+	if err := p.Reply(resp); err != nil {
+		log.Println(err)
+	} else if s.metrics != nil {
+		s.metrics.response(len(resp))
+	}
+	putResponse(resp)
+}
+
+// processRequest dispatches a single request received from addr and returns the
+// response that should be written back to addr, or nil if there is none. A non-nil
+// response may be borrowed from responsePool and should be released with putResponse
+// once it has been written.
+func (s *server) processRequest(body []byte, addr net.Addr) ([]byte, error) {
+	if s.limiter != nil && !s.limiter.allow(addr) {
+		if s.metrics != nil {
+			s.metrics.rateLimit()
+		}
+		if s.accessLog {
+			s.logAccess(body, addr, "limited", 0)
+		}
+		return nil, nil
+	}
+	if !s.accessLog {
+		return s.dispatch(body, addr)
+	}
+	start := time.Now()
+	resp, err := s.dispatch(body, addr)
+	s.logAccess(body, addr, accessResult(body, err), time.Since(start))
+	return resp, err
+}
+
+// dispatch handles body according to its length.
+func (s *server) dispatch(body []byte, addr net.Addr) ([]byte, error) {
+	if isPing(body) {
+		return pong(time.Now()), nil
+	}
+	if l := len(body); l > needle.NeedleLength && l%needle.NeedleLength == 0 && l/needle.NeedleLength <= needle.MaxBatchCount {
+		if s.metrics != nil {
+			s.metrics.set()
+		}
+		return s.handleBatch(body, addr)
+	}
+	switch len(body) {
+	case needle.HashLength:
+		if s.metrics != nil {
+			s.metrics.get()
+		}
+		resp, err := s.handleHash(body)
+		if s.trace != nil {
+			s.trace.record(OpGet, body, err == nil, addr)
+		}
+		return resp, err
+	case needle.NeedleLength:
+		if s.metrics != nil {
+			s.metrics.set()
+		}
+		resp, err := s.handleNeedle(body, addr)
+		if s.trace != nil {
+			s.trace.record(OpSet, body[:needle.HashLength], err == nil, addr)
+		}
+		return resp, err
+	default:
+		if s.metrics != nil {
+			s.metrics.invalidRequest()
+		}
+		return nil, fmt.Errorf("%w: %d", errInvalidLength, len(body))
+	}
+}
+
+func (s *server) handleHash(body []byte) ([]byte, error) {
 	var hash [needle.HashLength]byte
-	copy(hash[:], r.body)
-	n, err := s.storage.Get(hash)
+	copy(hash[:], body)
+	var n *needle.Needle
+	err := s.withTimeout(func() (err error) {
+		n, err = s.storage.Get(hash)
+		return err
+	})
+	if errors.Is(err, storage.ErrorNotFound) {
+		if s.metrics != nil {
+			s.metrics.miss()
+		}
+		if s.debugMisses {
+			s.logNearest(hash)
+		}
+	}
 	if err != nil {
+		return nil, err
+	}
+	if s.metrics != nil {
+		s.metrics.hit()
+	}
+	resp := getResponse()
+	h, p := n.Hash(), n.Payload()
+	copy(resp, h[:])
+	copy(resp[needle.HashLength:], p[:])
+	return resp, nil
+}
+
+// withTimeout runs the storage operation op, giving up with errTimeout once the
+// handler timeout passes. Without a timeout, op runs on the calling goroutine.
+func (s *server) withTimeout(op func() error) error {
+	if s.timeout <= 0 {
+		return op()
+	}
+	done := make(chan error, 1)
+	s.pending.Add(1)
+	go func() {
+		defer s.pending.Done()
+		done <- op()
+	}()
+	timer := time.NewTimer(s.timeout)
+	defer timer.Stop()
+	select {
+	case err := <-done:
 		return err
+	case <-timer.C:
+		if s.metrics != nil {
+			s.metrics.storageTimeout()
+		}
+		return errTimeout
 	}
-	_, err = conn.WriteTo(n.Bytes(), r.addr)
-	return err
 }
 
-func (s *server) handleNeedle(conn net.PacketConn, r *request) error {
-	n, err := needle.FromBytes(r.body)
+// rejectInvalidHash counts a SET whose hash did not match its payload and logs where
+// it came from if WithLogInvalidHash is set.
+func (s *server) rejectInvalidHash(body []byte, addr net.Addr) {
+	if s.metrics != nil {
+		s.metrics.invalidHash()
+	}
+	if s.logInvalid {
+		s.logger.Info(fmt.Sprintf("invalid hash %x from %v", body[:needle.HashLength], addr))
+	}
+}
+
+// logNearest logs the stored hash closest to a hash that missed.
+func (s *server) logNearest(hash needle.Hash) {
+	finder, ok := s.storage.(storage.NearestFinder)
+	if !ok {
+		return
+	}
+	nearest, prefix, ok := finder.Nearest(hash)
+	if !ok {
+		s.logger.Info(fmt.Sprintf("miss %x: storage is empty", hash))
+		return
+	}
+	s.logger.Info(fmt.Sprintf("miss %x: nearest %x shares %d prefix bits", hash, nearest, prefix))
+}
+
+func (s *server) handleNeedle(body []byte, addr net.Addr) ([]byte, error) {
+	fromBytes := needle.FromBytes
+	if s.trustHash {
+		fromBytes = needle.FromBytesTrusted
+	}
+	n, err := fromBytes(body)
 	if err != nil {
-		return err
+		if errors.Is(err, needle.ErrorInvalidHash) {
+			s.rejectInvalidHash(body, addr)
+		}
+		return nil, err
 	}
-	if err := s.storage.Set(n); err != nil {
-		return err
+	if s.headroom > 0 {
+		if r, ok := s.storage.(storage.CapacityReporter); ok {
+			if remaining, ok := r.Remaining(); ok && remaining <= s.headroom {
+				return nil, errNoHeadroom
+			}
+		}
+	}
+	if err := s.withTimeout(func() error { return s.storage.Set(n) }); err != nil {
+		return nil, err
+	}
+	if s.mirror != nil {
+		s.enqueueMirror(n)
+	}
+	if !s.ackSet {
+		return nil, nil
+	}
+	resp := getResponse()[:needle.HashLength]
+	h := n.Hash()
+	copy(resp, h[:])
+	return resp, nil
+}
+
+// handleBatch stores each needle of a SET datagram holding several concatenated
+// needles. An invalid needle does not stop the rest of the batch from being stored,
+// and the errors are joined. When acknowledgements are enabled the response holds the
+// hashes of the needles that were stored, in the order they were received.
+func (s *server) handleBatch(body []byte, addr net.Addr) ([]byte, error) {
+	var errs []error
+	var resp []byte
+	if s.ackSet {
+		// the capacity never matches a pooled response, so putResponse ignores it
+		resp = make([]byte, 0, needle.MaxBatchCount*needle.HashLength)
+	}
+	for b := body; len(b) > 0; b = b[needle.NeedleLength:] {
+		ack, err := s.handleNeedle(b[:needle.NeedleLength], addr)
+		if s.trace != nil {
+			s.trace.record(OpSet, b[:needle.HashLength], err == nil, addr)
+		}
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		if ack != nil {
+			resp = append(resp, ack...)
+			putResponse(ack)
+		}
+	}
+	if len(resp) == 0 {
+		resp = nil
+	}
+	return resp, errors.Join(errs...)
+}
+
+// getResponse borrows a NeedleLength buffer from responsePool.
+func getResponse() []byte {
+	return responsePool.Get().(*[needle.NeedleLength]byte)[:]
+}
+
+// isPing reports whether body is a PING: pingRequest alone, or zero bytes padded to
+// the length of a needle or batch, so a client can find the largest datagram that
+// reaches the server without storing anything. No valid needle is all zeros.
+func isPing(body []byte) bool {
+	if l := len(body); l != 1 && (l == 0 || l%needle.NeedleLength != 0 || l/needle.NeedleLength > needle.MaxBatchCount) {
+		return false
+	}
+	for _, b := range body {
+		if b != pingRequest {
+			return false
+		}
+	}
+	return true
+}
+
+// pong returns the response to a PING sent at now.
+func pong(now time.Time) []byte {
+	b := make([]byte, pongLength)
+	copy(b, pongPrefix)
+	binary.BigEndian.PutUint64(b[len(pongPrefix):], uint64(now.UnixNano()))
+	return b
+}
+
+// putResponse returns a buffer obtained from getResponse to responsePool. Responses
+// that were not borrowed from the pool are left for the garbage collector.
+func putResponse(b []byte) {
+	if cap(b) != needle.NeedleLength {
+		return
 	}
-	return err
+	responsePool.Put((*[needle.NeedleLength]byte)(b[:needle.NeedleLength]))
 }
@@ -0,0 +1,844 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/nomasters/haystack/needle"
+	"github.com/nomasters/haystack/storage"
+	"github.com/nomasters/haystack/storage/journal"
+	"github.com/nomasters/haystack/storage/memory"
+)
+
+// newTestServer returns a server backed by a memory store that is closed with the test.
+func newTestServer(t testing.TB, opts ...Option) *server {
+	t.Helper()
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	s := &server{
+		storage: memory.New(ctx, time.Minute, 1000),
+		ctx:     ctx,
+	}
+	for _, opt := range opts {
+		if err := opt(s); err != nil {
+			t.Fatal(err)
+		}
+	}
+	s.startMirror()
+	return s
+}
+
+// captureLogger is a logger.Logger that records messages for inspection.
+type captureLogger struct {
+	sync.Mutex
+	messages []string
+}
+
+func (l *captureLogger) Info(v ...any) {
+	l.Lock()
+	defer l.Unlock()
+	l.messages = append(l.messages, fmt.Sprint(v...))
+}
+
+func (l *captureLogger) Fatal(v ...any) {
+	panic(fmt.Sprint(v...))
+}
+
+func (l *captureLogger) Messages() []string {
+	l.Lock()
+	defer l.Unlock()
+	return append([]string(nil), l.messages...)
+}
+
+// randomNeedle returns a needle with a random payload.
+func randomNeedle(t testing.TB) *needle.Needle {
+	t.Helper()
+	p := make([]byte, needle.PayloadLength)
+	rand.Read(p)
+	n, err := needle.New(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return n
+}
+
+func TestProcessRequest(t *testing.T) {
+	t.Parallel()
+
+	s := newTestServer(t)
+	addr := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 1337}
+	stored := randomNeedle(t)
+	missing := randomNeedle(t)
+	storedHash, missingHash := stored.Hash(), missing.Hash()
+	invalid := stored.Bytes()
+	invalid[0] ^= 0xff
+
+	if _, err := s.processRequest(stored.Bytes(), addr); err != nil {
+		t.Fatal(err)
+	}
+
+	testTable := []struct {
+		body        []byte
+		expected    []byte
+		hasError    bool
+		description string
+	}{
+		{
+			body:        storedHash[:],
+			expected:    stored.Bytes(),
+			description: "GET hit",
+		},
+		{
+			body:        missingHash[:],
+			hasError:    true,
+			description: "GET miss",
+		},
+		{
+			body:        missing.Bytes(),
+			description: "SET",
+		},
+		{
+			body:        invalid,
+			hasError:    true,
+			description: "SET with invalid hash",
+		},
+		{
+			body:        make([]byte, 0),
+			hasError:    true,
+			description: "empty request",
+		},
+		{
+			body:        make([]byte, needle.HashLength+1),
+			hasError:    true,
+			description: "invalid length",
+		},
+		{
+			body:        make([]byte, needle.NeedleLength+1),
+			hasError:    true,
+			description: "too many bytes",
+		},
+		{
+			body:        make([]byte, (needle.MaxBatchCount+1)*needle.NeedleLength),
+			hasError:    true,
+			description: "batch larger than MaxBatchCount",
+		},
+	}
+
+	for _, test := range testTable {
+		resp, err := s.processRequest(test.body, addr)
+		if (err != nil) != test.hasError {
+			t.Errorf("%v: unexpected error: %v", test.description, err)
+		}
+		if !bytes.Equal(resp, test.expected) {
+			t.Errorf("%v: unexpected response\n%x\n%x", test.description, resp, test.expected)
+		}
+	}
+
+	if _, err := s.storage.Get(missingHash); err != nil {
+		t.Errorf("SET was not stored: %v", err)
+	}
+	if _, err := s.processRequest([]byte{1, 2, 3}, addr); !errors.Is(err, errInvalidLength) {
+		t.Errorf("expected errInvalidLength, got: %v", err)
+	}
+}
+
+func TestProcessRequestPing(t *testing.T) {
+	t.Parallel()
+
+	m := NewMetrics(0)
+	s := newTestServer(t, WithMetrics(m))
+	before := time.Now()
+	resp, err := s.processRequest([]byte{pingRequest}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(resp) != len(pongPrefix)+8 || string(resp[:len(pongPrefix)]) != pongPrefix {
+		t.Fatalf("expected a pong, got %x", resp)
+	}
+	if sent := time.Unix(0, int64(binary.BigEndian.Uint64(resp[len(pongPrefix):]))); sent.Before(before) || sent.After(time.Now()) {
+		t.Errorf("expected the server time in the pong, got %v", sent)
+	}
+
+	// a PING padded to a batch length is answered rather than read as needles
+	padded := make([]byte, needle.MaxBatchCount*needle.NeedleLength)
+	if resp, err := s.processRequest(padded, nil); err != nil || string(resp[:len(pongPrefix)]) != pongPrefix {
+		t.Errorf("expected a pong to a padded ping, got: %x, %v", resp, err)
+	}
+
+	// any other single byte is still an invalid length
+	if resp, err := s.processRequest([]byte{1}, nil); !errors.Is(err, errInvalidLength) || resp != nil {
+		t.Errorf("expected %v, got: %x, %v", errInvalidLength, resp, err)
+	}
+	snap := m.Snapshot()
+	if snap.InvalidRequests != 1 || snap.Gets != 0 || snap.Sets != 0 {
+		t.Errorf("expected only the invalid byte to be counted, got %+v", snap)
+	}
+}
+
+func TestProcessRequestAckSet(t *testing.T) {
+	t.Parallel()
+
+	n := randomNeedle(t)
+	hash := n.Hash()
+
+	resp, err := newTestServer(t).processRequest(n.Bytes(), nil)
+	if err != nil || resp != nil {
+		t.Errorf("expected no ack by default, got: %x, %v", resp, err)
+	}
+	resp, err = newTestServer(t, WithAckSet()).processRequest(n.Bytes(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(resp, hash[:]) {
+		t.Errorf("expected ack of needle hash\n%x\n%x", resp, hash[:])
+	}
+	putResponse(resp)
+}
+
+func TestProcessRequestBatch(t *testing.T) {
+	t.Parallel()
+
+	s := newTestServer(t, WithAckSet())
+	var body, expected []byte
+	var needles []*needle.Needle
+	for i := 0; i < needle.MaxBatchCount; i++ {
+		n := randomNeedle(t)
+		needles = append(needles, n)
+		body = append(body, n.Bytes()...)
+		h := n.Hash()
+		expected = append(expected, h[:]...)
+	}
+	resp, err := s.processRequest(body, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(resp, expected) {
+		t.Errorf("expected ack of every needle hash\n%x\n%x", resp, expected)
+	}
+	for _, n := range needles {
+		if _, err := s.storage.Get(n.Hash()); err != nil {
+			t.Errorf("batched SET was not stored: %v", err)
+		}
+	}
+
+	// an invalid needle fails alone and the rest of the batch is still stored
+	first, last := randomNeedle(t), randomNeedle(t)
+	invalid := randomNeedle(t).Bytes()
+	invalid[0] ^= 1
+	body = append(append(first.Bytes(), invalid...), last.Bytes()...)
+	resp, err = s.processRequest(body, nil)
+	if !errors.Is(err, needle.ErrorInvalidHash) {
+		t.Errorf("expected needle.ErrorInvalidHash, got: %v", err)
+	}
+	h1, h2 := first.Hash(), last.Hash()
+	if expected := append(h1[:], h2[:]...); !bytes.Equal(resp, expected) {
+		t.Errorf("expected ack of valid needles only\n%x\n%x", resp, expected)
+	}
+}
+
+func TestSwapStorage(t *testing.T) {
+	t.Parallel()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	old, next := memory.New(ctx, time.Minute, 10), memory.New(ctx, time.Minute, 10)
+	n := randomNeedle(t)
+	next.Set(n)
+	hash := n.Hash()
+
+	swappable := storage.NewSwappable(old)
+	s := newTestServer(t, WithStorage(swappable))
+	if _, err := s.processRequest(hash[:], nil); !errors.Is(err, memory.ErrorDNE) {
+		t.Fatalf("expected miss before swapping, got: %v", err)
+	}
+	if err := swappable.Swap(next); err != nil {
+		t.Fatal(err)
+	}
+	resp, err := s.processRequest(hash[:], nil)
+	if err != nil {
+		t.Fatalf("expected needle from the new storage, got: %v", err)
+	}
+	if !bytes.Equal(resp, n.Bytes()) {
+		t.Errorf("unexpected response\n%x\n%x", resp, n.Bytes())
+	}
+	putResponse(resp)
+}
+
+func TestHeadroom(t *testing.T) {
+	t.Parallel()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	s := newTestServer(t, WithStorage(memory.New(ctx, time.Minute, 3)), WithHeadroom(1))
+	for i := 0; i < 2; i++ {
+		if _, err := s.processRequest(randomNeedle(t).Bytes(), nil); err != nil {
+			t.Fatalf("expected SET %v to be accepted, got: %v", i, err)
+		}
+	}
+	if _, err := s.processRequest(randomNeedle(t).Bytes(), nil); !errors.Is(err, errNoHeadroom) {
+		t.Errorf("expected errNoHeadroom at the high-water mark, got: %v", err)
+	}
+}
+
+func TestDebugNearest(t *testing.T) {
+	t.Parallel()
+
+	l := new(captureLogger)
+	s := newTestServer(t, WithDebugNearest())
+	s.logger = l
+	n := randomNeedle(t)
+	hash := n.Hash()
+	s.processRequest(hash[:], nil)
+	s.processRequest(n.Bytes(), nil)
+	typo := hash
+	typo[0] ^= 0x80
+	s.processRequest(typo[:], nil)
+
+	messages := l.Messages()
+	if len(messages) != 2 {
+		t.Fatalf("expected 2 log messages, got: %v", messages)
+	}
+	if !strings.Contains(messages[0], "storage is empty") {
+		t.Errorf("unexpected message for empty storage: %v", messages[0])
+	}
+	if !strings.Contains(messages[1], fmt.Sprintf("nearest %x shares 0 prefix bits", hash)) {
+		t.Errorf("unexpected message for typo: %v", messages[1])
+	}
+}
+
+func TestInvalidHash(t *testing.T) {
+	t.Parallel()
+
+	l := new(captureLogger)
+	m := NewMetrics(0)
+	s := newTestServer(t, WithMetrics(m), WithLogInvalidHash())
+	s.logger = l
+	addr := &net.UDPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 4000}
+	s.processRequest(randomNeedle(t).Bytes(), addr)
+	invalid := randomNeedle(t).Bytes()
+	invalid[needle.HashLength] ^= 1
+	if _, err := s.processRequest(invalid, addr); !errors.Is(err, needle.ErrorInvalidHash) {
+		t.Errorf("expected needle.ErrorInvalidHash, got: %v", err)
+	}
+
+	if invalid := m.Snapshot().InvalidHashes; invalid != 1 {
+		t.Errorf("expected 1 invalid hash, got %v", invalid)
+	}
+	messages := l.Messages()
+	if len(messages) != 1 || !strings.Contains(messages[0], addr.String()) {
+		t.Errorf("expected the source address to be logged, got: %v", messages)
+	}
+}
+
+// slowStorage is a storage.GetSetCloser whose Get and Set block until release is closed.
+type slowStorage struct {
+	storage.GetSetCloser
+	release chan struct{}
+}
+
+func (s slowStorage) Get(hash needle.Hash) (*needle.Needle, error) {
+	<-s.release
+	return s.GetSetCloser.Get(hash)
+}
+
+func (s slowStorage) Set(n *needle.Needle) error {
+	<-s.release
+	return s.GetSetCloser.Set(n)
+}
+
+func TestHandlerTimeout(t *testing.T) {
+	t.Parallel()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	slow := slowStorage{GetSetCloser: memory.New(ctx, time.Minute, 10), release: make(chan struct{})}
+	defer close(slow.release)
+	m := NewMetrics(0)
+	s := newTestServer(t, WithStorage(slow), WithMetrics(m), WithAckSet(), WithHandlerTimeout(10*time.Millisecond))
+
+	n := randomNeedle(t)
+	hash := n.Hash()
+	start := time.Now()
+	if resp, err := s.processRequest(n.Bytes(), nil); !errors.Is(err, errTimeout) || resp != nil {
+		t.Errorf("expected SET to time out without an ack, got: %x, %v", resp, err)
+	}
+	if resp, err := s.processRequest(hash[:], nil); !errors.Is(err, errTimeout) || resp != nil {
+		t.Errorf("expected GET to time out without a response, got: %x, %v", resp, err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("expected slow storage to be abandoned, took %v", elapsed)
+	}
+	if timeouts := m.Snapshot().StorageTimeouts; timeouts != 2 {
+		t.Errorf("expected 2 storage timeouts, got %v", timeouts)
+	}
+}
+
+// closeTracker is a storage.GetSetCloser that counts Gets and Sets made after Close.
+type closeTracker struct {
+	storage.GetSetCloser
+	closed    atomic.Bool
+	afterUse  atomic.Int64
+	accessing atomic.Int64
+}
+
+func (c *closeTracker) Get(hash needle.Hash) (*needle.Needle, error) {
+	c.use()
+	return c.GetSetCloser.Get(hash)
+}
+
+func (c *closeTracker) Set(n *needle.Needle) error {
+	c.use()
+	return c.GetSetCloser.Set(n)
+}
+
+func (c *closeTracker) use() {
+	if c.closed.Load() {
+		c.afterUse.Add(1)
+	}
+	c.accessing.Add(1)
+}
+
+func (c *closeTracker) Close() error {
+	c.closed.Store(true)
+	return c.GetSetCloser.Close()
+}
+
+func TestShutdownUnderLoad(t *testing.T) {
+	t.Parallel()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	tracker := &closeTracker{GetSetCloser: memory.New(context.Background(), time.Minute, 100000)}
+	s := newTestServer(t, WithStorage(tracker), WithWorkerCount(4), WithReaderCount(2), WithHandlerTimeout(time.Millisecond))
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan error, 1)
+	go func() { done <- s.serve(ctx, newUDPSource(conn, conn)) }()
+
+	c, err := net.Dial("udp", conn.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	stop := make(chan struct{})
+	sent := make(chan struct{})
+	go func() {
+		defer close(sent)
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+				c.Write(randomNeedle(t).Bytes())
+			}
+		}
+	}()
+	for tracker.accessing.Load() < 100 {
+		time.Sleep(time.Millisecond)
+	}
+	cancel()
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	close(stop)
+	<-sent
+	if !tracker.closed.Load() {
+		t.Error("expected the server to close its storage")
+	}
+	if n := tracker.afterUse.Load(); n != 0 {
+		t.Errorf("expected no storage access after close, got %v", n)
+	}
+}
+
+func TestShutdownDrains(t *testing.T) {
+	t.Parallel()
+
+	for name, tc := range map[string]struct {
+		grace   time.Duration
+		release bool
+	}{
+		"handler finishes": {grace: 5 * time.Second, release: true},
+		"grace period":     {grace: 50 * time.Millisecond},
+	} {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+			n := randomNeedle(t)
+			hash := n.Hash()
+			inner := memory.New(context.Background(), time.Minute, 10)
+			if err := inner.Set(n); err != nil {
+				t.Fatal(err)
+			}
+			slow := slowStorage{GetSetCloser: inner, release: make(chan struct{})}
+			tracker := &closeTracker{GetSetCloser: slow}
+			s := newTestServer(t, WithStorage(tracker), WithWorkerCount(1), WithReaderCount(1), WithShutdownGracePeriod(tc.grace))
+			conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+			if err != nil {
+				t.Fatal(err)
+			}
+			ctx, cancel := context.WithCancel(context.Background())
+			done := make(chan error, 1)
+			go func() { done <- s.serve(ctx, newUDPSource(conn, conn)) }()
+
+			c, err := net.Dial("udp", conn.LocalAddr().String())
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer c.Close()
+			if _, err := c.Write(hash[:]); err != nil {
+				t.Fatal(err)
+			}
+			for tracker.accessing.Load() < 1 {
+				time.Sleep(time.Millisecond)
+			}
+			cancel()
+
+			if !tc.release {
+				err := <-done
+				if !errors.Is(err, context.DeadlineExceeded) || !strings.Contains(err.Error(), "1 handlers") {
+					t.Errorf("expected %v with 1 handler running, got: %v", context.DeadlineExceeded, err)
+				}
+				if tracker.closed.Load() {
+					t.Error("expected the storage to stay open while a handler uses it")
+				}
+				close(slow.release)
+				return
+			}
+
+			select {
+			case err := <-done:
+				t.Fatalf("expected shutdown to wait for the handler, got: %v", err)
+			case <-time.After(50 * time.Millisecond):
+			}
+			close(slow.release)
+			c.SetReadDeadline(time.Now().Add(time.Second))
+			resp := make([]byte, needle.NeedleLength+1)
+			l, err := c.Read(resp)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(resp[:l], n.Bytes()) {
+				t.Errorf("expected the needle, got %x", resp[:l])
+			}
+			if err := <-done; err != nil {
+				t.Fatal(err)
+			}
+			if !tracker.closed.Load() {
+				t.Error("expected the server to close its storage")
+			}
+		})
+	}
+}
+
+func TestShutdownFullQueue(t *testing.T) {
+	t.Parallel()
+
+	slow := slowStorage{GetSetCloser: memory.New(context.Background(), time.Minute, 10), release: make(chan struct{})}
+	defer close(slow.release)
+	tracker := &closeTracker{GetSetCloser: slow}
+	s := newTestServer(t, WithStorage(tracker), WithWorkerCount(1), WithReaderCount(1), WithShutdownGracePeriod(100*time.Millisecond))
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- s.serve(ctx, newUDPSource(conn, conn)) }()
+
+	c, err := net.Dial("udp", conn.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	// more GETs than the queue holds, so the reader blocks handing them to the worker
+	for i := 0; i < 200; i++ {
+		hash := randomNeedle(t).Hash()
+		c.Write(hash[:])
+	}
+	for tracker.accessing.Load() < 1 {
+		time.Sleep(time.Millisecond)
+	}
+	time.Sleep(50 * time.Millisecond)
+	cancel()
+
+	select {
+	case err := <-done:
+		if !errors.Is(err, context.DeadlineExceeded) {
+			t.Errorf("expected %v, got: %v", context.DeadlineExceeded, err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("expected shutdown to give up after the grace period")
+	}
+	if tracker.closed.Load() {
+		t.Error("expected the storage to stay open while a handler uses it")
+	}
+}
+
+func TestCheck(t *testing.T) {
+	t.Parallel()
+
+	optErr := errors.New("bad option")
+	testTable := []struct {
+		address     string
+		opts        []Option
+		hasError    bool
+		description string
+	}{
+		{
+			address:     "127.0.0.1:0",
+			description: "valid address",
+		},
+		{
+			address:     "127.0.0.1:99999",
+			hasError:    true,
+			description: "invalid port",
+		},
+		{
+			address:     "127.0.0.1:0",
+			opts:        []Option{func(*server) error { return optErr }},
+			hasError:    true,
+			description: "option error",
+		},
+		{
+			address:     "127.0.0.1:0",
+			opts:        []Option{WithBindInterface("haystack-none0")},
+			hasError:    true,
+			description: "unknown interface",
+		},
+		{
+			address:     "127.0.0.1:0",
+			opts:        []Option{WithResponseAddress("127.0.0.1:0")},
+			description: "response address",
+		},
+		{
+			address:     "127.0.0.1:0",
+			opts:        []Option{WithResponseAddress("127.0.0.1:99999")},
+			hasError:    true,
+			description: "invalid response address",
+		},
+	}
+	for _, test := range testTable {
+		if err := Check(test.address, test.opts...); (err != nil) != test.hasError {
+			t.Errorf("%v: unexpected error: %v", test.description, err)
+		}
+	}
+}
+
+func TestCheckTCP(t *testing.T) {
+	t.Parallel()
+	// a TCP listener on a port leaves the UDP port of the same number free
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	addr := ln.Addr().String()
+	if err := CheckTCP(addr); err == nil {
+		t.Error("expected CheckTCP to fail on a port bound for TCP")
+	}
+	if err := Check(addr); err != nil {
+		t.Errorf("expected Check to bind UDP, got: %v", err)
+	}
+	if err := CheckTCP("127.0.0.1:0", WithMetricsAddr(addr)); err == nil {
+		t.Error("expected CheckTCP to fail on a bound metrics address")
+	}
+	if err := CheckTCP("127.0.0.1:0"); err != nil {
+		t.Errorf("expected CheckTCP to pass, got: %v", err)
+	}
+}
+
+func BenchmarkServer_Concurrent_GET(b *testing.B) {
+	s := newTestServer(b)
+	n := randomNeedle(b)
+	if err := s.storage.Set(n); err != nil {
+		b.Fatal(err)
+	}
+	hash := n.Hash()
+
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer conn.Close()
+	sink, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer sink.Close()
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			resp, err := s.processRequest(hash[:], sink.LocalAddr())
+			if err != nil {
+				b.Error(err)
+				return
+			}
+			if _, err := conn.WriteTo(resp, sink.LocalAddr()); err != nil {
+				b.Error(err)
+			}
+			putResponse(resp)
+		}
+	})
+}
+
+func BenchmarkServer_SET(b *testing.B) {
+	body := randomNeedle(b).Bytes()
+
+	for _, trust := range []bool{false, true} {
+		name := "verify"
+		if trust {
+			name = "trust"
+		}
+		b.Run(name, func(b *testing.B) {
+			s := newTestServer(b)
+			s.trustHash = trust
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				if _, err := s.processRequest(body, nil); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+// startServer serves s on a local UDP socket until the benchmark ends and returns the
+// address to send requests to.
+func startServer(b *testing.B, s *server) string {
+	b.Helper()
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		b.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- s.serve(ctx, newUDPSource(conn, conn)) }()
+	b.Cleanup(func() {
+		cancel()
+		if err := <-done; err != nil {
+			b.Error(err)
+		}
+	})
+	return conn.LocalAddr().String()
+}
+
+// roundTrip writes req to c and reads the response into resp.
+func roundTrip(c net.Conn, req, resp []byte) error {
+	c.SetDeadline(time.Now().Add(time.Second))
+	if _, err := c.Write(req); err != nil {
+		return err
+	}
+	_, err := c.Read(resp)
+	return err
+}
+
+func BenchmarkServer_Throughput(b *testing.B) {
+	for _, readers := range []uint64{1, 4} {
+		b.Run(fmt.Sprintf("readers=%d", readers), func(b *testing.B) {
+			s := newTestServer(b, WithWorkerCount(0), WithReaderCount(readers))
+			n := randomNeedle(b)
+			if err := s.storage.Set(n); err != nil {
+				b.Fatal(err)
+			}
+			hash := n.Hash()
+			addr := startServer(b, s)
+
+			b.ReportAllocs()
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				c, err := net.Dial("udp", addr)
+				if err != nil {
+					b.Error(err)
+					return
+				}
+				defer c.Close()
+				resp := make([]byte, needle.NeedleLength)
+				for pb.Next() {
+					if err := roundTrip(c, hash[:], resp); err != nil {
+						b.Error(err)
+						return
+					}
+				}
+			})
+		})
+	}
+}
+
+// BenchmarkServer_Storage measures the round trip latency of acknowledged SETs and of
+// GETs through a UDP server for each storage backend.
+func BenchmarkServer_Storage(b *testing.B) {
+	backends := map[string]func(b *testing.B) storage.GetSetCloser{
+		"memory": func(b *testing.B) storage.GetSetCloser {
+			return memory.New(context.Background(), time.Hour, max(b.N, 1000)+1)
+		},
+		"journal": func(b *testing.B) storage.GetSetCloser {
+			s, err := journal.New(context.Background(), b.TempDir(), time.Hour, max(b.N, 1000)+1)
+			if err != nil {
+				b.Fatal(err)
+			}
+			return s
+		},
+	}
+	for name, newStorage := range backends {
+		b.Run(name+"/SET", func(b *testing.B) {
+			// the server owns st and closes it when it stops
+			st := newStorage(b)
+			s := newTestServer(b, WithStorage(st), WithWorkerCount(0), WithReaderCount(1), WithAckSet())
+			c, err := net.Dial("udp", startServer(b, s))
+			if err != nil {
+				b.Fatal(err)
+			}
+			defer c.Close()
+			needles := make([][]byte, b.N)
+			for i := range needles {
+				needles[i] = randomNeedle(b).Bytes()
+			}
+			ack := make([]byte, needle.HashLength)
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if err := roundTrip(c, needles[i], ack); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+		b.Run(name+"/GET", func(b *testing.B) {
+			// the server owns st and closes it when it stops
+			st := newStorage(b)
+			hashes := make([]needle.Hash, 1000)
+			for i := range hashes {
+				n := randomNeedle(b)
+				if err := st.Set(n); err != nil {
+					b.Fatal(err)
+				}
+				hashes[i] = n.Hash()
+			}
+			s := newTestServer(b, WithStorage(st), WithWorkerCount(0), WithReaderCount(1))
+			c, err := net.Dial("udp", startServer(b, s))
+			if err != nil {
+				b.Fatal(err)
+			}
+			defer c.Close()
+			resp := make([]byte, needle.NeedleLength)
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if err := roundTrip(c, hashes[i%len(hashes)][:], resp); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,103 @@
+package server
+
+import (
+	"errors"
+	"net"
+	"sync/atomic"
+	"time"
+)
+
+// Packet is a single request read from a PacketSource.
+type Packet struct {
+	// Data holds the request bytes. It must stay unchanged until Release is called.
+	Data []byte
+	// From identifies the sender in traces and logs. It may be nil.
+	From net.Addr
+	// Reply sends a response back to the sender. The server calls it at most once, and
+	// the response buffer is reused once it returns.
+	Reply func(resp []byte) error
+	// Release, if not nil, is called once the server is done with the packet, so the
+	// source can reuse Data.
+	Release func()
+}
+
+// PacketSource is a transport that delivers requests to the server and carries
+// responses back, such as a UDP socket, a unix datagram socket or a QUIC connection.
+// Every request must arrive as a single Packet, since the server dispatches on the
+// length of Data. ReadPacket is called from WithReaderCount goroutines at once and
+// must return an error wrapping net.ErrClosed once Close has been called, which stops
+// the server from reading. On shutdown the server closes a source before its handlers
+// finish, so their replies are lost, except for the sources created by this package,
+// which stop reading first and are closed once the requests already read are answered.
+type PacketSource interface {
+	ReadPacket() (*Packet, error)
+	Close() error
+}
+
+// Serve handles requests read from source until the context passed with WithContext
+// is done, then closes source and the storage. The address and interface options have
+// no effect since source is already connected.
+func Serve(source PacketSource, opts ...Option) error {
+	s, err := newServer("", opts...)
+	if err != nil {
+		return err
+	}
+	return s.serve(s.ctx, source)
+}
+
+// NewPacketConnSource returns a PacketSource that reads requests from and replies on
+// conn, so any datagram socket, such as a unix datagram socket from
+// net.ListenUnixgram, can be passed to Serve. The source closes conn when it is closed.
+func NewPacketConnSource(conn net.PacketConn) PacketSource {
+	return newUDPSource(conn, conn)
+}
+
+// udpSource is the PacketSource used by ListenAndServe. It reads requests from conn into
+// buffers from requestPool and replies from out, which is conn unless
+// WithResponseAddress is set.
+type udpSource struct {
+	conn    net.PacketConn
+	out     net.PacketConn
+	stopped atomic.Bool
+}
+
+func newUDPSource(conn, out net.PacketConn) *udpSource {
+	return &udpSource{conn: conn, out: out}
+}
+
+func (u *udpSource) ReadPacket() (*Packet, error) {
+	buf := requestPool.Get().(*[maxRequestLength]byte)
+	n, addr, err := u.conn.ReadFrom(buf[:])
+	if err != nil {
+		requestPool.Put(buf)
+		if u.stopped.Load() {
+			return nil, net.ErrClosed
+		}
+		return nil, err
+	}
+	return &Packet{
+		Data: buf[:n],
+		From: addr,
+		// WriteTo on a PacketConn returns only once the datagram has been handed
+		// to the kernel, so the response is safe to recycle after it returns.
+		Reply: func(resp []byte) error {
+			_, err := u.out.WriteTo(resp, addr)
+			return err
+		},
+		Release: func() { requestPool.Put(buf) },
+	}, nil
+}
+
+// stopReading unblocks pending reads with an expired deadline, leaving the sockets
+// open for replies.
+func (u *udpSource) stopReading() {
+	u.stopped.Store(true)
+	u.conn.SetReadDeadline(time.Now())
+}
+
+func (u *udpSource) Close() error {
+	if u.out != u.conn {
+		return errors.Join(u.conn.Close(), u.out.Close())
+	}
+	return u.conn.Close()
+}
@@ -0,0 +1,80 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// chanSource is a PacketSource fed from a channel that records replies.
+type chanSource struct {
+	packets chan []byte
+	closed  chan struct{}
+	once    sync.Once
+	replies chan []byte
+}
+
+func newChanSource() *chanSource {
+	return &chanSource{
+		packets: make(chan []byte),
+		closed:  make(chan struct{}),
+		replies: make(chan []byte, 10),
+	}
+}
+
+func (c *chanSource) ReadPacket() (*Packet, error) {
+	select {
+	case <-c.closed:
+		return nil, net.ErrClosed
+	case data := <-c.packets:
+		return &Packet{
+			Data: data,
+			Reply: func(resp []byte) error {
+				c.replies <- append([]byte(nil), resp...)
+				return nil
+			},
+		}, nil
+	}
+}
+
+func (c *chanSource) Close() error {
+	c.once.Do(func() { close(c.closed) })
+	return nil
+}
+
+func TestServe(t *testing.T) {
+	t.Parallel()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	source := newChanSource()
+	done := make(chan error, 1)
+	go func() { done <- Serve(source, WithContext(ctx), WithAckSet(), WithWorkerCount(1)) }()
+
+	n := randomNeedle(t)
+	hash := n.Hash()
+	source.packets <- n.Bytes()
+	source.packets <- hash[:]
+	for _, expected := range [][]byte{hash[:], n.Bytes()} {
+		select {
+		case resp := <-source.replies:
+			if !bytes.Equal(resp, expected) {
+				t.Errorf("unexpected reply\n%x\n%x", resp, expected)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("timed out waiting for a reply")
+		}
+	}
+
+	cancel()
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-source.closed:
+	default:
+		t.Error("expected Serve to close the source")
+	}
+}
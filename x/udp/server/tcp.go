@@ -0,0 +1,220 @@
+package server
+
+import (
+	"errors"
+	"log"
+	"net"
+	"os"
+	"os/signal"
+	"sync"
+	"time"
+
+	"github.com/nomasters/haystack/needle"
+	"github.com/nomasters/haystack/x/frame"
+)
+
+// tcpWriteTimeout bounds how long a reply may wait on a client that is not reading,
+// after which its connection is closed so it cannot hold up a worker.
+const tcpWriteTimeout = 5 * time.Second
+
+// ListenAndServeTCP serves requests on a TCP listener at address, for clients on
+// networks that block or shape UDP. Each request is a frame from the x/frame package:
+// OpGet with a 32 byte hash, answered by OpNeedle with the 192 byte needle on a hit,
+// or OpSet with a 192 byte needle, answered by OpAck with its hash if WithAckSet is
+// set. As with UDP, a miss is not answered. OpPing is handled as a PING and answered
+// with OpPong carrying the server time, and any other op closes the connection.
+// Requests, PINGs included, are handled by the same workers and storage as
+// ListenAndServe, so every option other than WithResponseAddress applies.
+func ListenAndServeTCP(address string, opts ...Option) error {
+	s, err := newServer(address, opts...)
+	if err != nil {
+		return err
+	}
+	lc := s.listenConfig()
+	ln, err := lc.Listen(s.ctx, "tcp", s.address)
+	if err != nil {
+		s.closeStorage()
+		return err
+	}
+	ctx, stop := signal.NotifyContext(s.ctx, os.Interrupt)
+	defer stop()
+	return s.serve(ctx, newTCPSource(ln))
+}
+
+// NewListenerSource returns a PacketSource that accepts connections from ln and reads
+// frames from them as ListenAndServeTCP does, so a stream listener can be passed to
+// Serve. The source closes ln and every connection when it is closed.
+func NewListenerSource(ln net.Listener) PacketSource {
+	return newTCPSource(ln)
+}
+
+// tcpSource is the PacketSource used by ListenAndServeTCP. A goroutine per connection
+// decodes frames and hands each request to ReadPacket, so a connection waits while
+// the workers are busy rather than queueing requests without bound.
+type tcpSource struct {
+	ln      net.Listener
+	packets chan *Packet
+	done    chan struct{}
+	once    sync.Once
+	wg      sync.WaitGroup
+	// closeErr is the error from closing ln, returned by Close.
+	closeErr error
+
+	mu    sync.Mutex
+	conns map[*tcpConn]struct{}
+}
+
+func newTCPSource(ln net.Listener) *tcpSource {
+	t := &tcpSource{
+		ln:      ln,
+		packets: make(chan *Packet),
+		done:    make(chan struct{}),
+		conns:   make(map[*tcpConn]struct{}),
+	}
+	t.wg.Add(1)
+	go t.accept()
+	return t
+}
+
+func (t *tcpSource) ReadPacket() (*Packet, error) {
+	select {
+	case <-t.done:
+		return nil, net.ErrClosed
+	case p := <-t.packets:
+		return p, nil
+	}
+}
+
+// stopReading stops accepting connections and reading requests, leaving the open
+// connections to carry the replies to requests already read.
+func (t *tcpSource) stopReading() {
+	t.once.Do(func() {
+		close(t.done)
+		t.closeErr = t.ln.Close()
+	})
+}
+
+// Close stops reading, closes the open connections and waits for their goroutines to
+// return.
+func (t *tcpSource) Close() error {
+	t.stopReading()
+	t.mu.Lock()
+	for c := range t.conns {
+		c.Close()
+	}
+	t.mu.Unlock()
+	t.wg.Wait()
+	return t.closeErr
+}
+
+func (t *tcpSource) accept() {
+	defer t.wg.Done()
+	for {
+		conn, err := t.ln.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			log.Printf("accept error: %v", err)
+			continue
+		}
+		c := &tcpConn{Conn: conn}
+		t.mu.Lock()
+		select {
+		case <-t.done:
+			t.mu.Unlock()
+			conn.Close()
+			return
+		default:
+		}
+		t.conns[c] = struct{}{}
+		t.wg.Add(1)
+		t.mu.Unlock()
+		go t.serve(c)
+	}
+}
+
+// serve reads frames from c until it is closed or sends a frame that is not a request,
+// then hangs up. Once reading stops, c is left open for replies until Close.
+func (t *tcpSource) serve(c *tcpConn) {
+	defer t.wg.Done()
+	hangUp := func() {
+		t.mu.Lock()
+		delete(t.conns, c)
+		t.mu.Unlock()
+		c.Close()
+	}
+	dec := frame.NewDecoder(c)
+	for {
+		op, body, err := dec.Decode()
+		if err != nil {
+			hangUp()
+			return
+		}
+		buf := requestPool.Get().(*[maxRequestLength]byte)
+		var n int
+		switch op {
+		case frame.OpGet, frame.OpSet:
+			n = copy(buf[:], body)
+		case frame.OpPing:
+			// a PING datagram, so the workers handle it exactly as they do over UDP
+			buf[0] = pingRequest
+			n = 1
+		default:
+			requestPool.Put(buf)
+			hangUp()
+			return
+		}
+		p := &Packet{
+			Data:    buf[:n],
+			From:    c.RemoteAddr(),
+			Reply:   func(resp []byte) error { return c.replyResponse(op, resp) },
+			Release: func() { requestPool.Put(buf) },
+		}
+		select {
+		case t.packets <- p:
+		case <-t.done:
+			requestPool.Put(buf)
+			return
+		}
+	}
+}
+
+// tcpConn serializes the replies written to a connection by concurrent workers.
+type tcpConn struct {
+	net.Conn
+	mu sync.Mutex
+}
+
+// replyResponse frames a response from processRequest to a request sent as op: a
+// needle for OpGet as OpNeedle, a pong for OpPing as OpPong with the server time and
+// each acknowledged hash for OpSet as OpAck. The op is passed rather than inferred
+// from the length, since a needle and an acknowledgement of six hashes are both 192
+// bytes.
+func (c *tcpConn) replyResponse(op frame.Op, resp []byte) error {
+	switch op {
+	case frame.OpGet:
+		return c.reply(frame.OpNeedle, resp)
+	case frame.OpPing:
+		return c.reply(frame.OpPong, resp[len(pongPrefix):])
+	}
+	for i := 0; i+needle.HashLength <= len(resp); i += needle.HashLength {
+		if err := c.reply(frame.OpAck, resp[i:i+needle.HashLength]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// reply writes a single frame, closing the connection if the client does not read it
+// within tcpWriteTimeout.
+func (c *tcpConn) reply(op frame.Op, body []byte) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.SetWriteDeadline(time.Now().Add(tcpWriteTimeout))
+	err := frame.Encode(c.Conn, op, body)
+	if err != nil {
+		c.Close()
+	}
+	return err
+}
@@ -0,0 +1,175 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/nomasters/haystack/needle"
+	"github.com/nomasters/haystack/x/frame"
+)
+
+func TestListenAndServeTCP(t *testing.T) {
+	t.Parallel()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := ln.Addr().String()
+	ln.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- ListenAndServeTCP(addr, WithContext(ctx), WithAckSet(), WithWorkerCount(2)) }()
+
+	var conn net.Conn
+	for start := time.Now(); ; time.Sleep(10 * time.Millisecond) {
+		if conn, err = net.Dial("tcp", addr); err == nil {
+			break
+		}
+		if time.Since(start) > time.Second {
+			t.Fatal(err)
+		}
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(time.Second))
+	dec := frame.NewDecoder(conn)
+	expect := func(op frame.Op, body []byte) {
+		t.Helper()
+		gotOp, gotBody, err := dec.Decode()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if gotOp != op || !bytes.Equal(gotBody, body) {
+			t.Fatalf("expected %v %x, got %v %x", op, body, gotOp, gotBody)
+		}
+	}
+	start := time.Now()
+	expectPong := func() {
+		t.Helper()
+		op, body, err := dec.Decode()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if op != frame.OpPong {
+			t.Fatalf("expected %v, got %v", frame.OpPong, op)
+		}
+		if sent := time.Unix(0, int64(binary.BigEndian.Uint64(body))); sent.Before(start) || sent.After(time.Now()) {
+			t.Errorf("expected the server time in the pong, got %v", sent)
+		}
+	}
+
+	n := randomNeedle(t)
+	hash := n.Hash()
+	if err := frame.Encode(conn, frame.OpSet, n.Bytes()); err != nil {
+		t.Fatal(err)
+	}
+	expect(frame.OpAck, hash[:])
+	if err := frame.Encode(conn, frame.OpGet, hash[:]); err != nil {
+		t.Fatal(err)
+	}
+	expect(frame.OpNeedle, n.Bytes())
+	if err := frame.Encode(conn, frame.OpPing, nil); err != nil {
+		t.Fatal(err)
+	}
+	expectPong()
+
+	// a miss is not answered, so the ping sent after it is answered first
+	missing := randomNeedle(t).Hash()
+	frame.Encode(conn, frame.OpGet, missing[:])
+	frame.Encode(conn, frame.OpPing, nil)
+	expectPong()
+
+	// a response op is not a request, so the server hangs up
+	if err := frame.Encode(conn, frame.OpAck, hash[:]); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := dec.Decode(); !errors.Is(err, io.EOF) {
+		t.Errorf("expected %v, got: %v", io.EOF, err)
+	}
+
+	// shutting down closes connections that are still open
+	idle, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer idle.Close()
+	frame.Encode(idle, frame.OpPing, nil)
+	idle.SetDeadline(time.Now().Add(time.Second))
+	if op, _, err := frame.NewDecoder(idle).Decode(); err != nil || op != frame.OpPong {
+		t.Fatalf("expected %v, got %v: %v", frame.OpPong, op, err)
+	}
+	cancel()
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	if _, err := idle.Read(make([]byte, 1)); !errors.Is(err, io.EOF) {
+		t.Errorf("expected %v after shutdown, got: %v", io.EOF, err)
+	}
+}
+
+// TestTCPPingRateLimited checks that a PING over TCP is handled like any other request.
+func TestTCPPingRateLimited(t *testing.T) {
+	t.Parallel()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	m := NewMetrics(0)
+	done := make(chan error, 1)
+	go func() {
+		done <- Serve(NewListenerSource(ln), WithContext(ctx), WithMetrics(m), WithRateLimit(0.001, 1), WithWorkerCount(1))
+	}()
+	defer func() {
+		cancel()
+		if err := <-done; err != nil {
+			t.Error(err)
+		}
+	}()
+
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(time.Second))
+	frame.Encode(conn, frame.OpPing, nil)
+	frame.Encode(conn, frame.OpPing, nil)
+	if op, body, err := frame.NewDecoder(conn).Decode(); err != nil || op != frame.OpPong || len(body) != 8 {
+		t.Fatalf("expected %v with the server time, got %v %x: %v", frame.OpPong, op, body, err)
+	}
+	for start := time.Now(); m.Snapshot().RateLimited != 1; time.Sleep(time.Millisecond) {
+		if time.Since(start) > time.Second {
+			t.Fatalf("expected the second ping to be rate limited, got %+v", m.Snapshot())
+		}
+	}
+}
+
+// TestReplyResponseOp checks that replies are framed by the op of the request, since
+// an acknowledgement of six hashes is as long as a needle.
+func TestReplyResponseOp(t *testing.T) {
+	t.Parallel()
+	local, remote := net.Pipe()
+	defer remote.Close()
+	c := &tcpConn{Conn: local}
+	acks := make([]byte, needle.NeedleLength)
+	go func() {
+		defer c.Close()
+		c.replyResponse(frame.OpSet, acks)
+	}()
+	dec := frame.NewDecoder(remote)
+	for i := 0; i < needle.NeedleLength/needle.HashLength; i++ {
+		if op, body, err := dec.Decode(); err != nil || op != frame.OpAck || len(body) != needle.HashLength {
+			t.Fatalf("ack %d: expected %v, got %v %x: %v", i, frame.OpAck, op, body, err)
+		}
+	}
+	if _, _, err := dec.Decode(); !errors.Is(err, io.EOF) {
+		t.Errorf("expected %v after the acks, got: %v", io.EOF, err)
+	}
+}
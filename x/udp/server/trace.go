@@ -0,0 +1,126 @@
+package server
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/nomasters/haystack/needle"
+)
+
+// Op is the type of operation recorded in an Event.
+type Op string
+
+const (
+	// OpGet is a request for a needle by hash.
+	OpGet Op = "get"
+	// OpSet is a request to store a needle.
+	OpSet Op = "set"
+)
+
+// Event describes a single operation handled by the server.
+type Event struct {
+	Time time.Time
+	Op   Op
+	Hash needle.Hash
+	// OK reports whether a GET hit or a SET was stored.
+	OK     bool
+	Source net.Addr
+}
+
+// String formats the event as a single trace line with an abbreviated hash.
+func (e Event) String() string {
+	result := "miss"
+	switch {
+	case e.Op == OpGet && e.OK:
+		result = "hit"
+	case e.Op == OpSet && e.OK:
+		result = "stored"
+	case e.Op == OpSet:
+		result = "rejected"
+	}
+	source := "-"
+	if e.Source != nil {
+		source = e.Source.String()
+	}
+	return fmt.Sprintf("%s %s %x %s %s", e.Time.Format(time.RFC3339Nano), e.Op, e.Hash[:4], result, source)
+}
+
+// Trace records the operations handled by a server for debugging. Every event is kept
+// in a fixed size ring buffer that can be read with Recent, and events are optionally
+// written as lines to a writer, rate limited so a busy server cannot flood it. It is
+// safe for concurrent use and is passed to the server with WithTrace.
+type Trace struct {
+	mu     sync.Mutex
+	events []Event
+	next   int
+	full   bool
+
+	w         io.Writer
+	perSecond int
+	second    int64
+	written   int
+	dropped   int
+	now       func() time.Time
+}
+
+// NewTrace returns a pointer to a Trace keeping the last size events. If w is not nil,
+// at most perSecond events a second are also written to it, and the number of events
+// skipped is reported once the limit resets.
+func NewTrace(size int, w io.Writer, perSecond int) *Trace {
+	return &Trace{
+		events:    make([]Event, max(size, 1)),
+		w:         w,
+		perSecond: perSecond,
+		now:       time.Now,
+	}
+}
+
+// Recent returns the buffered events, oldest first.
+func (t *Trace) Recent() []Event {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if !t.full {
+		return append([]Event(nil), t.events[:t.next]...)
+	}
+	return append(append([]Event(nil), t.events[t.next:]...), t.events[:t.next]...)
+}
+
+func (t *Trace) record(op Op, hash []byte, ok bool, source net.Addr) {
+	e := Event{Time: t.now(), Op: op, OK: ok, Source: source}
+	copy(e.Hash[:], hash)
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.events[t.next] = e
+	t.next = (t.next + 1) % len(t.events)
+	if t.next == 0 {
+		t.full = true
+	}
+
+	if t.w == nil {
+		return
+	}
+	if second := e.Time.Unix(); second != t.second {
+		if t.dropped > 0 {
+			fmt.Fprintf(t.w, "%d events dropped\n", t.dropped)
+		}
+		t.second, t.written, t.dropped = second, 0, 0
+	}
+	if t.written >= t.perSecond {
+		t.dropped++
+		return
+	}
+	t.written++
+	fmt.Fprintln(t.w, e)
+}
+
+// WithTrace passes a Trace to the server, which records every GET and SET it handles.
+func WithTrace(t *Trace) Option {
+	return func(svr *server) error {
+		svr.trace = t
+		return nil
+	}
+}
@@ -0,0 +1,49 @@
+package server
+
+import (
+	"bytes"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTrace(t *testing.T) {
+	t.Parallel()
+
+	var out bytes.Buffer
+	trace := NewTrace(2, &out, 1)
+	now := time.Unix(1000, 0)
+	trace.now = func() time.Time { return now }
+	s := newTestServer(t, WithTrace(trace))
+	addr := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 1337}
+
+	n := randomNeedle(t)
+	hash := n.Hash()
+	s.processRequest(hash[:], addr)
+	s.processRequest(n.Bytes(), addr)
+	s.processRequest(hash[:], addr)
+
+	events := trace.Recent()
+	if len(events) != 2 {
+		t.Fatalf("expected the ring buffer to hold 2 events, got %v", len(events))
+	}
+	if e := events[0]; e.Op != OpSet || !e.OK || e.Hash != hash {
+		t.Errorf("unexpected first event: %v", e)
+	}
+	if e := events[1]; e.Op != OpGet || !e.OK || e.Source != addr {
+		t.Errorf("unexpected second event: %v", e)
+	}
+
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	if len(lines) != 1 || !strings.Contains(lines[0], "get") || !strings.Contains(lines[0], "miss") {
+		t.Fatalf("expected only the first event to be written within the rate limit, got: %q", lines)
+	}
+
+	now = now.Add(time.Second)
+	s.processRequest(hash[:], addr)
+	lines = strings.Split(strings.TrimSpace(out.String()), "\n")
+	if len(lines) != 3 || lines[1] != "2 events dropped" || !strings.Contains(lines[2], "hit 127.0.0.1:1337") {
+		t.Errorf("expected dropped events to be reported when the limit resets, got: %q", lines)
+	}
+}